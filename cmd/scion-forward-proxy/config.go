@@ -0,0 +1,341 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/scionproto-contrib/http-proxy/forward"
+	"github.com/scionproto-contrib/http-proxy/forward/accesslog"
+	"github.com/scionproto-contrib/http-proxy/forward/acl"
+	"github.com/scionproto-contrib/http-proxy/forward/auth"
+	"github.com/scionproto-contrib/http-proxy/forward/hostsfile"
+	"github.com/scionproto-contrib/http-proxy/forward/pac"
+	"github.com/scionproto-contrib/http-proxy/forward/panpolicy"
+	"github.com/scionproto-contrib/http-proxy/forward/ratelimit"
+)
+
+const (
+	defaultListen          = ":8080"
+	defaultShutdownTimeout = 10 * time.Second
+	defaultRealm           = "scion-forward-proxy"
+
+	// adminTokenEnv is the environment variable holding the admin token, such that it
+	// need not be written to the configuration file.
+	adminTokenEnv = "SCION_FORWARD_PROXY_ADMIN_TOKEN"
+)
+
+// config is the configuration file of the proxy, unset fields take the defaults of
+// the forward package.
+type config struct {
+	// Listen is the address the proxy listens on, :8080 by default.
+	Listen string `json:"listen"`
+	// TLSCert and TLSKey are the certificate and key files, without them the proxy
+	// is served over plain HTTP.
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+	// SOCKS5Listen is the address of the SOCKS5 front-end, which is not served if empty.
+	SOCKS5Listen string `json:"socks5_listen"`
+	// APIHosts are the host names under which the endpoints of the proxy, e.g., /policy,
+	// are served. Requests for any other host are proxied. By default, the host name of the
+	// hosts file entry, e.g., forward-proxy.scion.
+	APIHosts        []string `json:"api_hosts"`
+	ShutdownTimeout duration `json:"shutdown_timeout"`
+
+	ResolveTimeout       duration `json:"resolve_timeout"`
+	DialTimeout          duration `json:"dial_timeout"`
+	PurgeTimeout         duration `json:"purge_timeout"`
+	PurgeInterval        duration `json:"purge_interval"`
+	DisablePurgeInactive bool     `json:"disable_purge_inactive"`
+
+	AdminToken string `json:"admin_token"`
+
+	// Auth makes clients authenticate with any of the configured methods, by default
+	// anyone reaching the proxy can use it.
+	Auth struct {
+		Realm string `json:"realm"`
+		// Htpasswd is a file of users with bcrypt hashed passwords, see `htpasswd -B`.
+		Htpasswd string `json:"htpasswd"`
+		// BearerTokens is a file with a user:token pair per line.
+		BearerTokens string `json:"bearer_tokens"`
+		// ClientCA is the file of the CAs issuing the client certificates, it requires TLS.
+		ClientCA string `json:"client_ca"`
+	} `json:"auth"`
+	// AccessControl decides which destinations clients may reach, acl.DefaultList if not set.
+	AccessControl *acl.List `json:"access_control"`
+
+	CountryMapping    string `json:"country_mapping"`
+	MultipathSubflows int    `json:"multipath_subflows"`
+	Fallback          *struct {
+		Cooldown duration `json:"cooldown"`
+	} `json:"fallback"`
+	Racing *struct {
+		HeadStart duration `json:"head_start"`
+	} `json:"racing"`
+	// Upstream routes the connections over TCP/IP through parent proxies.
+	Upstream panpolicy.UpstreamConfig `json:"upstream"`
+	// PAC configures the proxy auto-config file served under /proxy.pac.
+	PAC pac.Config `json:"pac"`
+	// TunnelIdleTimeout is 5min if not set, 0 disables it.
+	TunnelIdleTimeout *duration `json:"tunnel_idle_timeout"`
+	TunnelMaxLifetime duration  `json:"tunnel_max_lifetime"`
+	Bandwidth         struct {
+		Global         limit `json:"global"`
+		PerSession     limit `json:"per_session"`
+		PerDestination limit `json:"per_destination"`
+	} `json:"bandwidth"`
+
+	AccessLog *struct {
+		Path       string `json:"path"`
+		Format     string `json:"format"`
+		MaxSize    int64  `json:"max_size"`
+		MaxBackups int    `json:"max_backups"`
+	} `json:"access_log"`
+	HostsFile struct {
+		Disabled  bool     `json:"disabled"`
+		Path      string   `json:"path"`
+		HostName  string   `json:"host_name"`
+		Addresses []string `json:"addresses"`
+	} `json:"hosts_file"`
+}
+
+type limit struct {
+	BytesPerSecond int `json:"bytes_per_second"`
+	Burst          int `json:"burst"`
+}
+
+func (l limit) limit() ratelimit.Limit {
+	return ratelimit.Limit{BytesPerSecond: l.BytesPerSecond, Burst: l.Burst}
+}
+
+// duration is a time.Duration in the format of time.ParseDuration, e.g., "1m30s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// loadConfig reads the configuration file at path, or returns the defaults if path is empty.
+func loadConfig(path string) (config, error) {
+	var c config
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return c, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&c); err != nil {
+			return c, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+	if c.Listen == "" {
+		c.Listen = defaultListen
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = duration(defaultShutdownTimeout)
+	}
+	if token := os.Getenv(adminTokenEnv); token != "" {
+		c.AdminToken = token
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return c, fmt.Errorf("both tls_cert and tls_key must be set")
+	}
+	return c, nil
+}
+
+func (c config) hostsFileConfig() (hostsfile.Config, error) {
+	hc := hostsfile.Config{
+		Disabled: c.HostsFile.Disabled,
+		Path:     c.HostsFile.Path,
+		HostName: c.HostsFile.HostName,
+	}
+	for _, a := range c.HostsFile.Addresses {
+		addr, err := netip.ParseAddr(a)
+		if err != nil {
+			return hc, fmt.Errorf("hosts file address: %w", err)
+		}
+		hc.Addresses = append(hc.Addresses, addr)
+	}
+	return hc, nil
+}
+
+// authenticator returns the authenticator of the configured methods, or nil if
+// authentication is not required.
+func (c config) authenticator() (auth.Authenticator, error) {
+	realm := c.Auth.Realm
+	if realm == "" {
+		realm = defaultRealm
+	}
+	var chain auth.Chain
+	if c.Auth.ClientCA != "" {
+		chain = append(chain, auth.ClientCertificate{})
+	}
+	if c.Auth.Htpasswd != "" {
+		htpasswd, err := auth.LoadHtpasswd(c.Auth.Htpasswd, realm)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, htpasswd)
+	}
+	if c.Auth.BearerTokens != "" {
+		bearer, err := auth.LoadBearerTokens(c.Auth.BearerTokens, realm)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, bearer)
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	return chain, nil
+}
+
+// tlsConfig returns the TLS configuration requesting client certificates, or nil if
+// they are not configured.
+func (c config) tlsConfig() (*tls.Config, error) {
+	if c.Auth.ClientCA == "" {
+		return nil, nil
+	}
+	if c.TLSCert == "" {
+		return nil, fmt.Errorf("auth.client_ca requires tls_cert and tls_key")
+	}
+	pem, err := os.ReadFile(c.Auth.ClientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", c.Auth.ClientCA)
+	}
+	return &tls.Config{
+		ClientCAs: pool,
+		// clients without certificates may authenticate with the other methods
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}, nil
+}
+
+func (c config) apiHosts() []string {
+	if len(c.APIHosts) > 0 {
+		return c.APIHosts
+	}
+	if c.HostsFile.HostName != "" {
+		return []string{c.HostsFile.HostName}
+	}
+	return []string{hostsfile.DefaultHostName}
+}
+
+// newProxy creates the proxy as configured, it is to be initialized by the caller.
+func (c config) newProxy(logger *zap.Logger) (*forward.CoreProxy, error) {
+	pc := forward.DefaultConfig()
+	for _, d := range []struct {
+		dst *time.Duration
+		src duration
+	}{
+		{&pc.ResolveTimeout, c.ResolveTimeout},
+		{&pc.DialTimeout, c.DialTimeout},
+		{&pc.PurgeTimeout, c.PurgeTimeout},
+		{&pc.PurgeInterval, c.PurgeInterval},
+	} {
+		if d.src != 0 {
+			*d.dst = time.Duration(d.src)
+		}
+	}
+	pc.DisablePurgeInactive = c.DisablePurgeInactive
+
+	proxy, err := forward.NewCoreProxyWithConfig(pc, forward.WithLogger(logger))
+	if err != nil {
+		return nil, err
+	}
+	hc, err := c.hostsFileConfig()
+	if err != nil {
+		return nil, err
+	}
+	proxy.SetHostsFile(hc)
+	proxy.SetAdminToken(c.AdminToken)
+	authenticator, err := c.authenticator()
+	if err != nil {
+		return nil, err
+	}
+	if authenticator != nil {
+		proxy.SetAuthenticator(authenticator)
+	}
+	if c.AccessControl != nil {
+		proxy.SetAccessControl(c.AccessControl)
+	}
+	if c.CountryMapping != "" {
+		proxy.SetCountryMappingFile(c.CountryMapping)
+	}
+	if c.MultipathSubflows > 1 {
+		proxy.EnableMultipath(c.MultipathSubflows)
+	}
+	if c.Fallback != nil {
+		proxy.EnableFallback(time.Duration(c.Fallback.Cooldown))
+	}
+	if c.Racing != nil {
+		proxy.EnableRacing(time.Duration(c.Racing.HeadStart))
+	}
+	proxy.SetUpstreamProxies(c.Upstream)
+	proxy.SetPACConfig(c.PAC)
+	if c.TunnelIdleTimeout != nil || c.TunnelMaxLifetime != 0 {
+		idle := forward.DefaultTunnelIdleTimeout
+		if c.TunnelIdleTimeout != nil {
+			idle = time.Duration(*c.TunnelIdleTimeout)
+		}
+		proxy.SetTunnelTimeouts(idle, time.Duration(c.TunnelMaxLifetime))
+	}
+	proxy.SetBandwidthLimits(ratelimit.Config{
+		Global:         c.Bandwidth.Global.limit(),
+		PerSession:     c.Bandwidth.PerSession.limit(),
+		PerDestination: c.Bandwidth.PerDestination.limit(),
+	})
+	if c.AccessLog != nil {
+		format := accesslog.FormatJSON
+		if c.AccessLog.Format != "" {
+			if format, err = accesslog.ParseFormat(c.AccessLog.Format); err != nil {
+				return nil, err
+			}
+		}
+		file, err := accesslog.NewRotatingFile(c.AccessLog.Path, c.AccessLog.MaxSize, c.AccessLog.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		log, err := accesslog.New(file, format)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		proxy.SetAccessLog(log)
+	}
+	return proxy, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command scion-forward-proxy runs the SCION HTTP forward proxy as a standalone server,
+// without Caddy.
+//
+// Usage:
+//
+//	scion-forward-proxy [-config proxy.json] [-listen :8080] [-tls-cert cert.pem -tls-key key.pem] [-log-level info]
+//
+// The flags take precedence over the configuration file. If socks5_listen is configured,
+// a SOCKS5 front-end is served next to the HTTP proxy. The proxy is stopped gracefully
+// on SIGINT or SIGTERM, and the session keys are reloaded on SIGHUP.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/scionproto-contrib/http-proxy/forward"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	configPath := flag.String("config", "", "path to the JSON configuration file")
+	listen := flag.String("listen", "", "address to listen on (default "+defaultListen+")")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file, the proxy is served over plain HTTP without it")
+	tlsKey := flag.String("tls-key", "", "TLS key file")
+	logLevel := flag.String("log-level", "info", "log level: debug, info, warn or error")
+	flag.Parse()
+
+	level, err := zapcore.ParseLevel(*logLevel)
+	if err != nil {
+		return err
+	}
+	logConfig := zap.NewProductionConfig()
+	logConfig.Level = zap.NewAtomicLevelAt(level)
+	logger, err := logConfig.Build()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = logger.Sync() }()
+
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if *listen != "" {
+		c.Listen = *listen
+	}
+	if *tlsCert != "" || *tlsKey != "" {
+		c.TLSCert, c.TLSKey = *tlsCert, *tlsKey
+	}
+
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return err
+	}
+	proxy, err := c.newProxy(logger)
+	if err != nil {
+		return err
+	}
+	if err := proxy.Initialize(); err != nil {
+		return err
+	}
+	defer func() {
+		if err := proxy.Cleanup(); err != nil {
+			logger.Warn("Failed to clean up proxy.", zap.Error(err))
+		}
+	}()
+
+	errorLog, err := zap.NewStdLogAt(logger.With(zap.String("component", "http-server")), zapcore.DebugLevel)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:           newHandler(logger, proxy, c.apiHosts()),
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          errorLog,
+		TLSConfig:         tlsConfig,
+	}
+	listener, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		return err
+	}
+
+	serveErr := make(chan error, 2)
+	if c.SOCKS5Listen != "" {
+		socksListener, err := net.Listen("tcp", c.SOCKS5Listen)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		socksServer := proxy.NewSOCKS5Server()
+		// tunnels are closed on exit, like the hijacked tunnels of the HTTP server
+		defer socksServer.Close()
+		go func() {
+			logger.Info("Serving SOCKS5 front-end.", zap.String("address", socksListener.Addr().String()))
+			if err := socksServer.Serve(socksListener); !errors.Is(err, forward.ErrSOCKS5ServerClosed) {
+				serveErr <- err
+			}
+		}()
+	}
+	go func() {
+		logger.Info("Serving forward proxy.", zap.String("address", listener.Addr().String()), zap.Bool("tls", c.TLSCert != ""))
+		if c.TLSCert != "" {
+			serveErr <- server.ServeTLS(listener, c.TLSCert, c.TLSKey)
+		} else {
+			logger.Warn("Serving without TLS, the path policies of the clients are sent in the clear.")
+			serveErr <- server.Serve(listener)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case err := <-serveErr:
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if err := proxy.ReloadSessionKeys(); err != nil {
+					logger.Warn("Failed to reload session keys.", zap.Error(err))
+				}
+				continue
+			}
+			logger.Info("Shutting down.", zap.String("signal", sig.String()))
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.ShutdownTimeout))
+			defer cancel()
+			// hijacked tunnels are not waited for, they are closed on exit
+			if err := server.Shutdown(ctx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+				return err
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/scionproto-contrib/http-proxy/forward/utils"
+)
+
+// Paths of the endpoints of the proxy on the API hosts.
+const (
+	pathHealth          = "/health"
+	pathPolicy          = "/policy"
+	pathPathUsage       = "/path-usage"
+	pathSharedPathUsage = "/admin/path-usage"
+	pathMetrics         = "/admin/metrics"
+	pathResolveURL      = "/redirect"
+	pathResolveHost     = "/resolve"
+	pathPAC             = "/proxy.pac"
+)
+
+// proxy is the part of forward.CoreProxy served by the handler.
+type proxy interface {
+	HandleHealthCheck(w http.ResponseWriter, r *http.Request) error
+	HandlePolicyPath(w http.ResponseWriter, r *http.Request) error
+	HandlePathUsage(w http.ResponseWriter, r *http.Request) error
+	HandleSharedPathUsage(w http.ResponseWriter, r *http.Request) error
+	HandlePrometheusMetrics(w http.ResponseWriter, r *http.Request) error
+	HandleResolveURL(w http.ResponseWriter, r *http.Request) error
+	HandleResolveHost(w http.ResponseWriter, r *http.Request) error
+	HandlePAC(w http.ResponseWriter, r *http.Request) error
+	HandleTunnelRequest(w http.ResponseWriter, r *http.Request) error
+}
+
+// newHandler returns the handler serving the endpoints of the proxy for requests to one of
+// the API hosts, and proxying all other requests.
+func newHandler(logger *zap.Logger, p proxy, apiHosts []string) http.Handler {
+	mux := http.NewServeMux()
+	for path, handle := range map[string]func(http.ResponseWriter, *http.Request) error{
+		pathHealth:          p.HandleHealthCheck,
+		pathPolicy:          p.HandlePolicyPath,
+		pathPathUsage:       p.HandlePathUsage,
+		pathSharedPathUsage: p.HandleSharedPathUsage,
+		pathMetrics:         p.HandlePrometheusMetrics,
+		pathResolveURL:      p.HandleResolveURL,
+		pathResolveHost:     p.HandleResolveHost,
+		pathPAC:             p.HandlePAC,
+	} {
+		mux.Handle(path, errorHandler(logger, handle))
+	}
+	tunnel := errorHandler(logger, p.HandleTunnelRequest)
+
+	hosts := make(map[string]struct{}, len(apiHosts))
+	for _, h := range apiHosts {
+		hosts[strings.ToLower(h)] = struct{}{}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect && !r.URL.IsAbs() {
+			if _, ok := hosts[hostOnly(r.Host)]; ok {
+				mux.ServeHTTP(w, r)
+				return
+			}
+		}
+		tunnel.ServeHTTP(w, r)
+	})
+}
+
+// errorHandler writes the error returned by handle, if any, with the status of the
+// utils.HandlerError it wraps, or 500.
+func errorHandler(logger *zap.Logger, handle func(http.ResponseWriter, *http.Request) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := handle(w, r)
+		if err == nil {
+			return
+		}
+		status := http.StatusInternalServerError
+		var he *utils.HandlerError
+		if errors.As(err, &he) && he.StatusCode != 0 {
+			status = he.StatusCode
+		}
+		logger.Debug("Request failed.", zap.String("host", r.Host), zap.Int("status", status), zap.Error(err))
+		http.Error(w, err.Error(), status)
+	})
+}
+
+func hostOnly(hostPort string) string {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = hostPort
+	}
+	return strings.ToLower(host)
+}
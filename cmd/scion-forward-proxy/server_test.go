@@ -0,0 +1,173 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/scionproto-contrib/http-proxy/forward/acl"
+	"github.com/scionproto-contrib/http-proxy/forward/utils"
+)
+
+// recordingProxy records the handler called, tunnels fail with 407.
+type recordingProxy struct {
+	called string
+}
+
+func (p *recordingProxy) handle(name string) error {
+	p.called = name
+	return nil
+}
+
+func (p *recordingProxy) HandleHealthCheck(http.ResponseWriter, *http.Request) error {
+	return p.handle("health")
+}
+func (p *recordingProxy) HandlePolicyPath(http.ResponseWriter, *http.Request) error {
+	return p.handle("policy")
+}
+func (p *recordingProxy) HandlePathUsage(http.ResponseWriter, *http.Request) error {
+	return p.handle("path-usage")
+}
+func (p *recordingProxy) HandleSharedPathUsage(http.ResponseWriter, *http.Request) error {
+	return p.handle("shared-path-usage")
+}
+func (p *recordingProxy) HandlePrometheusMetrics(http.ResponseWriter, *http.Request) error {
+	return p.handle("metrics")
+}
+func (p *recordingProxy) HandleResolveURL(http.ResponseWriter, *http.Request) error {
+	return p.handle("redirect")
+}
+func (p *recordingProxy) HandleResolveHost(http.ResponseWriter, *http.Request) error {
+	return p.handle("resolve")
+}
+func (p *recordingProxy) HandlePAC(http.ResponseWriter, *http.Request) error {
+	return p.handle("pac")
+}
+func (p *recordingProxy) HandleTunnelRequest(http.ResponseWriter, *http.Request) error {
+	p.called = "tunnel"
+	return utils.NewHandlerError(http.StatusProxyAuthRequired, errors.New("no credentials"))
+}
+
+func TestHandler(t *testing.T) {
+	cases := map[string]struct {
+		method         string
+		target         string
+		host           string
+		expectedCalled string
+		expectedCode   int
+	}{
+		"health":                 {method: http.MethodGet, target: "/health", host: "forward-proxy.scion", expectedCalled: "health", expectedCode: http.StatusOK},
+		"policy with port":       {method: http.MethodPut, target: "/policy", host: "forward-proxy.scion:8080", expectedCalled: "policy", expectedCode: http.StatusOK},
+		"admin metrics":          {method: http.MethodGet, target: "/admin/metrics", host: "Forward-Proxy.scion", expectedCalled: "metrics", expectedCode: http.StatusOK},
+		"pac":                    {method: http.MethodGet, target: "/proxy.pac", host: "forward-proxy.scion:8080", expectedCalled: "pac", expectedCode: http.StatusOK},
+		"forward":                {method: http.MethodGet, target: "http://example.org/", host: "example.org", expectedCalled: "tunnel", expectedCode: http.StatusProxyAuthRequired},
+		"forward to api host":    {method: http.MethodGet, target: "http://forward-proxy.scion/policy", host: "forward-proxy.scion", expectedCalled: "tunnel", expectedCode: http.StatusProxyAuthRequired},
+		"connect":                {method: http.MethodConnect, target: "forward-proxy.scion:443", host: "forward-proxy.scion:443", expectedCalled: "tunnel", expectedCode: http.StatusProxyAuthRequired},
+		"unknown path":           {method: http.MethodGet, target: "/unknown", host: "forward-proxy.scion", expectedCode: http.StatusNotFound},
+		"origin form other host": {method: http.MethodGet, target: "/", host: "example.org", expectedCalled: "tunnel", expectedCode: http.StatusProxyAuthRequired},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			p := &recordingProxy{}
+			h := newHandler(zap.NewNop(), p, []string{"forward-proxy.scion"})
+
+			r := httptest.NewRequest(c.method, c.target, nil)
+			r.Host = c.host
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, c.expectedCalled, p.called)
+			assert.Equal(t, c.expectedCode, w.Code)
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"listen": "127.0.0.1:9090",
+		"pac": {"hosts": ["*.scionlab.org"]},
+		"socks5_listen": "127.0.0.1:1080",
+		"dial_timeout": "3s",
+		"tunnel_idle_timeout": "0s",
+		"hosts_file": {"disabled": true, "host_name": "proxy.example"},
+		"bandwidth": {"per_session": {"bytes_per_second": 1000}},
+		"access_control": {"rules": [{"action": "allow", "networks": ["10.0.0.0/8"]}], "default": "deny"},
+		"upstream": {"rules": [{"hosts": ["*.internal"], "proxy": "direct"}], "default": "http://gateway:3128"}
+	}`), 0o600))
+	t.Setenv(adminTokenEnv, "secret")
+
+	c, err := loadConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:9090", c.Listen)
+	assert.Equal(t, "127.0.0.1:1080", c.SOCKS5Listen)
+	assert.Equal(t, duration(3*time.Second), c.DialTimeout)
+	require.NotNil(t, c.TunnelIdleTimeout)
+	assert.Zero(t, *c.TunnelIdleTimeout)
+	assert.Equal(t, duration(defaultShutdownTimeout), c.ShutdownTimeout)
+	assert.Equal(t, "secret", c.AdminToken)
+	assert.Equal(t, []string{"proxy.example"}, c.apiHosts())
+	require.NotNil(t, c.AccessControl)
+	assert.Equal(t, acl.Deny, c.AccessControl.Default)
+	assert.Equal(t, "http://gateway:3128", c.Upstream.Default)
+	assert.Equal(t, []string{"*.scionlab.org"}, c.PAC.Hosts)
+	_, err = c.newProxy(zap.NewNop())
+	assert.NoError(t, err)
+
+	defaults, err := loadConfig("")
+	require.NoError(t, err)
+	assert.Equal(t, defaultListen, defaults.Listen)
+
+	for name, content := range map[string]string{
+		"unknown field":    `{"listn": ":8080"}`,
+		"numeric duration": `{"dial_timeout": 3}`,
+		"cert sans key":    `{"tls_cert": "cert.pem"}`,
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err := loadConfig(path)
+		assert.Error(t, err, name)
+	}
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"purge_interval": "1h", "purge_timeout": "1m"}`), 0o600))
+	c, err = loadConfig(path)
+	require.NoError(t, err)
+	_, err = c.newProxy(zap.NewNop())
+	assert.Error(t, err, "inconsistent purge timeouts accepted")
+
+	tokens := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(tokens, []byte("alice:token-of-alice\n"), 0o600))
+	require.NoError(t, os.WriteFile(path, []byte(`{"auth": {"bearer_tokens": "`+tokens+`"}}`), 0o600))
+	c, err = loadConfig(path)
+	require.NoError(t, err)
+	authenticator, err := c.authenticator()
+	require.NoError(t, err)
+	assert.Equal(t, []string{`Bearer realm="scion-forward-proxy"`}, authenticator.Challenges())
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"auth": {"client_ca": "ca.pem"}}`), 0o600))
+	c, err = loadConfig(path)
+	require.NoError(t, err)
+	_, err = c.tlsConfig()
+	assert.Error(t, err, "client certificates accepted without TLS")
+}
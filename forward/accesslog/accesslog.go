@@ -0,0 +1,217 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package accesslog writes one record per proxied request or tunnel, including the
+// SCION address and path the destination was reached over, e.g., for auditing.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Format is the format of the records in the access log.
+type Format string
+
+const (
+	// FormatJSON writes one JSON object per line.
+	FormatJSON Format = "json"
+	// FormatCLF writes the Common Log Format, extended with the fields specific to the proxy
+	// as key=value pairs, e.g.:
+	//
+	//	127.0.0.1 - deadbeef [10/Oct/2024:13:55:36 +0200] "CONNECT example.org:443 HTTP/1.1" 200 5120 up=1024 user=alice transport=scion scion=1-ff00:0:110,127.0.0.1:443 path=1-ff00:0:111>1-ff00:0:110 resolve=0.012 dial=0.103 duration=12.400
+	FormatCLF Format = "clf"
+)
+
+// ParseFormat parses the name of a format.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case FormatJSON, FormatCLF:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown access log format %q", s)
+	}
+}
+
+// Record is a proxied request or tunnel.
+type Record struct {
+	// Time is when the request was received.
+	Time      time.Time
+	Client    string
+	SessionID string
+	// User is the name of the authenticated user, if the proxy requires authentication.
+	User   string
+	Method string
+	// Host is the destination as requested, host:port for tunnels.
+	Host  string
+	Proto string
+	// Transport is scion or ip, none if the request was refused before dialing.
+	Transport string
+	// SCIONAddress is the resolved SCION address of the destination, if any.
+	SCIONAddress string
+	// Path is the ISD-ASes of the SCION path, if the destination was reached over SCION.
+	Path []string
+	// Status is the status of the response, or the status of the error the request failed with.
+	Status int
+	// BytesUpstream is the number of bytes sent from the client to the destination.
+	BytesUpstream int64
+	// BytesDownstream is the number of bytes sent from the destination to the client.
+	BytesDownstream int64
+	ResolveDuration time.Duration
+	DialDuration    time.Duration
+	// Duration is the time from receiving the request until it was done, i.e., the lifetime of tunnels.
+	Duration time.Duration
+}
+
+type jsonRecord struct {
+	Time            time.Time `json:"time"`
+	Client          string    `json:"client"`
+	SessionID       string    `json:"sessionId,omitempty"`
+	User            string    `json:"user,omitempty"`
+	Method          string    `json:"method"`
+	Host            string    `json:"host"`
+	Proto           string    `json:"proto"`
+	Transport       string    `json:"transport"`
+	SCIONAddress    string    `json:"scionAddress,omitempty"`
+	Path            []string  `json:"path,omitempty"`
+	Status          int       `json:"status"`
+	BytesUpstream   int64     `json:"bytesUpstream"`
+	BytesDownstream int64     `json:"bytesDownstream"`
+	ResolveSeconds  float64   `json:"resolveSeconds"`
+	DialSeconds     float64   `json:"dialSeconds"`
+	DurationSeconds float64   `json:"durationSeconds"`
+}
+
+func (r Record) appendJSON(b []byte) ([]byte, error) {
+	j, err := json.Marshal(jsonRecord{
+		Time:            r.Time,
+		Client:          r.Client,
+		SessionID:       r.SessionID,
+		User:            r.User,
+		Method:          r.Method,
+		Host:            r.Host,
+		Proto:           r.Proto,
+		Transport:       r.Transport,
+		SCIONAddress:    r.SCIONAddress,
+		Path:            r.Path,
+		Status:          r.Status,
+		BytesUpstream:   r.BytesUpstream,
+		BytesDownstream: r.BytesDownstream,
+		ResolveSeconds:  r.ResolveDuration.Seconds(),
+		DialSeconds:     r.DialDuration.Seconds(),
+		DurationSeconds: r.Duration.Seconds(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(append(b, j...), '\n'), nil
+}
+
+func (r Record) appendCLF(b []byte) []byte {
+	client, _, _ := strings.Cut(r.Client, ":")
+	if strings.HasPrefix(r.Client, "[") {
+		client, _, _ = strings.Cut(strings.TrimPrefix(r.Client, "["), "]")
+	}
+
+	b = append(b, clfField(client)...)
+	b = append(b, " - "...)
+	b = append(b, clfField(r.SessionID)...)
+	b = append(b, " ["...)
+	b = r.Time.AppendFormat(b, "02/Jan/2006:15:04:05 -0700")
+	b = append(b, "] "...)
+	b = strconv.AppendQuote(b, r.Method+" "+r.Host+" "+r.Proto)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(r.Status), 10)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, r.BytesDownstream, 10)
+	b = append(b, " up="...)
+	b = strconv.AppendInt(b, r.BytesUpstream, 10)
+	b = append(b, " user="...)
+	b = append(b, clfField(r.User)...)
+	b = append(b, " transport="...)
+	b = append(b, clfField(r.Transport)...)
+	b = append(b, " scion="...)
+	b = append(b, clfField(r.SCIONAddress)...)
+	b = append(b, " path="...)
+	b = append(b, clfField(strings.Join(r.Path, ">"))...)
+	b = append(b, " resolve="...)
+	b = strconv.AppendFloat(b, r.ResolveDuration.Seconds(), 'f', 3, 64)
+	b = append(b, " dial="...)
+	b = strconv.AppendFloat(b, r.DialDuration.Seconds(), 'f', 3, 64)
+	b = append(b, " duration="...)
+	b = strconv.AppendFloat(b, r.Duration.Seconds(), 'f', 3, 64)
+	return append(b, '\n')
+}
+
+// clfField returns "-" for empty fields and replaces whitespace, such that the fields
+// of a line can be split at spaces.
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Join(strings.Fields(s), "_")
+}
+
+// Logger writes access log records to a writer, e.g., a RotatingFile. It is safe for
+// concurrent use, each record is written at once.
+type Logger struct {
+	format Format
+
+	mutex sync.Mutex
+	w     io.Writer
+	// scratch is reused to encode the records, the writers must not retain it
+	scratch []byte
+}
+
+func New(w io.Writer, format Format) (*Logger, error) {
+	if _, err := ParseFormat(string(format)); err != nil {
+		return nil, err
+	}
+	return &Logger{w: w, format: format}, nil
+}
+
+func (l *Logger) Log(r Record) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	b := l.scratch[:0]
+	var err error
+	switch l.format {
+	case FormatJSON:
+		b, err = r.appendJSON(b)
+		if err != nil {
+			return err
+		}
+	case FormatCLF:
+		b = r.appendCLF(b)
+	}
+	l.scratch = b
+	_, err = l.w.Write(b)
+	return err
+}
+
+// Close closes the underlying writer, if it is an io.Closer.
+func (l *Logger) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if c, ok := l.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
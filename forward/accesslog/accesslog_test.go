@@ -0,0 +1,151 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var record = Record{
+	Time:            time.Date(2024, 10, 10, 13, 55, 36, 0, time.FixedZone("", 2*60*60)),
+	Client:          "[::1]:51234",
+	SessionID:       "deadbeef",
+	User:            "alice",
+	Method:          "CONNECT",
+	Host:            "example.org:443",
+	Proto:           "HTTP/1.1",
+	Transport:       "scion",
+	SCIONAddress:    "1-ff00:0:110,127.0.0.1:443",
+	Path:            []string{"1-ff00:0:111", "1-ff00:0:110"},
+	Status:          200,
+	BytesUpstream:   1024,
+	BytesDownstream: 5120,
+	ResolveDuration: 12 * time.Millisecond,
+	DialDuration:    103 * time.Millisecond,
+	Duration:        12400 * time.Millisecond,
+}
+
+func TestLogger(t *testing.T) {
+	cases := map[string]struct {
+		format   Format
+		record   Record
+		expected string
+	}{
+		"clf": {
+			format:   FormatCLF,
+			record:   record,
+			expected: `::1 - deadbeef [10/Oct/2024:13:55:36 +0200] "CONNECT example.org:443 HTTP/1.1" 200 5120 up=1024 user=alice transport=scion scion=1-ff00:0:110,127.0.0.1:443 path=1-ff00:0:111>1-ff00:0:110 resolve=0.012 dial=0.103 duration=12.400` + "\n",
+		},
+		"clf refused": {
+			format:   FormatCLF,
+			record:   Record{Time: record.Time, Client: "10.0.0.1:8080", Method: "GET", Host: "http://example.org/", Proto: "HTTP/1.1", Transport: "none", Status: 407},
+			expected: `10.0.0.1 - - [10/Oct/2024:13:55:36 +0200] "GET http://example.org/ HTTP/1.1" 407 0 up=0 user=- transport=none scion=- path=- resolve=0.000 dial=0.000 duration=0.000` + "\n",
+		},
+		"json": {
+			format:   FormatJSON,
+			record:   record,
+			expected: `{"time":"2024-10-10T13:55:36+02:00","client":"[::1]:51234","sessionId":"deadbeef","user":"alice","method":"CONNECT","host":"example.org:443","proto":"HTTP/1.1","transport":"scion","scionAddress":"1-ff00:0:110,127.0.0.1:443","path":["1-ff00:0:111","1-ff00:0:110"],"status":200,"bytesUpstream":1024,"bytesDownstream":5120,"resolveSeconds":0.012,"dialSeconds":0.103,"durationSeconds":12.4}` + "\n",
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			l, err := New(&buf, c.format)
+			require.NoError(t, err)
+			require.NoError(t, l.Log(c.record))
+			assert.Equal(t, c.expected, buf.String())
+			if c.format == FormatJSON {
+				assert.True(t, json.Valid(buf.Bytes()), "invalid JSON")
+			}
+		})
+	}
+
+	_, err := New(&bytes.Buffer{}, "xml")
+	assert.Error(t, err, "unknown format accepted")
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := NewRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := f.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	require.NoError(t, f.Close())
+
+	for name, expected := range map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		b, err := os.ReadFile(name)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(b), name)
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "backups beyond the limit are kept")
+
+	// appends to the existing file
+	f, err = NewRotatingFile(path, 0, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("fifth\n"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "fourth\nfifth\n", string(b))
+
+	_, err = f.Write([]byte("closed"))
+	assert.Error(t, err, "write after close")
+}
+
+func TestRotatingFileRenameFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	// the file cannot be renamed onto a non-empty directory
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "blocker"), 0o750))
+	f, err := NewRotatingFile(path, 10, 1)
+	require.NoError(t, err)
+
+	_, err = f.Write([]byte("first\n"))
+	require.NoError(t, err)
+	n, err := f.Write([]byte("second\n"))
+	assert.ErrorContains(t, err, "rotating access log")
+	assert.Equal(t, len("second\n"), n, "record lost on failed rotation")
+
+	// the log goes on once the rotation succeeds again
+	require.NoError(t, os.RemoveAll(path+".1"))
+	_, err = f.Write([]byte("third\n"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	for name, expected := range map[string]string{
+		path:        "third\n",
+		path + ".1": "first\nsecond\n",
+	} {
+		b, err := os.ReadFile(name)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(b), name)
+	}
+}
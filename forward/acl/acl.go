@@ -0,0 +1,264 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package acl decides which destinations clients may reach through the proxy, such that
+// the proxy cannot be used to reach, e.g., services in its private network.
+package acl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/scionproto/scion/pkg/addr"
+)
+
+// Action is the action of a rule.
+type Action string
+
+const (
+	Allow Action = "allow"
+	Deny  Action = "deny"
+)
+
+// PortRange is a range of ports, including First and Last. In JSON, it is a port, e.g.,
+// 443, or a range, e.g., "8000-8999".
+type PortRange struct {
+	First, Last uint16
+}
+
+func (p *PortRange) UnmarshalJSON(b []byte) error {
+	var port uint16
+	if err := json.Unmarshal(b, &port); err == nil {
+		*p = PortRange{First: port, Last: port}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("port range must be a port or a string like \"8000-8999\": %w", err)
+	}
+	first, last, found := strings.Cut(s, "-")
+	if !found {
+		last = first
+	}
+	f, err := strconv.ParseUint(first, 10, 16)
+	if err != nil {
+		return fmt.Errorf("port range %q: %w", s, err)
+	}
+	l, err := strconv.ParseUint(last, 10, 16)
+	if err != nil {
+		return fmt.Errorf("port range %q: %w", s, err)
+	}
+	*p = PortRange{First: uint16(f), Last: uint16(l)}
+	return nil
+}
+
+func (p PortRange) contains(port uint16) bool {
+	return p.First <= port && port <= p.Last
+}
+
+// Rule matches requests by their method and destination. A rule matches a request if it
+// matches all of its conditions that are set, where a condition matches if any of its
+// values matches.
+type Rule struct {
+	Action Action `json:"action"`
+	// Hosts are patterns of the requested host names, as in path.Match, e.g., *.example.org.
+	Hosts []string `json:"hosts,omitempty"`
+	// Networks match the addresses of destinations reached over TCP/IP, once the host name
+	// is resolved. Destinations reached over SCION are matched by their ISD-AS.
+	Networks []netip.Prefix `json:"networks,omitempty"`
+	Ports    []PortRange    `json:"ports,omitempty"`
+	// ISDASes match destinations reached over SCION, 0 is a wildcard, e.g., 1-0 matches ISD 1.
+	ISDASes []addr.IA `json:"isd_as,omitempty"`
+	Methods []string  `json:"methods,omitempty"`
+	// Reason is the reason reported to clients whose requests are denied by the rule.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Validate checks the rule for invalid actions, patterns and port ranges.
+func (r Rule) Validate() error {
+	var errs []error
+	if r.Action != Allow && r.Action != Deny {
+		errs = append(errs, fmt.Errorf("action %q is neither %s nor %s", r.Action, Allow, Deny))
+	}
+	for _, host := range r.Hosts {
+		if _, err := path.Match(host, ""); err != nil {
+			errs = append(errs, fmt.Errorf("host pattern %q: %w", host, err))
+		}
+	}
+	for _, p := range r.Ports {
+		if p.First > p.Last {
+			errs = append(errs, fmt.Errorf("port range %d-%d is empty", p.First, p.Last))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Request is a request for a destination, as far as it is known. Address is only set
+// once the destination is resolved to an IP address, IA if it is reached over SCION.
+type Request struct {
+	Method  string
+	Host    string
+	Port    uint16
+	Address netip.Addr
+	IA      addr.IA
+}
+
+// unresolved returns whether the request is to be reached over TCP/IP, but its address is
+// not known yet.
+func (req Request) unresolved() bool {
+	return !req.Address.IsValid() && req.IA.IsZero()
+}
+
+// matches returns whether the rule matches the request, ignoring the networks if the request
+// is unresolved.
+func (r Rule) matches(req Request) bool {
+	return matchesAny(r.Hosts, func(pattern string) bool {
+		ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(req.Host))
+		return ok
+	}) && (req.unresolved() || matchesAny(r.Networks, func(prefix netip.Prefix) bool {
+		return req.Address.IsValid() && prefix.Contains(req.Address.Unmap())
+	})) && matchesAny(r.Ports, func(p PortRange) bool {
+		return p.contains(req.Port)
+	}) && matchesAny(r.ISDASes, func(ia addr.IA) bool {
+		return !req.IA.IsZero() &&
+			(ia.ISD() == 0 || ia.ISD() == req.IA.ISD()) && (ia.AS() == 0 || ia.AS() == req.IA.AS())
+	}) && matchesAny(r.Methods, func(method string) bool {
+		return strings.EqualFold(method, req.Method)
+	})
+}
+
+// matchesAny returns whether any of the values matches, or true if there are none.
+func matchesAny[T any](values []T, match func(T) bool) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// List is an ordered list of rules, the first rule matching a request decides.
+type List struct {
+	Rules []Rule `json:"rules"`
+	// Default is the action if no rule matches, allow if not set.
+	Default Action `json:"default,omitempty"`
+}
+
+// PrivateNetworks are the loopback, private, link-local, shared and multicast address
+// ranges, as well as the unspecified addresses.
+var PrivateNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// DefaultList denies destinations in PrivateNetworks and CONNECT tunnels to ports other
+// than 443, and allows everything else.
+func DefaultList() *List {
+	return &List{
+		Rules: []Rule{
+			{Action: Deny, Networks: PrivateNetworks, Reason: "destination is in a private network"},
+			{Action: Allow, Methods: []string{http.MethodConnect}, Ports: []PortRange{{First: 443, Last: 443}}},
+			{Action: Deny, Methods: []string{http.MethodConnect}, Reason: "CONNECT is only allowed to port 443"},
+		},
+		Default: Allow,
+	}
+}
+
+// Validate checks the rules and the default action.
+func (l *List) Validate() error {
+	var errs []error
+	for i, r := range l.Rules {
+		if err := r.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("rule %d: %w", i, err))
+		}
+	}
+	if l.Default != "" && l.Default != Allow && l.Default != Deny {
+		errs = append(errs, fmt.Errorf("default action %q is neither %s nor %s", l.Default, Allow, Deny))
+	}
+	return errors.Join(errs...)
+}
+
+// Decision is the decision on a request.
+type Decision struct {
+	Allowed bool
+	// Deferred is set if the decision depends on the address of the destination, which is
+	// not known yet. The request is to be evaluated again once the host name is resolved.
+	Deferred bool
+	// Rule is the index of the deciding rule, -1 if no rule matched.
+	Rule   int
+	Reason string
+}
+
+// Evaluate decides on the request with the first matching rule. If the request is unresolved,
+// rules matching by network may or may not match it. The decision is only deferred if such a
+// rule takes another action than the first rule that matches regardless of the address.
+func (l *List) Evaluate(req Request) Decision {
+	var pending []Action
+	decide := func(d Decision) Decision {
+		for _, action := range pending {
+			if (action == Allow) != d.Allowed {
+				return Decision{Allowed: true, Deferred: true, Rule: -1}
+			}
+		}
+		return d
+	}
+	for i, r := range l.Rules {
+		if !r.matches(req) {
+			continue
+		}
+		if len(r.Networks) > 0 && req.unresolved() {
+			pending = append(pending, r.Action)
+			continue
+		}
+		d := Decision{Allowed: r.Action == Allow, Rule: i, Reason: r.Reason}
+		if !d.Allowed && d.Reason == "" {
+			d.Reason = fmt.Sprintf("denied by rule %d", i)
+		}
+		return decide(d)
+	}
+	d := Decision{Allowed: l.Default != Deny, Rule: -1}
+	if !d.Allowed {
+		d.Reason = "not allowed by any rule"
+	}
+	return decide(d)
+}
+
+// DeniedError is the error of requests denied by a List.
+type DeniedError struct {
+	Decision Decision
+}
+
+func (e *DeniedError) Error() string {
+	return "access denied: " + e.Decision.Reason
+}
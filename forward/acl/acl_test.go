@@ -0,0 +1,129 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package acl
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultList(t *testing.T) {
+	cases := map[string]struct {
+		request  Request
+		expected Decision
+	}{
+		"public get": {
+			request:  Request{Method: http.MethodGet, Host: "example.org", Port: 80, Address: netip.MustParseAddr("93.184.215.14")},
+			expected: Decision{Allowed: true, Rule: -1},
+		},
+		"loopback": {
+			request:  Request{Method: http.MethodGet, Host: "localhost", Port: 80, Address: netip.MustParseAddr("127.0.0.1")},
+			expected: Decision{Rule: 0, Reason: "destination is in a private network"},
+		},
+		"mapped private": {
+			request:  Request{Method: http.MethodConnect, Host: "intranet", Port: 443, Address: netip.MustParseAddr("::ffff:10.1.2.3")},
+			expected: Decision{Rule: 0, Reason: "destination is in a private network"},
+		},
+		"connect 443": {
+			request:  Request{Method: http.MethodConnect, Host: "example.org", Port: 443, Address: netip.MustParseAddr("93.184.215.14")},
+			expected: Decision{Allowed: true, Rule: 1},
+		},
+		"connect 22": {
+			request:  Request{Method: http.MethodConnect, Host: "example.org", Port: 22, Address: netip.MustParseAddr("93.184.215.14")},
+			expected: Decision{Rule: 2, Reason: "CONNECT is only allowed to port 443"},
+		},
+		"unresolved connect 22": {
+			request:  Request{Method: http.MethodConnect, Host: "example.org", Port: 22},
+			expected: Decision{Rule: 2, Reason: "CONNECT is only allowed to port 443"},
+		},
+		"unresolved get": {
+			request:  Request{Method: http.MethodGet, Host: "example.org", Port: 80},
+			expected: Decision{Allowed: true, Deferred: true, Rule: -1},
+		},
+		"scion host in private network": {
+			request:  Request{Method: http.MethodConnect, Host: "ethz.ch", Port: 443, IA: addr.MustParseIA("64-2:0:9")},
+			expected: Decision{Allowed: true, Rule: 1},
+		},
+	}
+
+	list := DefaultList()
+	require.NoError(t, list.Validate())
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, c.expected, list.Evaluate(c.request))
+		})
+	}
+}
+
+func TestListJSON(t *testing.T) {
+	var list List
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"rules": [
+			{"action": "allow", "isd_as": ["64-0"], "ports": [443, "8000-8999"]},
+			{"action": "deny", "hosts": ["*.internal.example.org"], "reason": "internal"},
+			{"action": "allow", "networks": ["192.0.2.0/24"], "methods": ["get"]}
+		],
+		"default": "deny"
+	}`), &list))
+	require.NoError(t, list.Validate())
+
+	cases := map[string]struct {
+		request  Request
+		expected Decision
+	}{
+		"isd wildcard": {
+			request:  Request{Method: http.MethodConnect, Host: "ethz.ch", Port: 8443, IA: addr.MustParseIA("64-2:0:9")},
+			expected: Decision{Allowed: true, Rule: 0},
+		},
+		"other isd": {
+			request:  Request{Method: http.MethodConnect, Host: "example.org", Port: 443, IA: addr.MustParseIA("71-2:0:4a")},
+			expected: Decision{Rule: -1, Reason: "not allowed by any rule"},
+		},
+		"host glob": {
+			request:  Request{Method: http.MethodGet, Host: "Wiki.Internal.example.org", Port: 80, Address: netip.MustParseAddr("192.0.2.1")},
+			expected: Decision{Rule: 1, Reason: "internal"},
+		},
+		"network and method": {
+			request:  Request{Method: http.MethodGet, Host: "example.org", Port: 80, Address: netip.MustParseAddr("192.0.2.1")},
+			expected: Decision{Allowed: true, Rule: 2},
+		},
+		"network other method": {
+			request:  Request{Method: http.MethodPost, Host: "example.org", Port: 80, Address: netip.MustParseAddr("192.0.2.1")},
+			expected: Decision{Rule: -1, Reason: "not allowed by any rule"},
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, c.expected, list.Evaluate(c.request))
+		})
+	}
+
+	for name, content := range map[string]string{
+		"unknown action": `{"rules": [{"action": "drop"}]}`,
+		"bad pattern":    `{"rules": [{"action": "deny", "hosts": ["[example.org"]}]}`,
+		"empty ports":    `{"rules": [{"action": "deny", "ports": ["9000-8000"]}]}`,
+		"bad default":    `{"default": "maybe"}`,
+	} {
+		var list List
+		require.NoError(t, json.Unmarshal([]byte(content), &list), name)
+		assert.Error(t, list.Validate(), name)
+	}
+}
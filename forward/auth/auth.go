@@ -0,0 +1,114 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package auth authenticates the users of the proxy, with credentials passed in the
+// Proxy-Authorization header or with TLS client certificates.
+//
+// The Proxy-Authorization header is also the carrier of the session cookie, see PolicyUser.
+// To pass both, clients send the header twice, once with their credentials and once with the
+// session cookie; the carrier is never considered a credential.
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	// PolicyUser is the user name of the Basic Proxy-Authorization carrying the session cookie
+	// as password, i.e., "Basic base64(policy:<cookie>)".
+	PolicyUser = "policy"
+
+	headerProxyAuthorization = "Proxy-Authorization"
+)
+
+var (
+	// ErrNoCredentials is returned by authenticators if the request carries no credentials
+	// they can verify.
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials is returned by authenticators if the credentials of the request are invalid.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Identity is an authenticated user.
+type Identity struct {
+	// Name identifies the user, e.g., the user name or the subject of the client certificate.
+	Name string
+	// Method is the method the user authenticated with, e.g., basic, bearer or mtls.
+	Method string
+}
+
+// Authenticator authenticates the user of a request.
+type Authenticator interface {
+	// Authenticate returns the identity of the user of the request. It returns an error
+	// wrapping ErrNoCredentials if the request carries no credentials for the authenticator.
+	// The errors may tell why the credentials are invalid, e.g., that the user is unknown,
+	// hence they are meant for the log of the server and not for the client.
+	Authenticate(r *http.Request) (Identity, error)
+	// Challenges returns the Proxy-Authenticate challenges asking clients for credentials.
+	Challenges() []string
+}
+
+// Chain authenticates requests with the first authenticator for which the request carries
+// credentials, such that users can choose how to authenticate.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(r *http.Request) (Identity, error) {
+	for _, a := range c {
+		identity, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return identity, err
+	}
+	return Identity{}, ErrNoCredentials
+}
+
+func (c Chain) Challenges() []string {
+	var challenges []string
+	for _, a := range c {
+		challenges = append(challenges, a.Challenges()...)
+	}
+	return challenges
+}
+
+// credentials returns the credentials of the Proxy-Authorization headers with the scheme,
+// skipping the session cookie carrier.
+func credentials(r *http.Request, scheme string) []string {
+	var creds []string
+	for _, value := range r.Header.Values(headerProxyAuthorization) {
+		s, cred, ok := strings.Cut(strings.TrimSpace(value), " ")
+		if !ok || !strings.EqualFold(s, scheme) {
+			continue
+		}
+		cred = strings.TrimSpace(cred)
+		if strings.EqualFold(scheme, "Basic") {
+			if user, _, ok := decodeBasic(cred); ok && user == PolicyUser {
+				continue
+			}
+		}
+		creds = append(creds, cred)
+	}
+	return creds
+}
+
+func decodeBasic(cred string) (user, password string, ok bool) {
+	b, err := base64.StdEncoding.DecodeString(cred)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(b), ":")
+}
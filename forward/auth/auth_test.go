@@ -0,0 +1,145 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func basic(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func writeFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func newChain(t *testing.T) Chain {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	htpasswd, err := LoadHtpasswd(writeFile(t,
+		"# users\nalice:"+string(hash)+"\n"+
+			"bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), "proxy")
+	require.NoError(t, err)
+
+	bearer, err := LoadBearerTokens(writeFile(t, "carol:token-of-carol\n"), "proxy")
+	require.NoError(t, err)
+
+	return Chain{ClientCertificate{}, htpasswd, bearer}
+}
+
+func TestChain(t *testing.T) {
+	chain := newChain(t)
+
+	cases := map[string]struct {
+		headers     []string
+		expected    Identity
+		expectedErr error
+	}{
+		"bcrypt":              {headers: []string{basic("alice", "secret")}, expected: Identity{Name: "alice", Method: "basic"}},
+		"sha":                 {headers: []string{basic("bob", "secret")}, expected: Identity{Name: "bob", Method: "basic"}},
+		"bearer":              {headers: []string{"Bearer token-of-carol"}, expected: Identity{Name: "carol", Method: "bearer"}},
+		"with policy carrier": {headers: []string{basic(PolicyUser, "cookie"), basic("alice", "secret")}, expected: Identity{Name: "alice", Method: "basic"}},
+		"wrong password":      {headers: []string{basic("alice", "wrong")}, expectedErr: ErrInvalidCredentials},
+		"unknown user":        {headers: []string{basic("mallory", "secret")}, expectedErr: ErrInvalidCredentials},
+		"unknown token":       {headers: []string{"Bearer token-of-mallory"}, expectedErr: ErrInvalidCredentials},
+		"policy carrier only": {headers: []string{basic(PolicyUser, "cookie")}, expectedErr: ErrNoCredentials},
+		"no header":           {expectedErr: ErrNoCredentials},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodConnect, "example.org:443", nil)
+			for _, h := range c.headers {
+				r.Header.Add("Proxy-Authorization", h)
+			}
+
+			identity, err := chain.Authenticate(r)
+			if c.expectedErr != nil {
+				assert.ErrorIs(t, err, c.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.expected, identity)
+		})
+	}
+
+	assert.Equal(t, []string{`Basic realm="proxy"`, `Bearer realm="proxy"`}, chain.Challenges())
+}
+
+func TestLoadHtpasswd(t *testing.T) {
+	for name, content := range map[string]string{
+		"md5":         "alice:$apr1$salt$hash\n",
+		"crypt":       "alice:rqXexS6ZhobKA\n",
+		"no hash":     "alice\n",
+		"policy user": PolicyUser + ":{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n",
+	} {
+		_, err := LoadHtpasswd(writeFile(t, content), "proxy")
+		assert.Error(t, err, name)
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "dave"}}
+
+	cases := map[string]struct {
+		state       *tls.ConnectionState
+		expected    Identity
+		expectedErr error
+	}{
+		"verified": {
+			state:    &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}},
+			expected: Identity{Name: "dave", Method: "mtls"},
+		},
+		"san": {
+			state: &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{{DNSNames: []string{"client.example.org"}}},
+				VerifiedChains:   [][]*x509.Certificate{{{DNSNames: []string{"client.example.org"}}}},
+			},
+			expected: Identity{Name: "client.example.org", Method: "mtls"},
+		},
+		"unverified":     {state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, expectedErr: ErrInvalidCredentials},
+		"no certificate": {state: &tls.ConnectionState{}, expectedErr: ErrNoCredentials},
+		"plain":          {expectedErr: ErrNoCredentials},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodConnect, "example.org:443", nil)
+			r.TLS = c.state
+
+			identity, err := ClientCertificate{}.Authenticate(r)
+			if c.expectedErr != nil {
+				assert.ErrorIs(t, err, c.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.expected, identity)
+		})
+	}
+}
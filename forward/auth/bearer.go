@@ -0,0 +1,92 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// BearerTokens authenticates users with the Bearer tokens issued to them.
+type BearerTokens struct {
+	realm string
+	// users maps the SHA-256 of the tokens to the users, such that tokens are compared in
+	// constant time.
+	users map[[sha256.Size]byte]string
+}
+
+// NewBearerTokens creates an authenticator for the tokens, which are mapped to their users.
+func NewBearerTokens(tokens map[string]string, realm string) (*BearerTokens, error) {
+	b := &BearerTokens{realm: realm, users: make(map[[sha256.Size]byte]string, len(tokens))}
+	for token, user := range tokens {
+		if token == "" || user == "" {
+			return nil, fmt.Errorf("empty bearer token or user")
+		}
+		b.users[sha256.Sum256([]byte(token))] = user
+	}
+	return b, nil
+}
+
+// LoadBearerTokens loads the tokens from a file with a user:token pair per line.
+func LoadBearerTokens(path, realm string) (*BearerTokens, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, token, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected user:token", path, n)
+		}
+		if _, dup := tokens[token]; dup {
+			return nil, fmt.Errorf("%s:%d: token of user %s is not unique", path, n, user)
+		}
+		tokens[token] = user
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewBearerTokens(tokens, realm)
+}
+
+func (b *BearerTokens) Authenticate(r *http.Request) (Identity, error) {
+	creds := credentials(r, "Bearer")
+	if len(creds) == 0 {
+		return Identity{}, ErrNoCredentials
+	}
+	sum := sha256.Sum256([]byte(creds[0]))
+	for hash, user := range b.users {
+		if subtle.ConstantTimeCompare(hash[:], sum[:]) == 1 {
+			return Identity{Name: user, Method: "bearer"}, nil
+		}
+	}
+	return Identity{}, fmt.Errorf("%w: unknown bearer token", ErrInvalidCredentials)
+}
+
+func (b *BearerTokens) Challenges() []string {
+	return []string{fmt.Sprintf("Bearer realm=%q", b.realm)}
+}
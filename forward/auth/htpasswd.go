@@ -0,0 +1,104 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against for unknown users, such that they take as long as known ones.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	return hash
+})
+
+// Htpasswd authenticates users with Basic credentials against an htpasswd file, as created by
+// `htpasswd -B`. Passwords hashed with bcrypt and SHA-1 ({SHA}) are supported.
+type Htpasswd struct {
+	realm  string
+	hashes map[string][]byte
+}
+
+// LoadHtpasswd loads the users of the htpasswd file at path.
+func LoadHtpasswd(path, realm string) (*Htpasswd, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	h := &Htpasswd{realm: realm, hashes: make(map[string][]byte)}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, n)
+		}
+		if user == PolicyUser {
+			return nil, fmt.Errorf("%s:%d: user name %q is reserved", path, n, PolicyUser)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("%s:%d: unsupported hash of user %s, use bcrypt", path, n, user)
+		}
+		h.hashes[user] = []byte(hash)
+	}
+	return h, scanner.Err()
+}
+
+func (h *Htpasswd) Authenticate(r *http.Request) (Identity, error) {
+	creds := credentials(r, "Basic")
+	if len(creds) == 0 {
+		return Identity{}, ErrNoCredentials
+	}
+	user, password, ok := decodeBasic(creds[0])
+	if !ok {
+		return Identity{}, fmt.Errorf("%w: malformed Basic credentials", ErrInvalidCredentials)
+	}
+	hash, known := h.hashes[user]
+	if !known {
+		_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return Identity{}, fmt.Errorf("%w: unknown user %s", ErrInvalidCredentials, user)
+	}
+	if !verifyPassword(hash, password) {
+		return Identity{}, fmt.Errorf("%w: wrong password of user %s", ErrInvalidCredentials, user)
+	}
+	return Identity{Name: user, Method: "basic"}, nil
+}
+
+func (h *Htpasswd) Challenges() []string {
+	return []string{fmt.Sprintf("Basic realm=%q", h.realm)}
+}
+
+func verifyPassword(hash []byte, password string) bool {
+	if sha, ok := bytes.CutPrefix(hash, []byte("{SHA}")); ok {
+		sum := sha1.Sum([]byte(password))
+		expected := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare(sha, []byte(expected)) == 1
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
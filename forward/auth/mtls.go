@@ -0,0 +1,60 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+)
+
+// ClientCertificate authenticates users with the TLS client certificate of the connection
+// to the proxy. The server must verify the certificates, e.g., with tls.VerifyClientCertIfGiven
+// and the CAs issuing them, unverified certificates are rejected.
+type ClientCertificate struct{}
+
+func (ClientCertificate) Authenticate(r *http.Request) (Identity, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return Identity{}, ErrNoCredentials
+	}
+	if len(r.TLS.VerifiedChains) == 0 {
+		return Identity{}, fmt.Errorf("%w: client certificate not verified", ErrInvalidCredentials)
+	}
+	name := certificateName(r.TLS.VerifiedChains[0][0])
+	if name == "" {
+		return Identity{}, fmt.Errorf("%w: client certificate without subject", ErrInvalidCredentials)
+	}
+	return Identity{Name: name, Method: "mtls"}, nil
+}
+
+// Challenges is empty, client certificates are requested in the TLS handshake.
+func (ClientCertificate) Challenges() []string {
+	return nil
+}
+
+// certificateName returns the common name of the subject, or its first email address or
+// DNS name if it has none.
+func certificateName(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	default:
+		return ""
+	}
+}
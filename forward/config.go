@@ -0,0 +1,141 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forward
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/scionproto-contrib/http-proxy/forward/panpolicy"
+	"github.com/scionproto-contrib/http-proxy/forward/resolver"
+	"github.com/scionproto-contrib/http-proxy/forward/session"
+)
+
+const (
+	DefaultResolveTimeout = 5 * time.Second
+	DefaultDialTimeout    = 10 * time.Second
+	DefaultPurgeTimeout   = 10 * time.Minute
+	DefaultPurgeInterval  = time.Minute
+)
+
+// Config is the configuration of a CoreProxy, see DefaultConfig for the defaults.
+type Config struct {
+	// ResolveTimeout bounds the resolution of the SCION address of a destination, 5s by default.
+	ResolveTimeout time.Duration
+	// DialTimeout bounds the dial of a destination, 10s by default.
+	DialTimeout time.Duration
+	// PurgeTimeout is the time after which the dialers of sessions that have not dialed
+	// are purged, 10min by default.
+	PurgeTimeout time.Duration
+	// PurgeInterval is the interval at which inactive dialers are purged, 1min by default.
+	// It must not exceed PurgeTimeout.
+	PurgeInterval time.Duration
+	// DisablePurgeInactive keeps the dialers of inactive sessions, PurgeTimeout and
+	// PurgeInterval are ignored then.
+	DisablePurgeInactive bool
+}
+
+// DefaultConfig returns the default configuration.
+func DefaultConfig() Config {
+	return Config{
+		ResolveTimeout: DefaultResolveTimeout,
+		DialTimeout:    DefaultDialTimeout,
+		PurgeTimeout:   DefaultPurgeTimeout,
+		PurgeInterval:  DefaultPurgeInterval,
+	}
+}
+
+// Validate returns an error describing all invalid fields, if any.
+func (c Config) Validate() error {
+	var errs []error
+	positive := func(name string, d time.Duration) {
+		if d <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %s", name, d))
+		}
+	}
+	positive("resolve timeout", c.ResolveTimeout)
+	positive("dial timeout", c.DialTimeout)
+	if !c.DisablePurgeInactive {
+		positive("purge timeout", c.PurgeTimeout)
+		positive("purge interval", c.PurgeInterval)
+		if c.PurgeInterval > c.PurgeTimeout {
+			errs = append(errs, fmt.Errorf("purge interval %s exceeds purge timeout %s", c.PurgeInterval, c.PurgeTimeout))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Optional settings of dialer managers, see WithDialerManager.
+type (
+	countryMapper interface {
+		SetCountryMapping(countries panpolicy.CountryMapping)
+	}
+	multipathEnabler interface {
+		SetMultipathSubflows(subflows int)
+	}
+	upstreamSetter interface {
+		SetUpstream(upstream *panpolicy.Upstream)
+	}
+)
+
+// Option customizes a CoreProxy created with NewCoreProxyWithConfig.
+type Option func(cp *CoreProxy)
+
+// WithLogger sets the logger, by default nothing is logged.
+func WithLogger(logger *zap.Logger) Option {
+	return func(cp *CoreProxy) {
+		cp.logger = logger
+	}
+}
+
+// WithResolver sets the resolver of the SCION addresses of destinations, instead of resolving
+// them with PAN.
+func WithResolver(r resolver.Resolver) Option {
+	return func(cp *CoreProxy) {
+		cp.resolver = r
+	}
+}
+
+// WithDialerManager sets the manager of the dialers of the sessions, which is started by
+// Initialize and stopped by Cleanup. The settings of the proxy affecting the dialers, e.g.,
+// EnableMultipath, require the manager to support them. The dialer metrics are reported if
+// the manager implements metrics.DialerStats.
+func WithDialerManager(m panpolicy.DialerManager) Option {
+	return func(cp *CoreProxy) {
+		cp.policyManager = m
+	}
+}
+
+// WithSessionStore sets the store used to persist session data, see SetSessionStore.
+func WithSessionStore(store session.SessionStore) Option {
+	return func(cp *CoreProxy) {
+		cp.sessionStore = store
+	}
+}
+
+// NewCoreProxyWithConfig creates a new CoreProxy after validating the configuration.
+func NewCoreProxyWithConfig(config Config, opts ...Option) (*CoreProxy, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid proxy configuration: %w", err)
+	}
+	cp := newCoreProxy(zap.NewNop(), config)
+	for _, opt := range opts {
+		opt(cp)
+	}
+	return cp, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package forward_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/scionproto-contrib/http-proxy/forward"
+	"github.com/scionproto-contrib/http-proxy/forward/hostsfile"
+	"github.com/scionproto-contrib/http-proxy/forward/panpolicy"
+	"github.com/scionproto-contrib/http-proxy/forward/session"
+)
+
+func TestConfigValidate(t *testing.T) {
+	cases := map[string]struct {
+		modify      func(c *forward.Config)
+		expectedErr bool
+	}{
+		"defaults":                   {modify: func(c *forward.Config) {}},
+		"zero resolve timeout":       {modify: func(c *forward.Config) { c.ResolveTimeout = 0 }, expectedErr: true},
+		"negative dial timeout":      {modify: func(c *forward.Config) { c.DialTimeout = -time.Second }, expectedErr: true},
+		"zero purge interval":        {modify: func(c *forward.Config) { c.PurgeInterval = 0 }, expectedErr: true},
+		"interval exceeds timeout":   {modify: func(c *forward.Config) { c.PurgeInterval = 2 * c.PurgeTimeout }, expectedErr: true},
+		"purge disabled sans values": {modify: func(c *forward.Config) { c.DisablePurgeInactive, c.PurgeTimeout, c.PurgeInterval = true, 0, 0 }},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			config := forward.DefaultConfig()
+			c.modify(&config)
+			err := config.Validate()
+			if c.expectedErr {
+				assert.Error(t, err, "expected an error but got none")
+				_, err := forward.NewCoreProxyWithConfig(config)
+				assert.Error(t, err, "invalid configuration accepted")
+				return
+			}
+			assert.NoError(t, err, "unexpected error")
+		})
+	}
+}
+
+type testDialerManager struct {
+	started, stopped bool
+}
+
+func (m *testDialerManager) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	w.WriteHeader(http.StatusTeapot)
+	return nil
+}
+
+func (m *testDialerManager) GetDialer(session.SessionData, bool) (panpolicy.PANDialer, error) {
+	return nil, nil
+}
+
+func (m *testDialerManager) Start() error {
+	m.started = true
+	return nil
+}
+
+func (m *testDialerManager) Stop() error {
+	m.stopped = true
+	return nil
+}
+
+func TestNewCoreProxyWithConfig(t *testing.T) {
+	manager := &testDialerManager{}
+	cp, err := forward.NewCoreProxyWithConfig(forward.DefaultConfig(),
+		forward.WithDialerManager(manager),
+		forward.WithSessionStore(session.NewCookieStore(zap.NewNop(), session.GenerateRandomKeys()...)),
+	)
+	require.NoError(t, err)
+	cp.SetHostsFile(hostsfile.Config{Disabled: true})
+
+	require.NoError(t, cp.Initialize())
+	assert.True(t, manager.started, "dialer manager not started")
+	recorder := httptest.NewRecorder()
+	require.NoError(t, cp.HandlePolicyPath(recorder, httptest.NewRequest(http.MethodGet, apiPolicyPath, nil)))
+	assert.Equal(t, http.StatusTeapot, recorder.Code, "request not handled by the dialer manager")
+
+	require.NoError(t, cp.Cleanup())
+	assert.True(t, manager.stopped, "dialer manager not stopped")
+
+	// the injected manager does not support multipath
+	cp, err = forward.NewCoreProxyWithConfig(forward.DefaultConfig(), forward.WithDialerManager(&testDialerManager{}))
+	require.NoError(t, err)
+	cp.SetHostsFile(hostsfile.Config{Disabled: true})
+	cp.EnableMultipath(2)
+	assert.Error(t, cp.Initialize(), "unsupported multipath accepted")
+
+	cp, err = forward.NewCoreProxyWithConfig(forward.DefaultConfig(), forward.WithDialerManager(&testDialerManager{}))
+	require.NoError(t, err)
+	cp.SetHostsFile(hostsfile.Config{Disabled: true})
+	cp.SetUpstreamProxies(panpolicy.UpstreamConfig{Default: "http://gateway:3128"})
+	assert.Error(t, cp.Initialize(), "unsupported upstream proxies accepted")
+}
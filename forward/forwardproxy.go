@@ -17,36 +17,48 @@ package forward
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/textproto"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
 	"github.com/netsec-ethz/scion-apps/pkg/shttp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/scionproto/scion/pkg/addr"
 	"go.uber.org/zap"
 
+	"github.com/scionproto-contrib/http-proxy/forward/accesslog"
+	"github.com/scionproto-contrib/http-proxy/forward/acl"
+	"github.com/scionproto-contrib/http-proxy/forward/auth"
+	"github.com/scionproto-contrib/http-proxy/forward/hostsfile"
 	"github.com/scionproto-contrib/http-proxy/forward/ioutils"
+	"github.com/scionproto-contrib/http-proxy/forward/metrics"
+	"github.com/scionproto-contrib/http-proxy/forward/pac"
 	"github.com/scionproto-contrib/http-proxy/forward/panpolicy"
+	"github.com/scionproto-contrib/http-proxy/forward/ratelimit"
 	"github.com/scionproto-contrib/http-proxy/forward/resolver"
 	"github.com/scionproto-contrib/http-proxy/forward/session"
+	"github.com/scionproto-contrib/http-proxy/forward/strictscion"
 	"github.com/scionproto-contrib/http-proxy/forward/utils"
 )
 
-const (
-	hostsFile    = "/etc/hosts"
-	hostsComment = " # Line added by the SCION HTTP Forward Proxy"
-	hostName     = "forward-proxy.scion"
-	// TODO: make the address injectable via configuration
-	hostsEntry = "127.0.0.1\t" + hostName
-)
+// DefaultTunnelIdleTimeout is the time after which idle tunnels are closed, see SetTunnelTimeouts.
+const DefaultTunnelIdleTimeout = 5 * time.Minute
 
 // ResolveHandler defines an interface for handling HTTP requests related to
 // host resolution and redirection. Implementations of this interface should
@@ -71,44 +83,264 @@ type CoreProxy struct {
 	purgeTimeout         time.Duration
 	purgeInterval        time.Duration
 	metricsHandler       HTTPHandler
+	aggregateHandler     HTTPHandler
+	adminToken           string
+	authenticator        auth.Authenticator
+	accessControl        *acl.List
 	policyManager        panpolicy.DialerManager
 	scionHostResolver    ResolveHandler
 	resolver             resolver.Resolver
+	fallbackTracker      *panpolicy.FallbackTracker
+	raceTransports       bool
+	raceHeadStart        time.Duration
+	strictSCION          *strictscion.Store
+	pacConfig            pac.Config
+	scionHosts           *pac.Store
+	sessionStore         session.SessionStore
+	countryMappingFile   string
+	multipathSubflows    int
+	upstreamConfig       panpolicy.UpstreamConfig
+	tunnelTimeouts       ioutils.Options
+	bandwidthLimits      ratelimit.Config
+	limiters             *ratelimit.Limiters
+	collector            *metrics.Collector
+	prometheusHandler    http.Handler
+	accessLog            *accesslog.Logger
+	hostsFileConfig      hostsfile.Config
+	hostsFile            *hostsfile.Manager
 }
 
-// NewCoreProxy creates a new CoreProxy instance.
+// NewCoreProxy creates a new CoreProxy instance. Unlike NewCoreProxyWithConfig, it does not
+// validate the timeouts.
 func NewCoreProxy(logger *zap.Logger, resolveTimeout, dialTimeout, purgeTimeout, purgeInterval time.Duration, disablePurgeInactive bool) *CoreProxy {
-	// TODO: add logic for handling incorrect Timeout values
+	return newCoreProxy(logger, Config{
+		ResolveTimeout:       resolveTimeout,
+		DialTimeout:          dialTimeout,
+		PurgeTimeout:         purgeTimeout,
+		PurgeInterval:        purgeInterval,
+		DisablePurgeInactive: disablePurgeInactive,
+	})
+}
+
+func newCoreProxy(logger *zap.Logger, config Config) *CoreProxy {
 	return &CoreProxy{
 		logger:               logger,
-		resolveTimeout:       resolveTimeout,
-		dialTimeout:          dialTimeout,
-		disablePurgeInactive: disablePurgeInactive,
-		purgeTimeout:         purgeTimeout,
-		purgeInterval:        purgeInterval,
+		resolveTimeout:       config.ResolveTimeout,
+		dialTimeout:          config.DialTimeout,
+		disablePurgeInactive: config.DisablePurgeInactive,
+		purgeTimeout:         config.PurgeTimeout,
+		purgeInterval:        config.PurgeInterval,
+		tunnelTimeouts:       ioutils.Options{IdleTimeout: DefaultTunnelIdleTimeout},
+		accessControl:        acl.DefaultList(),
 	}
 }
 
+// EnableFallback makes the proxy retry failed or timed-out SCION dials over TCP/IP.
+// Destinations for which the SCION dial failed are reached over TCP/IP directly
+// until the cool-down expires. It must be called before Initialize.
+func (cp *CoreProxy) EnableFallback(cooldown time.Duration) {
+	cp.fallbackTracker = panpolicy.NewFallbackTracker(cooldown)
+}
+
+// EnableRacing makes the proxy race SCION against TCP/IP for SCION-enabled hosts
+// and use whichever connection is established first. SCION is given the head start,
+// so that it is preferred if both transports are healthy. It must be called before Initialize.
+func (cp *CoreProxy) EnableRacing(headStart time.Duration) {
+	cp.raceTransports = true
+	cp.raceHeadStart = headStart
+}
+
+// SetSessionStore sets the store used to persist session data, e.g., the path policy.
+// If not set, the session data is kept in cookies protected with the keys configured
+// in the environment, see session.KeysFromEnv. It must be called before Initialize.
+func (cp *CoreProxy) SetSessionStore(store session.SessionStore) {
+	cp.sessionStore = store
+}
+
+// SetCountryMappingFile sets the file mapping ASes to countries, which allows clients to
+// restrict their paths to countries with geofence policies, see panpolicy.LoadCountryMapping.
+// It must be called before Initialize.
+func (cp *CoreProxy) SetCountryMappingFile(path string) {
+	cp.countryMappingFile = path
+}
+
+// EnableMultipath makes the proxy stripe CONNECT tunnels to SCION destinations over up to
+// subflows disjoint paths, if the destination supports it (see networks/multipath), such that
+// bulk transfers use the aggregate bandwidth of the paths. It must be called before Initialize.
+func (cp *CoreProxy) EnableMultipath(subflows int) {
+	cp.multipathSubflows = subflows
+}
+
+// SetUpstreamProxies routes the connections to destinations reached over TCP/IP through
+// parent HTTP or SOCKS5 proxies, e.g., the gateway of a corporate network, while SCION
+// connections are dialed natively. It must be called before Initialize.
+func (cp *CoreProxy) SetUpstreamProxies(config panpolicy.UpstreamConfig) {
+	cp.upstreamConfig = config
+}
+
+// SetTunnelTimeouts sets the time after which CONNECT tunnels without data transferred in
+// either direction are closed, and the maximum lifetime of tunnels. Zero disables a timeout,
+// by default idle tunnels are closed after 5 minutes and the lifetime is not limited.
+func (cp *CoreProxy) SetTunnelTimeouts(idle, maxLifetime time.Duration) {
+	cp.tunnelTimeouts = ioutils.Options{IdleTimeout: idle, MaxLifetime: maxLifetime}
+}
+
+// SetBandwidthLimits limits the bandwidth of tunnels and forwarded requests globally, per
+// client and per destination host. It must be called before Initialize.
+func (cp *CoreProxy) SetBandwidthLimits(limits ratelimit.Config) {
+	cp.bandwidthLimits = limits
+}
+
+// SetAccessLog sets the log to which a record of each proxied request and tunnel is written.
+// The log is closed by Cleanup.
+func (cp *CoreProxy) SetAccessLog(log *accesslog.Logger) {
+	cp.accessLog = log
+}
+
+// SetHostsFile configures the entries mapping the host name of the proxy to its addresses, which
+// are added to the hosts file by Initialize and removed by Cleanup. By default, forward-proxy.scion
+// is mapped to 127.0.0.1 in /etc/hosts. It must be called before Initialize.
+func (cp *CoreProxy) SetHostsFile(config hostsfile.Config) {
+	cp.hostsFileConfig = config
+}
+
+// SetAdminToken sets the bearer token required by the admin endpoints, e.g.,
+// HandleSharedPathUsage. Without a token, the admin endpoints are disabled.
+func (cp *CoreProxy) SetAdminToken(token string) {
+	cp.adminToken = token
+}
+
+// SetAuthenticator makes the proxy require clients to authenticate, e.g., with an auth.Chain
+// of the methods users can choose from. Clients then pass the session cookie in an additional
+// Proxy-Authorization header, or use the default policy without it.
+func (cp *CoreProxy) SetAuthenticator(a auth.Authenticator) {
+	cp.authenticator = a
+}
+
+// SetAccessControl sets the list deciding which destinations clients may reach, by default
+// acl.DefaultList. Nil allows all destinations. It must be called before Initialize.
+func (cp *CoreProxy) SetAccessControl(list *acl.List) {
+	cp.accessControl = list
+}
+
+// SetPACConfig configures the proxy auto-config file served by HandlePAC, e.g., the
+// SCION-enabled hosts known in advance. It must be called before Initialize.
+func (cp *CoreProxy) SetPACConfig(config pac.Config) {
+	cp.pacConfig = config
+}
+
 // Initialize initializes the core proxy logic.
 func (cp *CoreProxy) Initialize() error {
+	if cp.accessControl != nil {
+		if err := cp.accessControl.Validate(); err != nil {
+			return fmt.Errorf("access control list: %w", err)
+		}
+	}
+	if cp.sessionStore == nil {
+		keyPairs, err := session.KeysFromEnv()
+		if errors.Is(err, session.ErrNoSessionKeys) {
+			cp.logger.Info("No session keys configured, generating random keys. Sessions do not survive restarts.")
+			keyPairs = session.GenerateRandomKeys()
+		} else if err != nil {
+			return err
+		}
+		cp.sessionStore = session.NewCookieStore(cp.logger.With(zap.String("component", "session-store")), keyPairs...)
+	}
+
+	limiters, err := ratelimit.New(cp.bandwidthLimits)
+	if err != nil {
+		return err
+	}
+	cp.limiters = limiters
+	hostsFile, err := hostsfile.New(cp.logger.With(zap.String("component", "hosts-file")), cp.hostsFileConfig)
+	if err != nil {
+		return err
+	}
+	cp.hostsFile = hostsFile
+
 	cp.scionHostResolver = resolver.NewScionHostResolver(cp.logger.With(zap.String("component", "scion-host-resolver")), cp.resolveTimeout)
-	cp.policyManager = panpolicy.NewPolicyManager(cp.logger.With(zap.String("component", "policy-manager")), cp.dialTimeout, !cp.disablePurgeInactive, cp.purgeTimeout, cp.purgeInterval)
+	if cp.policyManager == nil {
+		cp.policyManager = panpolicy.NewPolicyManager(cp.logger.With(zap.String("component", "policy-manager")), cp.sessionStore, cp.dialTimeout, !cp.disablePurgeInactive, cp.purgeTimeout, cp.purgeInterval)
+	}
+	if cp.countryMappingFile != "" {
+		cs, ok := cp.policyManager.(countryMapper)
+		if !ok {
+			return fmt.Errorf("dialer manager %T does not support country mappings", cp.policyManager)
+		}
+		countries, err := panpolicy.LoadCountryMapping(cp.countryMappingFile)
+		if err != nil {
+			return err
+		}
+		cs.SetCountryMapping(countries)
+	}
+	if cp.multipathSubflows > 1 {
+		ms, ok := cp.policyManager.(multipathEnabler)
+		if !ok {
+			return fmt.Errorf("dialer manager %T does not support multipath", cp.policyManager)
+		}
+		ms.SetMultipathSubflows(cp.multipathSubflows)
+	}
+	if !cp.upstreamConfig.IsZero() {
+		us, ok := cp.policyManager.(upstreamSetter)
+		if !ok {
+			return fmt.Errorf("dialer manager %T does not support upstream proxies", cp.policyManager)
+		}
+		upstream, err := panpolicy.NewUpstream(cp.upstreamConfig, cp.dialTimeout)
+		if err != nil {
+			return err
+		}
+		us.SetUpstream(upstream)
+	}
 	if err := cp.policyManager.Start(); err != nil {
 		return err
 	}
-	cp.metricsHandler = panpolicy.NewMetricsHandler(cp.policyManager, cp.logger.With(zap.String("component", "metrics-handler")))
-	cp.resolver = resolver.NewPANResolver(cp.logger.With(zap.String("component", "resolver")), cp.resolveTimeout)
+	cp.metricsHandler = panpolicy.NewMetricsHandler(cp.policyManager, cp.sessionStore, cp.logger.With(zap.String("component", "metrics-handler")))
+	cp.aggregateHandler = panpolicy.NewAggregateMetricsHandler(cp.policyManager, cp.logger.With(zap.String("component", "aggregate-metrics-handler")))
+	stats, _ := cp.policyManager.(metrics.DialerStats)
+	cp.collector = metrics.NewCollector(stats)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(cp.collector)
+	cp.prometheusHandler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	if cp.resolver == nil {
+		cp.resolver = resolver.NewPANResolver(cp.logger.With(zap.String("component", "resolver")), cp.resolveTimeout)
+	}
+	cp.strictSCION = strictscion.NewStore(strictscion.DefaultMaxAge, strictscion.DefaultMaxHosts)
+	cp.scionHosts = pac.NewStore(pac.DefaultMaxAge, pac.DefaultMaxHosts)
 
-	if err := cp.addHostsEntry(); err != nil {
-		cp.logger.Warn("Failed to add entry to /etc/hosts file", zap.Error(err))
+	if err := cp.hostsFile.Add(); err != nil {
+		cp.logger.Warn("Failed to add entry to hosts file", zap.Error(err))
 	}
 	return nil
 }
 
+// ReloadSessionKeys reloads the session keys from the environment, see session.KeysFromEnv,
+// and replaces the keys of the session store. Sessions protected with a key that is
+// no longer configured become invalid.
+func (cp *CoreProxy) ReloadSessionKeys() error {
+	rotator, ok := cp.sessionStore.(session.KeyRotator)
+	if !ok {
+		return fmt.Errorf("session store %T does not support key rotation", cp.sessionStore)
+	}
+	keyPairs, err := session.KeysFromEnv()
+	if err != nil {
+		return err
+	}
+	if err := rotator.SetKeyPairs(keyPairs...); err != nil {
+		return err
+	}
+	cp.logger.Info("Reloaded session keys.", zap.Int("key-pairs", len(keyPairs)/2))
+	return nil
+}
+
 // Cleanup cleans up the core proxy logic.
 func (cp *CoreProxy) Cleanup() error {
-	if err := cp.removeHostsEntry(); err != nil {
-		cp.logger.Warn("Failed to remove entry from /etc/hosts file", zap.Error(err))
+	if err := cp.hostsFile.Remove(); err != nil {
+		cp.logger.Warn("Failed to remove entry from hosts file", zap.Error(err))
+	}
+	if cp.accessLog != nil {
+		if err := cp.accessLog.Close(); err != nil {
+			cp.logger.Warn("Failed to close access log", zap.Error(err))
+		}
 	}
 	return cp.policyManager.Stop()
 }
@@ -129,6 +361,70 @@ func (cp *CoreProxy) HandlePathUsage(w http.ResponseWriter, r *http.Request) err
 	return cp.metricsHandler.ServeHTTP(w, r)
 }
 
+// HandleSharedPathUsage reports the paths and dials of the shared dialer, which serves all
+// sessions without path policy, aggregated per destination ISD-AS. It requires the admin
+// token, see SetAdminToken.
+func (cp *CoreProxy) HandleSharedPathUsage(w http.ResponseWriter, r *http.Request) error {
+	if err := cp.authorizeAdmin(w, r); err != nil {
+		return err
+	}
+	return cp.aggregateHandler.ServeHTTP(w, r)
+}
+
+// Collector returns the Prometheus collector of the proxy metrics, e.g., to register it
+// with the registry of the embedding application. It must be called after Initialize.
+func (cp *CoreProxy) Collector() prometheus.Collector {
+	return cp.collector
+}
+
+// HandlePrometheusMetrics serves the proxy metrics in the Prometheus exposition format.
+// It requires the admin token, see SetAdminToken.
+func (cp *CoreProxy) HandlePrometheusMetrics(w http.ResponseWriter, r *http.Request) error {
+	if err := cp.authorizeAdmin(w, r); err != nil {
+		return err
+	}
+	cp.prometheusHandler.ServeHTTP(w, r)
+	return nil
+}
+
+func (cp *CoreProxy) authorizeAdmin(w http.ResponseWriter, r *http.Request) error {
+	if cp.adminToken == "" {
+		return utils.NewHandlerError(http.StatusForbidden, errors.New("admin endpoints are disabled"))
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cp.adminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		return utils.NewHandlerError(http.StatusUnauthorized, errors.New("invalid or missing admin token"))
+	}
+	return nil
+}
+
+// HandlePAC serves a proxy auto-config file, which makes browsers use the proxy for the hosts
+// configured with SetPACConfig and the hosts recently reached over SCION, and connect
+// to all other hosts directly.
+func (cp *CoreProxy) HandlePAC(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return utils.NewHandlerError(http.StatusMethodNotAllowed, errors.New("HTTP GET allowed only"))
+	}
+	proxyAddr := cp.pacConfig.Proxy
+	if proxyAddr == "" {
+		proxyAddr = r.Host
+	}
+	directive := "PROXY " + proxyAddr
+	if r.TLS != nil {
+		directive = "HTTPS " + proxyAddr
+	}
+
+	var b bytes.Buffer
+	if err := pac.Write(&b, directive, cp.scionHosts.Hosts(), cp.pacConfig.Hosts); err != nil {
+		return utils.NewHandlerError(http.StatusInternalServerError, err)
+	}
+	w.Header().Set("Content-Type", pac.ContentType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(b.Bytes())
+	return nil
+}
+
 func (cp *CoreProxy) HandleResolveURL(w http.ResponseWriter, r *http.Request) error {
 	return cp.scionHostResolver.HandleRedirectBackOrError(w, r)
 }
@@ -137,99 +433,378 @@ func (cp *CoreProxy) HandleResolveHost(w http.ResponseWriter, r *http.Request) e
 	return cp.scionHostResolver.HandleHostResolutionRequest(w, r)
 }
 
-func (cp *CoreProxy) HandleTunnelRequest(w http.ResponseWriter, r *http.Request) error {
+func (cp *CoreProxy) HandleTunnelRequest(w http.ResponseWriter, r *http.Request) (err error) {
+	kind := metrics.KindForward
+	if r.Method == http.MethodConnect {
+		kind = metrics.KindTunnel
+	}
+	hostPort := r.URL.Host
+	if hostPort == "" {
+		hostPort = r.Host
+	}
+	record := accesslog.Record{
+		Time:   time.Now(),
+		Client: r.RemoteAddr,
+		Method: r.Method,
+		Host:   hostPort,
+		Proto:  r.Proto,
+	}
+	var pr *proxiedRequest
+	defer func() {
+		cp.observeRequest(kind, &record, pr, err)
+	}()
+
+	identity, err := cp.authenticate(w, r)
+	if err != nil {
+		return err
+	}
+	record.User = identity.Name
+
 	// get session
-	err := cp.parseCookieFromProxyAuth(w, r)
+	err = cp.parseCookieFromProxyAuth(w, r)
 	if err != nil {
 		return utils.NewHandlerError(http.StatusInternalServerError, err)
 	}
 
 	// parse session date from cookie e.g. policy
-	sessionData, err := session.GetSessionData(cp.logger, r)
+	sessionData, err := cp.sessionStore.GetSessionData(r)
 	if err != nil {
 		return utils.NewHandlerError(http.StatusInternalServerError, err)
 	}
 	cp.logger.Debug("Having session.", zap.String("session-id", sessionData.ID))
+	record.SessionID = sessionData.ID
 
-	hostPort := r.URL.Host
-	if hostPort == "" {
-		hostPort = r.Host
+	var ctx context.Context
+	pr, ctx, err = cp.prepareRequest(r.Context(), &record, sessionData, r.Method, r.URL.Scheme, hostPort)
+	if err != nil {
+		return err
 	}
+	r = r.WithContext(ctx)
+
+	if r.Method == http.MethodConnect {
+		cp.logger.Debug("Tunneling.", zap.String("host", r.Host))
+		return cp.tunnelRequest(w, r, pr)
+	}
+
+	cp.logger.Debug("Proxying.", zap.String("host", r.Host), zap.String("method", r.Method))
+	return cp.forwardRequest(w, r, pr)
+}
+
+// prepareRequest resolves the destination of a request or tunnel of the session and chooses the
+// dialer for it, recording the resolution in the access log record. It returns the context
+// to dial with, in which the addresses dialed over TCP/IP are checked by the access control list.
+func (cp *CoreProxy) prepareRequest(ctx context.Context, record *accesslog.Record, sessionData session.SessionData, method, scheme, hostPort string) (*proxiedRequest, context.Context, error) {
 	cp.logger.Debug("Resolving host.", zap.String("host", hostPort))
-	addr, _ := cp.resolver.Resolve(r.Context(), hostPort)
+	resolveStart := time.Now()
+	addr, resolveErr := cp.resolver.Resolve(ctx, hostPort)
+	record.ResolveDuration = time.Since(resolveStart)
+	cp.collector.ObserveResolve(resolveOutcome(addr, resolveErr), record.ResolveDuration)
+	if !addr.IsZero() {
+		record.SCIONAddress = addr.String()
+	}
 
 	// get dialer based on policy and destination address
 	useScion := !addr.IsZero()
+	strict := cp.strictSCION.IsStrict(hostPort)
+	if !useScion && strict {
+		cp.logger.Info("Refusing to reach Strict-SCION host over TCP/IP.", zap.String("host", hostPort))
+		return nil, nil, utils.NewHandlerError(http.StatusForbidden,
+			fmt.Errorf("host %s announced Strict-SCION but is not reachable over SCION; refusing to connect over TCP/IP", hostPort))
+	}
+	if useScion && !strict && cp.fallbackTracker != nil && cp.fallbackTracker.InCooldown(hostPort) {
+		cp.logger.Debug("SCION recently failed for host; skipping SCION.", zap.String("host", hostPort))
+		useScion = false
+	}
+	if cp.accessControl != nil {
+		access, err := accessRequest(method, scheme, hostPort)
+		if err != nil {
+			return nil, nil, utils.NewHandlerError(http.StatusBadRequest, err)
+		}
+		if useScion {
+			access = withIA(access, addr)
+		}
+		if err := cp.checkAccess(access); err != nil {
+			return nil, nil, utils.NewHandlerError(http.StatusForbidden, err)
+		}
+		// destinations reached over TCP/IP, e.g., after falling back from SCION, are checked
+		// again by the dialer, once the host name is resolved
+		access.IA = 0
+		ctx = panpolicy.WithAddressCheck(ctx, func(addrPort netip.AddrPort) error {
+			access := access
+			access.Address = addrPort.Addr()
+			return cp.checkAccess(access)
+		})
+	}
+
 	dialer, err := cp.policyManager.GetDialer(sessionData, useScion)
 	if err != nil {
-		return utils.NewHandlerError(http.StatusInternalServerError, err)
+		return nil, nil, utils.NewHandlerError(http.StatusInternalServerError, err)
+	}
+	if useScion && !strict && (cp.raceTransports || cp.fallbackTracker != nil) {
+		stdDialer, err := cp.policyManager.GetDialer(sessionData, false)
+		if err != nil {
+			return nil, nil, utils.NewHandlerError(http.StatusInternalServerError, err)
+		}
+		if cp.raceTransports {
+			dialer = panpolicy.NewRacingDialer(cp.logger.With(zap.String("component", "racing-dialer")), dialer, stdDialer, cp.raceHeadStart)
+		} else {
+			dialer = panpolicy.NewFallbackDialer(cp.logger.With(zap.String("component", "fallback-dialer")), dialer, stdDialer, cp.fallbackTracker)
+		}
 	}
 
-	if r.Method == http.MethodConnect {
-		cp.logger.Debug("Tunneling.", zap.String("host", r.Host))
-		return cp.tunnelRequest(w, r, dialer)
+	transport := metrics.TransportIP
+	if useScion {
+		transport = metrics.TransportSCION
 	}
+	pr := &proxiedRequest{
+		dialer:  newObservedDialer(dialer, cp.collector, cp.scionHosts, transport),
+		limiter: cp.limiters.For(ratelimit.ClientKey(record.User, record.Client), hostPort),
+	}
+	return pr, ctx, nil
+}
 
-	cp.logger.Debug("Proxying.", zap.String("host", r.Host), zap.String("method", r.Method))
-	return cp.forwardRequest(w, r, dialer)
+// accessRequest returns the request for the access control list, without the address of
+// the destination.
+func accessRequest(method, scheme, hostPort string) (acl.Request, error) {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		// forwarded requests need not have a port
+		host, portStr = hostPort, "80"
+		if scheme == "https" {
+			portStr = "443"
+		}
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return acl.Request{}, fmt.Errorf("invalid port of %s: %w", hostPort, err)
+	}
+	return acl.Request{Method: method, Host: host, Port: uint16(port)}, nil
+}
+
+func withIA(access acl.Request, scionAddr pan.UDPAddr) acl.Request {
+	access.IA = addr.IA(scionAddr.IA)
+	return access
 }
 
-func (cp *CoreProxy) addHostsEntry() error {
-	content, err := os.ReadFile(hostsFile)
+// checkAccess evaluates the access control list, it returns an acl.DeniedError if the
+// destination is denied.
+func (cp *CoreProxy) checkAccess(access acl.Request) error {
+	decision := cp.accessControl.Evaluate(access)
+	fields := []zap.Field{
+		zap.String("method", access.Method),
+		zap.String("host", access.Host),
+		zap.Uint16("port", access.Port),
+		zap.Int("rule", decision.Rule),
+	}
+	if access.Address.IsValid() {
+		fields = append(fields, zap.Stringer("address", access.Address))
+	}
+	if !access.IA.IsZero() {
+		fields = append(fields, zap.Stringer("isd-as", access.IA))
+	}
+	if !decision.Allowed {
+		cp.logger.Info("Destination denied by access control list.", append(fields, zap.String("reason", decision.Reason))...)
+		return &acl.DeniedError{Decision: decision}
+	}
+	if !decision.Deferred {
+		cp.logger.Debug("Destination allowed by access control list.", fields...)
+	}
+	return nil
+}
+
+// dialError returns the error of a failed dial, with status 403 if the destination was
+// denied by the access control list.
+func dialError(status int, err error) error {
+	var denied *acl.DeniedError
+	if errors.As(err, &denied) {
+		return utils.NewHandlerError(http.StatusForbidden, denied)
+	}
+	return utils.NewHandlerError(status, err)
+}
+
+// proxiedRequest is the state of a request or tunnel being proxied, which is reported
+// in the metrics and the access log once it is done.
+type proxiedRequest struct {
+	dialer  *observedDialer
+	limiter ioutils.Limiter
+
+	// status is the status of the response from the destination, if any.
+	status     int
+	upstream   atomic.Int64
+	downstream atomic.Int64
+}
+
+// observeRequest completes the access log record of a request handled by HandleTunnelRequest,
+// which returned err, and reports it in the metrics and the access log, if any.
+func (cp *CoreProxy) observeRequest(kind string, record *accesslog.Record, pr *proxiedRequest, err error) {
+	record.Duration = time.Since(record.Time)
+	record.Transport = metrics.TransportNone
+	record.Status = http.StatusOK
+	if pr != nil {
+		record.Transport = pr.dialer.Transport()
+		record.Path = panpolicy.PathHops(pr.dialer.Conn())
+		record.DialDuration = pr.dialer.DialDuration()
+		record.BytesUpstream = pr.upstream.Load()
+		record.BytesDownstream = pr.downstream.Load()
+		if pr.status != 0 {
+			record.Status = pr.status
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("failed to read hosts file: %w", err)
+		record.Status = http.StatusInternalServerError
+		var he *utils.HandlerError
+		if errors.As(err, &he) && he.StatusCode != 0 {
+			record.Status = he.StatusCode
+		}
 	}
 
-	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		if !strings.HasPrefix(strings.TrimSpace(line), "#") && strings.Contains(line, hostName) {
-			cp.logger.Debug("Entry for host name already exists", zap.String("entry", line))
-			return nil
+	cp.collector.ObserveRequest(kind, record.Transport, requestOutcome(err))
+	if cp.accessLog != nil {
+		if err := cp.accessLog.Log(*record); err != nil {
+			cp.logger.Warn("Failed to write access log.", zap.Error(err))
 		}
 	}
+}
 
-	file, err := os.OpenFile(hostsFile, os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to open hosts file for writing: %w", err)
+// requestOutcome classifies the error returned by HandleTunnelRequest for the metrics.
+func requestOutcome(err error) string {
+	if err == nil {
+		return metrics.OutcomeSuccess
+	}
+	var he *utils.HandlerError
+	if !errors.As(err, &he) {
+		return metrics.OutcomeError
 	}
-	defer file.Close()
+	switch {
+	case he.StatusCode == http.StatusBadGateway || he.StatusCode == http.StatusServiceUnavailable ||
+		he.StatusCode == http.StatusGatewayTimeout:
+		return metrics.OutcomeUpstreamError
+	case he.StatusCode >= 400 && he.StatusCode < 500:
+		return metrics.OutcomeRejected
+	default:
+		return metrics.OutcomeError
+	}
+}
 
-	entry := hostsComment + "\n" + hostsEntry + "\n"
-	if _, err := file.WriteString(entry); err != nil {
-		return fmt.Errorf("failed to write to hosts file: %w", err)
+func resolveOutcome(addr pan.UDPAddr, err error) string {
+	switch {
+	case errors.Is(err, resolver.ErrResolveTimeout):
+		return metrics.ResolveTimeout
+	case err == nil && !addr.IsZero():
+		return metrics.ResolveSCION
+	default:
+		return metrics.ResolveNone
 	}
+}
 
-	cp.logger.Info("Added entry to hosts file", zap.String("entry", hostsEntry))
-	return nil
+// observedDialer records the latency of the dials of a request and the transport
+// they were eventually established over, e.g., if TCP/IP won a race against SCION.
+type observedDialer struct {
+	panpolicy.PANDialer
+	collector *metrics.Collector
+	// scionHosts learns the destinations reached over SCION, which are allowed and dialed
+	scionHosts *pac.Store
+
+	mutex        sync.Mutex
+	transport    string
+	conn         net.Conn
+	dialDuration time.Duration
 }
 
-func (cp *CoreProxy) removeHostsEntry() error {
-	content, err := os.ReadFile(hostsFile)
-	if err != nil {
-		return fmt.Errorf("failed to read hosts file: %w", err)
+func newObservedDialer(dialer panpolicy.PANDialer, collector *metrics.Collector, scionHosts *pac.Store, transport string) *observedDialer {
+	return &observedDialer{
+		PANDialer:  dialer,
+		collector:  collector,
+		scionHosts: scionHosts,
+		transport:  transport,
 	}
+}
 
-	var newLines []string
-	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		if !strings.Contains(line, hostsEntry) && !strings.Contains(line, hostsComment) {
-			newLines = append(newLines, line)
+func (d *observedDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := d.PANDialer.DialContext(ctx, network, addr)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err == nil {
+		d.transport = metrics.TransportOf(conn)
+		d.conn = conn
+		if d.transport == metrics.TransportSCION {
+			d.scionHosts.Observe(addr)
 		}
 	}
+	d.dialDuration = time.Since(start)
+	d.collector.ObserveDial(d.transport, d.dialDuration, err)
+	return conn, err
+}
+
+// Transport returns the transport of the last established connection, or the
+// transport intended to be used if none was established.
+func (d *observedDialer) Transport() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.transport
+}
+
+// Conn returns the last established connection, if any.
+func (d *observedDialer) Conn() net.Conn {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.conn
+}
+
+// DialDuration returns the duration of the last dial.
+func (d *observedDialer) DialDuration() time.Duration {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.dialDuration
+}
 
-	err = os.WriteFile(hostsFile, []byte(strings.Join(newLines, "\n")), 0644)
+// authenticate authenticates the client with the authenticator, if any, and challenges
+// clients that failed to authenticate.
+func (cp *CoreProxy) authenticate(w http.ResponseWriter, r *http.Request) (auth.Identity, error) {
+	identity, err := cp.identify(r)
 	if err != nil {
-		return fmt.Errorf("failed to write to hosts file: %w", err)
+		challenges := cp.authenticator.Challenges()
+		if len(challenges) == 0 {
+			// only client certificates are accepted, which cannot be requested with a 407
+			return auth.Identity{}, utils.NewHandlerError(http.StatusForbidden, err)
+		}
+		for _, challenge := range challenges {
+			w.Header().Add("Proxy-Authenticate", challenge)
+		}
+		return auth.Identity{}, utils.NewHandlerError(http.StatusProxyAuthRequired, err)
 	}
+	return identity, nil
+}
 
-	cp.logger.Info("Removed entry from hosts file", zap.String("entry", hostsEntry))
-	return nil
+// identify authenticates the client with the authenticator, if any.
+func (cp *CoreProxy) identify(r *http.Request) (auth.Identity, error) {
+	if cp.authenticator == nil {
+		return auth.Identity{}, nil
+	}
+	identity, err := cp.authenticator.Authenticate(r)
+	if err != nil {
+		cp.logger.Info("Proxy authentication failed.", zap.String("client", r.RemoteAddr), zap.Error(err))
+		// the client must not learn why, e.g., whether the user exists
+		if errors.Is(err, auth.ErrNoCredentials) {
+			return auth.Identity{}, auth.ErrNoCredentials
+		}
+		return auth.Identity{}, auth.ErrInvalidCredentials
+	}
+	cp.logger.Debug("Client authenticated.", zap.String("user", identity.Name), zap.String("method", identity.Method))
+	return identity, nil
 }
 
 func (cp *CoreProxy) parseCookieFromProxyAuth(w http.ResponseWriter, r *http.Request) error {
 	// the path policy cookie is passed in the proxy-authorization header as the cookie
 	username, cookie, err := proxyBasicAuth(r)
-	if err != nil || username != "policy" {
+	if (err != nil || username != auth.PolicyUser) && cp.authenticator != nil {
+		// authenticated clients need not pass a session cookie
+		removeForwardProxyCookie(r)
+		return nil
+	}
+	if err != nil || username != auth.PolicyUser {
 		cp.logger.Warn("Invalid or not provided proxy authorization header.", zap.Error(err))
 
 		w.Header().Set("Proxy-Authenticate", "Basic realm=caddy-scion-forward-proxy") // realm is a garbage value
@@ -255,33 +830,41 @@ func (cp *CoreProxy) parseCookieFromProxyAuth(w http.ResponseWriter, r *http.Req
 	return nil
 }
 
+// proxyBasicAuth returns the session cookie carrier among the Proxy-Authorization headers,
+// which may also carry the credentials of the client.
 func proxyBasicAuth(r *http.Request) (username, password string, err error) {
-	auth := r.Header.Get("Proxy-Authorization")
-	if auth == "" {
+	values := r.Header.Values("Proxy-Authorization")
+	if len(values) == 0 {
 		return "", "", nil
 	}
-	return parseBasicAuth(auth)
+	for _, value := range values {
+		username, password, err = parseBasicAuth(value)
+		if err == nil {
+			return username, password, nil
+		}
+	}
+	return "", "", err
 }
 
-func parseBasicAuth(auth string) (username, password string, err error) {
+func parseBasicAuth(header string) (username, password string, err error) {
 	const prefix = "Basic "
 	// Case insensitive prefix matccp.
-	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
 		return "", "", fmt.Errorf("authorization header format does not start with 'Basic '")
 	}
-	c, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	c, err := base64.StdEncoding.DecodeString(header[len(prefix):])
 	if err != nil {
 		return "", "", fmt.Errorf("failed to base64 decode authorization header: %v", err)
 	}
 	cs := string(c)
 	username, password, ok := strings.Cut(cs, ":")
-	if !ok || username != "policy" {
-		return "", "", fmt.Errorf("authorization header format does not contain policy:value %s", cs)
+	if !ok || username != auth.PolicyUser {
+		return "", "", fmt.Errorf("authorization header format does not contain %s:value", auth.PolicyUser)
 	}
 	return username, password, nil
 }
 
-func (cp *CoreProxy) tunnelRequest(w http.ResponseWriter, r *http.Request, dialer panpolicy.PANDialer) error {
+func (cp *CoreProxy) tunnelRequest(w http.ResponseWriter, r *http.Request, pr *proxiedRequest) error {
 	if r.ProtoMajor == 2 || r.ProtoMajor == 3 {
 		if len(r.URL.Scheme) > 0 || len(r.URL.Path) > 0 {
 			return utils.NewHandlerError(http.StatusBadRequest,
@@ -294,16 +877,17 @@ func (cp *CoreProxy) tunnelRequest(w http.ResponseWriter, r *http.Request, diale
 		hostPort = r.Host
 	}
 
-	targetConn, err := dialer.DialContext(r.Context(), "tcp", hostPort)
+	targetConn, err := pr.dialer.DialContext(panpolicy.WithMultipath(r.Context()), "tcp", hostPort)
 	if err != nil {
-		return utils.NewHandlerError(http.StatusServiceUnavailable, fmt.Errorf("failed to setup tunnel: %v", err))
+		return dialError(http.StatusServiceUnavailable, fmt.Errorf("failed to setup tunnel: %w", err))
 	}
 	defer targetConn.Close()
 	cp.logger.Debug("Set up tunnel.", zap.String("remote-address", targetConn.RemoteAddr().String()))
+	targetConn = cp.collector.CountTransferred(targetConn, metrics.TransportOf(targetConn))
 
 	switch r.ProtoMajor {
 	case 1: // http1: hijack the whole flow
-		if err := cp.serveHijack(w, targetConn); err != nil {
+		if err := cp.serveHijack(w, targetConn, pr); err != nil {
 			return utils.NewHandlerError(http.StatusInternalServerError, err)
 		}
 		return nil
@@ -317,7 +901,15 @@ func (cp *CoreProxy) tunnelRequest(w http.ResponseWriter, r *http.Request, diale
 			return utils.NewHandlerError(http.StatusInternalServerError,
 				fmt.Errorf("ResponseWriter flush error: %v", err))
 		}
-		if err := ioutils.DualStream(targetConn, r.Body, w); err != nil {
+		var clientReader io.Reader = r.Body
+		var clientWriter io.Writer = w
+		if streamer, ok := http3Streamer(w); ok {
+			// unlike the response, the HTTP/3 stream can be half-closed once the target is done
+			str := http3Stream{streamer.HTTPStream()}
+			defer str.Close()
+			clientReader, clientWriter = str, str
+		}
+		if err := cp.streamTunnel(targetConn, clientReader, clientWriter, pr); err != nil {
 			return utils.NewHandlerError(http.StatusInternalServerError, err)
 		}
 		return nil
@@ -329,7 +921,7 @@ func (cp *CoreProxy) tunnelRequest(w http.ResponseWriter, r *http.Request, diale
 
 // Hijacks the connection from ResponseWriter, writes the response and proxies data between targetConn
 // and hijacked connection.
-func (cp *CoreProxy) serveHijack(w http.ResponseWriter, targetConn net.Conn) error {
+func (cp *CoreProxy) serveHijack(w http.ResponseWriter, targetConn net.Conn, pr *proxiedRequest) error {
 	clientConn, bufReader, err := http.NewResponseController(w).Hijack()
 	if err != nil {
 		return utils.NewHandlerError(http.StatusInternalServerError,
@@ -344,7 +936,8 @@ func (cp *CoreProxy) serveHijack(w http.ResponseWriter, targetConn net.Conn) err
 			if err != nil {
 				return utils.NewHandlerError(http.StatusBadGateway, err)
 			}
-			_, _ = targetConn.Write(rbuf)
+			n, _ := targetConn.Write(rbuf)
+			pr.upstream.Add(int64(n))
 
 		}
 	}
@@ -371,10 +964,64 @@ func (cp *CoreProxy) serveHijack(w http.ResponseWriter, targetConn net.Conn) err
 			fmt.Errorf("failed to send response to client: %v", err))
 	}
 
-	return ioutils.DualStream(targetConn, clientConn, clientConn)
+	return cp.streamTunnel(targetConn, clientConn, clientConn, pr)
 }
 
-func (cp *CoreProxy) forwardRequest(w http.ResponseWriter, r *http.Request, dialer panpolicy.PANDialer) error {
+// streamTunnel streams data between the target and the client at the rate allowed by the
+// limiter of the request, if any, and records the bytes transferred in each direction.
+func (cp *CoreProxy) streamTunnel(targetConn net.Conn, clientReader io.Reader, clientWriter io.Writer, pr *proxiedRequest) error {
+	log := cp.logger.With(zap.String("remote-address", targetConn.RemoteAddr().String()))
+	opts := cp.tunnelTimeouts
+	opts.Limiter = pr.limiter
+	res := ioutils.DualStream(targetConn, clientReader, clientWriter, opts)
+	pr.upstream.Add(res.Upstream)
+	pr.downstream.Add(res.Downstream)
+	log = log.With(zap.Int64("bytes-upstream", res.Upstream), zap.Int64("bytes-downstream", res.Downstream),
+		zap.Duration("duration", res.Duration()))
+	if err := res.Err(); err != nil {
+		log.Info("Tunnel failed.", zap.Error(err))
+		return err
+	}
+	if res.Timeout != nil {
+		log.Debug("Closed tunnel on timeout.", zap.Error(res.Timeout))
+		return nil
+	}
+	log.Debug("Closed tunnel.")
+	return nil
+}
+
+// http3Streamer returns the HTTP/3 stream of the response, if any. Wrapped response
+// writers are unwrapped like http.ResponseController does.
+func http3Streamer(w http.ResponseWriter) (http3.HTTPStreamer, bool) {
+	for {
+		switch t := w.(type) {
+		case http3.HTTPStreamer:
+			return t, true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// http3Stream is the stream of an HTTP/3 CONNECT request taken over from the server.
+type http3Stream struct {
+	http3.Stream
+}
+
+// CloseWrite ends the response, while the request can still be read.
+func (s http3Stream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+// Close closes both directions of the stream.
+func (s http3Stream) Close() error {
+	s.Stream.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+	return s.Stream.Close()
+}
+
+func (cp *CoreProxy) forwardRequest(w http.ResponseWriter, r *http.Request, pr *proxiedRequest) error {
 	// Scheme has to be appended to avoid `unsupported protocol scheme ""` error.
 	// `http://` is used, since this initial request itself is always HTTP, regardless of what client and server
 	// may speak afterwards.
@@ -411,18 +1058,32 @@ func (cp *CoreProxy) forwardRequest(w http.ResponseWriter, r *http.Request, dial
 		}
 		r.Body, _ = r.GetBody()
 	}
+	if r.Body != nil {
+		// the body is read by the transport, possibly after the response was received
+		var body io.Reader = countingReader{r.Body, &pr.upstream}
+		if pr.limiter != nil {
+			body = ioutils.NewLimitedReader(r.Context(), body, pr.limiter)
+		}
+		r.Body = readCloser{body, r.Body}
+	}
 
 	// is the same as http.DefaultTransport but not as the Roundtripper type so we can set the Dialer
 	transport := shttp.DefaultTransport.Clone()
-	transport.DialContext = dialer.DialContext
+	transport.DialContext = pr.dialer.DialContext
 
 	resp, err := transport.RoundTrip(r)
 	if err != nil {
-		return utils.NewHandlerError(http.StatusBadGateway, fmt.Errorf("failed to read response: %v", err))
+		return dialError(http.StatusBadGateway, fmt.Errorf("failed to read response: %w", err))
 	}
 	defer resp.Body.Close()
 
-	if err := forwardResponse(w, resp); err != nil {
+	// the header is announced to clients reaching the host over TCP/IP, see strictscion
+	cp.strictSCION.Observe(r.URL.Host, resp.Header.Get(strictscion.HeaderName))
+
+	pr.status = resp.StatusCode
+	n, err := forwardResponse(r.Context(), w, resp, pr.limiter)
+	pr.downstream.Store(n)
+	if err != nil {
 		return utils.NewHandlerError(http.StatusInternalServerError, err)
 	}
 	return nil
@@ -439,8 +1100,9 @@ func removeForwardProxyCookie(r *http.Request) {
 	}
 }
 
-// Removes hop-by-hop headers, and writes response into ResponseWriter.
-func forwardResponse(w http.ResponseWriter, response *http.Response) error {
+// Removes hop-by-hop headers, and writes response into ResponseWriter at the rate allowed
+// by the limiter, if any. It returns the number of bytes of the body written.
+func forwardResponse(ctx context.Context, w http.ResponseWriter, response *http.Response, limiter ioutils.Limiter) (int64, error) {
 	w.Header().Del("Server") // remove Server: Caddy, append via instead
 	w.Header().Add("Via", strconv.Itoa(response.ProtoMajor)+"."+strconv.Itoa(response.ProtoMinor)+" caddy")
 
@@ -454,9 +1116,28 @@ func forwardResponse(w http.ResponseWriter, response *http.Response) error {
 	buf := *bufPtr
 	buf = buf[0:cap(buf)]
 	defer bufferPool.Put(bufPtr)
-	_, err := io.CopyBuffer(w, response.Body, buf)
+	var body io.Reader = response.Body
+	if limiter != nil {
+		body = ioutils.NewLimitedReader(ctx, body, limiter)
+	}
+	return io.CopyBuffer(w, body, buf)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// countingReader adds the number of bytes read to n.
+type countingReader struct {
+	io.Reader
+	n *atomic.Int64
+}
 
-	return err
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n.Add(int64(n))
+	return n, err
 }
 
 // https://github.com/golang/go/blob/go1.21.6/src/net/http/httputil/reverseproxy.go#L281-L287
@@ -18,22 +18,40 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"net/url"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 	"golang.org/x/net/http2"
 
+	"github.com/scionproto-contrib/http-proxy/advertiser"
 	"github.com/scionproto-contrib/http-proxy/forward"
+	"github.com/scionproto-contrib/http-proxy/forward/accesslog"
+	"github.com/scionproto-contrib/http-proxy/forward/acl"
+	"github.com/scionproto-contrib/http-proxy/forward/auth"
+	"github.com/scionproto-contrib/http-proxy/forward/hostsfile"
+	"github.com/scionproto-contrib/http-proxy/forward/pac"
+	"github.com/scionproto-contrib/http-proxy/forward/panpolicy"
+	"github.com/scionproto-contrib/http-proxy/forward/ratelimit"
+	"github.com/scionproto-contrib/http-proxy/forward/resolver"
+	"github.com/scionproto-contrib/http-proxy/forward/session"
+	"github.com/scionproto-contrib/http-proxy/forward/strictscion"
 	"github.com/scionproto-contrib/http-proxy/forward/utils"
 )
 
@@ -179,6 +197,43 @@ func TestConnectAuthNoPolicy(t *testing.T) {
 	}
 }
 
+func TestConnectTargetCloses(t *testing.T) {
+	// the target greets and closes the connection without waiting for the client
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("hello"))
+		conn.Close()
+	}()
+
+	proxyConn, err := dial(secureForwardProxy.addr, "HTTP/2.0", true)
+	require.NoError(t, err)
+	defer proxyConn.Close()
+	clientConn, err := (&http2.Transport{}).NewClientConn(proxyConn)
+	require.NoError(t, err)
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, err := http.NewRequest(http.MethodConnect, "https://"+target.Addr().String(), pr)
+	require.NoError(t, err)
+	req.Host = target.Addr().String()
+	req.Header.Set("Proxy-Authorization", credentialsCorrectNoPolicy)
+	resp, err := clientConn.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the end of the target ends the stream instead of resetting it
+	greeting, err := io.ReadAll(resp.Body)
+	require.NoError(t, err, "tunnel not ended with io.EOF")
+	assert.Equal(t, "hello", string(greeting))
+}
+
 func TestConnectAuthPolicyInvalid(t *testing.T) {
 	const useTLS = true
 	for _, httpProxyVer := range testHTTPProxyVersions {
@@ -221,6 +276,338 @@ func TestAPIGetPath(t *testing.T) {
 	// test
 }
 
+func TestAPISharedPathUsage(t *testing.T) {
+	cases := map[string]struct {
+		server       *testServer
+		token        string
+		expectedCode int
+	}{
+		"valid token":    {server: &secureForwardProxy, token: testAdminToken, expectedCode: http.StatusOK},
+		"invalid token":  {server: &secureForwardProxy, token: "guess", expectedCode: http.StatusUnauthorized},
+		"missing token":  {server: &secureForwardProxy, expectedCode: http.StatusUnauthorized},
+		"no admin token": {server: &insecureForwardProxy, token: testAdminToken, expectedCode: http.StatusForbidden},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://"+c.server.addr+apiSharedPathUsage, nil)
+			require.NoError(t, err)
+			if c.token != "" {
+				req.Header.Set("Authorization", "Bearer "+c.token)
+			}
+
+			tp := &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return dial(c.server.addr, "HTTP/1.1", c.server.tls)
+				},
+			}
+			response, err := tp.RoundTrip(req)
+			require.NoError(t, err)
+			defer response.Body.Close()
+			assert.Equal(t, c.expectedCode, response.StatusCode)
+			if c.expectedCode != http.StatusOK {
+				return
+			}
+
+			var metrics panpolicy.AggregateMetrics
+			require.NoError(t, json.NewDecoder(response.Body).Decode(&metrics))
+			assert.NotNil(t, metrics.Destinations, "destinations missing")
+		})
+	}
+}
+
+func TestAPIPrometheusMetrics(t *testing.T) {
+	// proxy a request, such that it is reported
+	response, err := getViaProxy(insecureTestTarget.addr, "/", secureForwardProxy.addr, "HTTP/1.1", credentialsCorrectNoPolicy, true)
+	require.NoError(t, err)
+	require.NoError(t, responseExpected(response, responseOK, insecureTestTarget.contents["/"]))
+
+	cases := map[string]struct {
+		token        string
+		expectedCode int
+	}{
+		"valid token":   {token: testAdminToken, expectedCode: http.StatusOK},
+		"missing token": {expectedCode: http.StatusUnauthorized},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://"+secureForwardProxy.addr+apiMetrics, nil)
+			require.NoError(t, err)
+			if c.token != "" {
+				req.Header.Set("Authorization", "Bearer "+c.token)
+			}
+
+			tp := &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return dial(secureForwardProxy.addr, "HTTP/1.1", true)
+				},
+			}
+			response, err := tp.RoundTrip(req)
+			require.NoError(t, err)
+			defer response.Body.Close()
+			assert.Equal(t, c.expectedCode, response.StatusCode)
+			if c.expectedCode != http.StatusOK {
+				return
+			}
+
+			body, err := io.ReadAll(response.Body)
+			require.NoError(t, err)
+			assert.Contains(t, string(body), `scion_forward_proxy_requests_total{kind="forward",outcome="success",transport="ip"}`)
+			assert.Contains(t, string(body), "scion_forward_proxy_open_connections")
+		})
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	testAccessLog.Records()
+
+	response, err := getViaProxy(insecureTestTarget.addr, "/image.png", secureForwardProxy.addr, "HTTP/1.1", credentialsCorrectNoPolicy, true)
+	require.NoError(t, err)
+	require.NoError(t, responseExpected(response, responseOK, insecureTestTarget.contents["/image.png"]))
+
+	// the tunnel is logged once it is closed
+	conn, err := dial(secureForwardProxy.addr, "HTTP/1.1", true)
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(conn, "CONNECT %[1]s HTTP/1.1\r\nHost: %[1]s\r\nProxy-Authorization: %[2]s\r\n\r\n"+
+		"GET / HTTP/1.1\r\nHost: %[1]s\r\nConnection: close\r\n\r\n", insecureTestTarget.addr, credentialsCorrectNoPolicy)
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	response, err = http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	response, err = http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	require.NoError(t, responseExpected(response, responseOK, insecureTestTarget.contents["/"]))
+	require.NoError(t, conn.Close())
+	response, err = getViaProxy(insecureTestTarget.addr, "/", secureForwardProxy.addr, "HTTP/1.1", credentialsIncorrect, true)
+	require.NoError(t, err)
+	require.NoError(t, responseExpected(response, statusCodeProxyAuthReq, responseProxyAuthRequired))
+
+	// records are written once the handler returned, possibly after the response was received
+	var records []accesslog.Record
+	require.Eventually(t, func() bool {
+		records = append(records, testAccessLog.Records()...)
+		return len(records) == 3
+	}, 5*time.Second, 10*time.Millisecond, "records missing")
+
+	byMethod := make(map[string]accesslog.Record)
+	for _, r := range records {
+		if r.Status == http.StatusProxyAuthRequired {
+			byMethod["refused"] = r
+			continue
+		}
+		byMethod[r.Method] = r
+	}
+
+	get := byMethod[http.MethodGet]
+	assert.Equal(t, insecureTestTarget.addr, get.Host)
+	assert.Equal(t, http.StatusOK, get.Status)
+	assert.Equal(t, "ip", get.Transport)
+	assert.Equal(t, int64(len(insecureTestTarget.contents["/image.png"])), get.BytesDownstream)
+	assert.NotEmpty(t, get.SessionID, "session missing")
+
+	connect := byMethod[http.MethodConnect]
+	assert.Equal(t, insecureTestTarget.addr, connect.Host)
+	assert.Equal(t, http.StatusOK, connect.Status)
+	assert.Equal(t, "ip", connect.Transport)
+	assert.Positive(t, connect.BytesUpstream, "request not counted")
+	assert.Greater(t, connect.BytesDownstream, int64(len(insecureTestTarget.contents["/"])), "response not counted")
+
+	refused := byMethod["refused"]
+	assert.Equal(t, "none", refused.Transport)
+	assert.Zero(t, refused.BytesDownstream)
+}
+
+func TestAuthenticator(t *testing.T) {
+	cp := forward.NewCoreProxy(zap.NewNop(), 10*time.Second, 10*time.Second, 10*time.Second, 10*time.Second, false)
+	cp.SetHostsFile(hostsfile.Config{Disabled: true})
+	cp.SetSessionStore(session.NewCookieStore(zap.NewNop(), session.GenerateRandomKeys()...))
+	bearer, err := auth.NewBearerTokens(map[string]string{"token-of-alice": "alice"}, "proxy")
+	require.NoError(t, err)
+	htpasswdPath := filepath.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, os.WriteFile(htpasswdPath, []byte("bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0o600)) // bob:secret
+	htpasswd, err := auth.LoadHtpasswd(htpasswdPath, "proxy")
+	require.NoError(t, err)
+	cp.SetAuthenticator(auth.Chain{bearer, htpasswd})
+	cp.SetAccessControl(nil)
+	require.NoError(t, cp.Initialize())
+	defer func() {
+		require.NoError(t, cp.Cleanup())
+	}()
+
+	basic := func(user, password string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	}
+
+	// the errors do not tell clients why they failed, e.g., whether the user exists
+	cases := map[string]struct {
+		credentials  []string
+		expectedCode int
+		expectedErr  error
+	}{
+		"token":               {credentials: []string{"Bearer token-of-alice"}, expectedCode: http.StatusOK},
+		"token and policy":    {credentials: []string{credentialsCorrectPolicyInvalid, "Bearer token-of-alice"}, expectedCode: http.StatusOK},
+		"password":            {credentials: []string{basic("bob", "secret")}, expectedCode: http.StatusOK},
+		"invalid token":       {credentials: []string{"Bearer guess"}, expectedCode: http.StatusProxyAuthRequired, expectedErr: auth.ErrInvalidCredentials},
+		"wrong password":      {credentials: []string{basic("bob", "guess")}, expectedCode: http.StatusProxyAuthRequired, expectedErr: auth.ErrInvalidCredentials},
+		"unknown user":        {credentials: []string{basic("mallory", "secret")}, expectedCode: http.StatusProxyAuthRequired, expectedErr: auth.ErrInvalidCredentials},
+		"policy carrier only": {credentials: []string{credentialsCorrectNoPolicy}, expectedCode: http.StatusProxyAuthRequired, expectedErr: auth.ErrNoCredentials},
+		"no credentials":      {expectedCode: http.StatusProxyAuthRequired, expectedErr: auth.ErrNoCredentials},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://"+insecureTestTarget.addr+"/", nil)
+			for _, credentials := range c.credentials {
+				r.Header.Add("Proxy-Authorization", credentials)
+			}
+			w := httptest.NewRecorder()
+
+			err := cp.HandleTunnelRequest(w, r)
+			if c.expectedCode != http.StatusOK {
+				var handlerErr *utils.HandlerError
+				require.ErrorAs(t, err, &handlerErr)
+				assert.Equal(t, c.expectedCode, handlerErr.StatusCode)
+				assert.Equal(t, c.expectedErr, handlerErr.Err)
+				assert.Equal(t, `Bearer realm="proxy"`, w.Header().Get("Proxy-Authenticate"))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, insecureTestTarget.contents["/"], w.Body.Bytes())
+		})
+	}
+}
+
+func TestBandwidthLimitPerClient(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 3000)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(body)
+	}))
+	defer origin.Close()
+
+	cp := forward.NewCoreProxy(zap.NewNop(), 10*time.Second, 10*time.Second, 10*time.Second, 10*time.Second, false)
+	cp.SetHostsFile(hostsfile.Config{Disabled: true})
+	cp.SetSessionStore(session.NewCookieStore(zap.NewNop(), session.GenerateRandomKeys()...))
+	cp.SetAccessControl(nil)
+	// the bucket of a client holds the body once
+	cp.SetBandwidthLimits(ratelimit.Config{PerSession: ratelimit.Limit{BytesPerSecond: len(body)}})
+	require.NoError(t, cp.Initialize())
+	defer func() {
+		require.NoError(t, cp.Cleanup())
+	}()
+
+	// the requests without cookie get a new session each, but share the bucket of the client
+	var elapsed time.Duration
+	for range 2 {
+		r := httptest.NewRequest(http.MethodGet, origin.URL+"/", nil)
+		r.Header.Set("Proxy-Authorization", credentialsCorrectNoPolicy)
+		w := httptest.NewRecorder()
+		start := time.Now()
+		require.NoError(t, cp.HandleTunnelRequest(w, r))
+		elapsed = time.Since(start)
+		assert.Equal(t, body, w.Body.Bytes())
+	}
+	assert.GreaterOrEqual(t, elapsed, 500*time.Millisecond, "second request not limited by the bucket of the first")
+}
+
+func TestStrictSCION(t *testing.T) {
+	// the origin announces Strict-SCION to the clients reaching it over TCP/IP
+	advertiser := advertiser.NewAdvertiser(zap.NewNop(), "max-age=3600")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, advertiser.ServeHTTP(w, r))
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	// the origin has no SCION address, it is reached over TCP/IP
+	cp, err := forward.NewCoreProxyWithConfig(forward.DefaultConfig(),
+		forward.WithResolver(staticResolver{}),
+		forward.WithSessionStore(session.NewCookieStore(zap.NewNop(), session.GenerateRandomKeys()...)),
+	)
+	require.NoError(t, err)
+	cp.SetHostsFile(hostsfile.Config{Disabled: true})
+	cp.SetAccessControl(nil)
+	require.NoError(t, cp.Initialize())
+	defer func() {
+		require.NoError(t, cp.Cleanup())
+	}()
+
+	r := httptest.NewRequest(http.MethodGet, origin.URL+"/", nil)
+	r.Header.Set("Proxy-Authorization", credentialsCorrectNoPolicy)
+	w := httptest.NewRecorder()
+	require.NoError(t, cp.HandleTunnelRequest(w, r))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello", w.Body.String())
+	assert.Equal(t, "max-age=3600", w.Header().Get(strictscion.HeaderName))
+
+	// once announced, the host is no longer reached over TCP/IP
+	r = httptest.NewRequest(http.MethodGet, origin.URL+"/", nil)
+	r.Header.Set("Proxy-Authorization", credentialsCorrectNoPolicy)
+	var handlerErr *utils.HandlerError
+	require.ErrorAs(t, cp.HandleTunnelRequest(httptest.NewRecorder(), r), &handlerErr)
+	assert.Equal(t, http.StatusForbidden, handlerErr.StatusCode)
+	assert.ErrorContains(t, handlerErr, "Strict-SCION")
+}
+
+func TestAccessControl(t *testing.T) {
+	newProxy := func(list *acl.List) *forward.CoreProxy {
+		cp := forward.NewCoreProxy(zap.NewNop(), 10*time.Second, 10*time.Second, 10*time.Second, 10*time.Second, false)
+		cp.SetHostsFile(hostsfile.Config{Disabled: true})
+		cp.SetSessionStore(session.NewCookieStore(zap.NewNop(), session.GenerateRandomKeys()...))
+		if list != nil {
+			cp.SetAccessControl(list)
+		}
+		require.NoError(t, cp.Initialize())
+		t.Cleanup(func() {
+			require.NoError(t, cp.Cleanup())
+		})
+		return cp
+	}
+	defaultProxy := newProxy(nil)
+	loopbackProxy := newProxy(&acl.List{
+		Rules: []acl.Rule{
+			{Action: acl.Deny, Methods: []string{http.MethodPost}, Reason: "read-only"},
+			{Action: acl.Allow, Networks: []netip.Prefix{netip.MustParsePrefix("127.0.42.0/24")}},
+		},
+		Default: acl.Deny,
+	})
+
+	cases := map[string]struct {
+		proxy          *forward.CoreProxy
+		method         string
+		target         string
+		expectedCode   int
+		expectedReason string
+	}{
+		"default private":  {proxy: defaultProxy, method: http.MethodGet, target: "http://" + insecureTestTarget.addr + "/", expectedCode: http.StatusForbidden, expectedReason: "private network"},
+		"default port":     {proxy: defaultProxy, method: http.MethodConnect, target: "example.org:22", expectedCode: http.StatusForbidden, expectedReason: "port 443"},
+		"allowed network":  {proxy: loopbackProxy, method: http.MethodGet, target: "http://" + insecureTestTarget.addr + "/", expectedCode: http.StatusOK},
+		"denied method":    {proxy: loopbackProxy, method: http.MethodPost, target: "http://" + insecureTestTarget.addr + "/", expectedCode: http.StatusForbidden, expectedReason: "read-only"},
+		"not allowed host": {proxy: loopbackProxy, method: http.MethodGet, target: "http://127.0.0.1:1/", expectedCode: http.StatusForbidden, expectedReason: "not allowed"},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(c.method, c.target, nil)
+			r.Header.Set("Proxy-Authorization", credentialsCorrectNoPolicy)
+			w := httptest.NewRecorder()
+
+			err := c.proxy.HandleTunnelRequest(w, r)
+			if c.expectedCode != http.StatusOK {
+				var handlerErr *utils.HandlerError
+				require.ErrorAs(t, err, &handlerErr)
+				assert.Equal(t, c.expectedCode, handlerErr.StatusCode)
+				assert.Contains(t, handlerErr.Error(), c.expectedReason)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+	}
+}
+
 func TestAPIResolveHost(t *testing.T) {
 	// test
 }
@@ -439,6 +826,98 @@ type testServer struct {
 	proxy    *forward.CoreProxy
 }
 
+// staticResolver resolves the hosts in its map to their SCION addresses.
+type staticResolver map[string]pan.UDPAddr
+
+func (s staticResolver) Resolve(_ context.Context, hostPort string) (pan.UDPAddr, error) {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = hostPort
+	}
+	return s[host], nil
+}
+
+func (s staticResolver) ResolveAndVerify(ctx context.Context, host string) (pan.UDPAddr, resolver.VerifyResult, error) {
+	addr, err := s.Resolve(ctx, host)
+	return addr, resolver.VerifyResult{}, err
+}
+
+// pacDialerManager hands out dialers whose connections appear to be established over
+// SCION if requested, such that the hosts dialed are learned for the proxy auto-config file.
+type pacDialerManager struct {
+	testDialerManager
+}
+
+func (m *pacDialerManager) GetDialer(_ session.SessionData, useScion bool) (panpolicy.PANDialer, error) {
+	return &pacDialer{scion: useScion}, nil
+}
+
+type pacDialer struct {
+	panpolicy.PANDialer
+	scion bool
+}
+
+func (d *pacDialer) DialContext(context.Context, string, string) (net.Conn, error) {
+	conn, peer := net.Pipe()
+	peer.Close()
+	if d.scion {
+		return &pacConn{Conn: conn}, nil
+	}
+	return conn, nil
+}
+
+type pacConn struct {
+	net.Conn
+}
+
+func (c *pacConn) RemoteAddr() net.Addr {
+	return pan.MustParseUDPAddr("64-2:0:9,129.132.121.164:443")
+}
+
+func TestPAC(t *testing.T) {
+	scionAddr := pan.MustParseUDPAddr("64-2:0:9,129.132.121.164:443")
+	cp, err := forward.NewCoreProxyWithConfig(forward.DefaultConfig(),
+		forward.WithResolver(staticResolver{"ethz.ch": scionAddr, "netsec.ethz.ch": scionAddr}),
+		forward.WithDialerManager(&pacDialerManager{}),
+		forward.WithSessionStore(session.NewCookieStore(zap.NewNop(), session.GenerateRandomKeys()...)),
+	)
+	require.NoError(t, err)
+	cp.SetHostsFile(hostsfile.Config{Disabled: true})
+	// hosts are only learned once they are allowed and dialed over SCION
+	cp.SetAccessControl(&acl.List{
+		Rules:   []acl.Rule{{Action: acl.Deny, Hosts: []string{"netsec.ethz.ch"}}},
+		Default: acl.Allow,
+	})
+	cp.SetPACConfig(pac.Config{Hosts: []string{"*.scionlab.org"}})
+	require.NoError(t, cp.Initialize())
+	defer func() {
+		require.NoError(t, cp.Cleanup())
+	}()
+
+	for _, target := range []string{"ethz.ch:443", "netsec.ethz.ch:443", "example.org:443"} {
+		r := httptest.NewRequest(http.MethodConnect, target, nil)
+		r.Header.Set("Proxy-Authorization", credentialsCorrectNoPolicy)
+		// the recorder cannot be hijacked, the tunnels fail once dialed
+		assert.Error(t, cp.HandleTunnelRequest(httptest.NewRecorder(), r))
+	}
+
+	w := httptest.NewRecorder()
+	require.NoError(t, cp.HandlePAC(w, httptest.NewRequest(http.MethodGet, "http://forward-proxy.scion:8080/proxy.pac", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, pac.ContentType, w.Header().Get("Content-Type"))
+	file := w.Body.String()
+	assert.Contains(t, file, `"PROXY forward-proxy.scion:8080"`)
+	assert.Contains(t, file, `{"ethz.ch":true}`)
+	assert.Contains(t, file, `["*.scionlab.org"]`)
+	assert.NotContains(t, file, "netsec.ethz.ch", "denied host learned")
+	assert.NotContains(t, file, "example.org", "host dialed over TCP/IP learned")
+
+	w = httptest.NewRecorder()
+	var handlerErr *utils.HandlerError
+	require.ErrorAs(t, cp.HandlePAC(w, httptest.NewRequest(http.MethodPost, "/proxy.pac", nil)), &handlerErr)
+	assert.Equal(t, http.StatusMethodNotAllowed, handlerErr.StatusCode)
+}
+
 var (
 	secureForwardProxy   testServer
 	insecureForwardProxy testServer
@@ -447,13 +926,48 @@ var (
 )
 
 const (
-	apiPathPrefix  = ""
-	apiPolicyPath  = apiPathPrefix + "/policy"
-	apiPathUsage   = apiPathPrefix + "/path-usage"
-	apiResolveURL  = apiPathPrefix + "/redirect"
-	apiResolveHost = apiPathPrefix + "/resolve"
+	apiPathPrefix      = ""
+	apiPolicyPath      = apiPathPrefix + "/policy"
+	apiPathUsage       = apiPathPrefix + "/path-usage"
+	apiSharedPathUsage = apiPathPrefix + "/admin/path-usage"
+	apiMetrics         = apiPathPrefix + "/admin/metrics"
+	apiResolveURL      = apiPathPrefix + "/redirect"
+	apiResolveHost     = apiPathPrefix + "/resolve"
 )
 
+const testAdminToken = "admin-secret"
+
+// testAccessLog is the access log of the secure forward proxy.
+var testAccessLog syncBuffer
+
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+// Records returns the records logged since the last call.
+func (b *syncBuffer) Records() []accesslog.Record {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var records []accesslog.Record
+	dec := json.NewDecoder(&b.buf)
+	for {
+		// the fields but the durations match the JSON keys
+		var r accesslog.Record
+		if err := dec.Decode(&r); err != nil {
+			break
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
 func (s *testServer) interceptConnect(connect, next http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		if req.Method == http.MethodConnect || req.Host != s.addr {
@@ -478,6 +992,18 @@ func (s *testServer) start() {
 			http.Error(w, err.Error(), returnCode)
 		}
 	})
+	mux.HandleFunc(apiSharedPathUsage, func(w http.ResponseWriter, r *http.Request) {
+		if err := s.proxy.HandleSharedPathUsage(w, r); err != nil {
+			returnCode, err := unwrapError(err)
+			http.Error(w, err.Error(), returnCode)
+		}
+	})
+	mux.HandleFunc(apiMetrics, func(w http.ResponseWriter, r *http.Request) {
+		if err := s.proxy.HandlePrometheusMetrics(w, r); err != nil {
+			returnCode, err := unwrapError(err)
+			http.Error(w, err.Error(), returnCode)
+		}
+	})
 	mux.HandleFunc(apiResolveURL, func(w http.ResponseWriter, r *http.Request) {
 		if err := s.proxy.HandleResolveURL(w, r); err != nil {
 			returnCode, err := unwrapError(err)
@@ -567,7 +1093,18 @@ func TestMain(m *testing.M) {
 		root: "./test/target",
 	}
 
-	// Initialize proxies
+	// Initialize proxies, leaving the hosts file of the machine running the tests alone
+	// and allowing the test targets on loopback addresses
+	secureForwardProxy.proxy.SetHostsFile(hostsfile.Config{Disabled: true})
+	insecureForwardProxy.proxy.SetHostsFile(hostsfile.Config{Disabled: true})
+	secureForwardProxy.proxy.SetAccessControl(nil)
+	insecureForwardProxy.proxy.SetAccessControl(nil)
+	secureForwardProxy.proxy.SetAdminToken(testAdminToken)
+	accessLog, err := accesslog.New(&testAccessLog, accesslog.FormatJSON)
+	if err != nil {
+		log.Fatal(err)
+	}
+	secureForwardProxy.proxy.SetAccessLog(accessLog)
 	if err := secureForwardProxy.proxy.Initialize(); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,252 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hostsfile adds the host name of the proxy to the hosts file, such that clients
+// can reach the proxy's API by name, and removes it again on shutdown.
+package hostsfile
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultPath     = "/etc/hosts"
+	DefaultHostName = "forward-proxy.scion"
+
+	comment = "# Line added by the SCION HTTP Forward Proxy"
+	// maxAttempts is the number of times an update is retried if the file was modified concurrently.
+	maxAttempts = 3
+)
+
+// DefaultAddress is the address the host name resolves to if none is configured.
+var DefaultAddress = netip.MustParseAddr("127.0.0.1")
+
+// Config configures the entries of the proxy in the hosts file, unset fields take the defaults.
+type Config struct {
+	// Disabled leaves the hosts file untouched.
+	Disabled bool
+	// Path is the hosts file, /etc/hosts by default.
+	Path string
+	// HostName is the name of the proxy, forward-proxy.scion by default.
+	HostName string
+	// Addresses are the IPv4 and IPv6 addresses of the proxy, 127.0.0.1 by default.
+	Addresses []netip.Addr
+}
+
+// Manager adds and removes the entries of the proxy. Updates are serialized with other
+// instances by locking the file, and written to a temporary file which replaces the hosts file,
+// such that readers never see a partial file. If the file was modified in the meantime by a tool
+// that does not lock it, the update is retried.
+type Manager struct {
+	logger *zap.Logger
+	config Config
+}
+
+func New(logger *zap.Logger, config Config) (*Manager, error) {
+	if config.Path == "" {
+		config.Path = DefaultPath
+	}
+	if config.HostName == "" {
+		config.HostName = DefaultHostName
+	}
+	if len(config.Addresses) == 0 {
+		config.Addresses = []netip.Addr{DefaultAddress}
+	}
+	if strings.ContainsAny(config.HostName, " \t\n#") {
+		return nil, fmt.Errorf("invalid host name %q", config.HostName)
+	}
+	for _, addr := range config.Addresses {
+		if !addr.IsValid() {
+			return nil, errors.New("invalid address for the hosts file")
+		}
+	}
+	return &Manager{logger: logger, config: config}, nil
+}
+
+// Entries returns the lines added to the hosts file, one per address.
+func (m *Manager) Entries() []string {
+	entries := make([]string, 0, len(m.config.Addresses))
+	for _, addr := range m.config.Addresses {
+		entries = append(entries, addr.Unmap().String()+"\t"+m.config.HostName+"\t"+comment)
+	}
+	return entries
+}
+
+// Add adds the entries, unless the host name is already present in an entry that is not ours,
+// e.g., configured manually.
+func (m *Manager) Add() error {
+	if m.config.Disabled {
+		return nil
+	}
+	return m.update(func(lines []string) ([]string, bool) {
+		kept := m.withoutOwn(lines)
+		for _, line := range kept {
+			if hasHostName(line, m.config.HostName) {
+				m.logger.Debug("Entry for host name already exists", zap.String("entry", line))
+				return nil, false
+			}
+		}
+		if len(kept) > 0 && kept[len(kept)-1] == "" {
+			kept = kept[:len(kept)-1]
+		}
+		updated := append(append(kept, m.Entries()...), "")
+		return updated, !slices.Equal(updated, lines)
+	})
+}
+
+// Remove removes the entries added by Add, as well as the entries added by previous versions.
+func (m *Manager) Remove() error {
+	if m.config.Disabled {
+		return nil
+	}
+	return m.update(func(lines []string) ([]string, bool) {
+		kept := m.withoutOwn(lines)
+		return kept, len(kept) != len(lines)
+	})
+}
+
+// withoutOwn returns the lines not added by the proxy. Previous versions added the comment
+// on a separate line preceding the entry.
+func (m *Manager) withoutOwn(lines []string) []string {
+	var kept []string
+	for i := 0; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if trimmed == comment {
+			if i+1 < len(lines) && hasHostName(lines[i+1], m.config.HostName) {
+				i++
+			}
+			continue
+		}
+		if entry, c, ok := strings.Cut(trimmed, "#"); ok && "#"+c == comment && hasHostName(entry, m.config.HostName) {
+			continue
+		}
+		kept = append(kept, lines[i])
+	}
+	return kept
+}
+
+// hasHostName returns whether a line that is not commented out maps the host name.
+func hasHostName(line, hostName string) bool {
+	entry, _, _ := strings.Cut(line, "#")
+	fields := strings.Fields(entry)
+	if len(fields) < 2 {
+		return false
+	}
+	for _, name := range fields[1:] {
+		if strings.EqualFold(name, hostName) {
+			return true
+		}
+	}
+	return false
+}
+
+// update applies edit to the lines of the hosts file and writes the result if edit reports
+// a change.
+func (m *Manager) update(edit func(lines []string) ([]string, bool)) error {
+	unlock, err := lockFile(m.config.Path)
+	if err != nil {
+		return fmt.Errorf("failed to lock hosts file: %w", err)
+	}
+	defer unlock()
+
+	for attempt := 1; ; attempt++ {
+		info, err := os.Stat(m.config.Path)
+		if err != nil {
+			return fmt.Errorf("failed to read hosts file: %w", err)
+		}
+		content, err := os.ReadFile(m.config.Path)
+		if err != nil {
+			return fmt.Errorf("failed to read hosts file: %w", err)
+		}
+		lines, changed := edit(strings.Split(string(content), "\n"))
+		if !changed {
+			return nil
+		}
+		err = m.replace(info, []byte(strings.Join(lines, "\n")))
+		if errors.Is(err, errModified) && attempt < maxAttempts {
+			m.logger.Debug("Hosts file modified concurrently, retrying.", zap.Int("attempt", attempt))
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write hosts file: %w", err)
+		}
+		m.logger.Info("Updated hosts file", zap.String("path", m.config.Path), zap.Strings("entries", m.Entries()))
+		return nil
+	}
+}
+
+var errModified = errors.New("hosts file modified concurrently")
+
+// replace atomically replaces the hosts file with content, unless it was modified since it was
+// read, as described by read. If the file cannot be replaced, e.g., because it is bind-mounted
+// into a container or the directory is not writable, it is rewritten in place.
+func (m *Manager) replace(read os.FileInfo, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(m.config.Path), "."+filepath.Base(m.config.Path)+".*")
+	if err != nil {
+		m.logger.Debug("Cannot replace hosts file, rewriting it in place.", zap.Error(err))
+		return m.rewrite(read, content)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Chmod(read.Mode().Perm())
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := checkUnmodified(m.config.Path, read); err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), m.config.Path)
+	if errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EXDEV) {
+		m.logger.Debug("Cannot replace hosts file, rewriting it in place.", zap.Error(err))
+		return m.rewrite(read, content)
+	}
+	return err
+}
+
+func (m *Manager) rewrite(read os.FileInfo, content []byte) error {
+	if err := checkUnmodified(m.config.Path, read); err != nil {
+		return err
+	}
+	return os.WriteFile(m.config.Path, content, read.Mode().Perm())
+}
+
+func checkUnmodified(path string, read os.FileInfo) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(info, read) || !info.ModTime().Equal(read.ModTime()) || info.Size() != read.Size() {
+		return errModified
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package hostsfile
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const baseHosts = "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost\n"
+
+func TestAddRemove(t *testing.T) {
+	cases := map[string]struct {
+		config        Config
+		initial       string
+		expectedAdded string
+		expectedFinal string
+	}{
+		"default": {
+			initial:       baseHosts,
+			expectedAdded: baseHosts + "127.0.0.1\tforward-proxy.scion\t" + comment + "\n",
+			expectedFinal: baseHosts,
+		},
+		"ipv6 and custom name": {
+			config:  Config{HostName: "proxy.example", Addresses: []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("fd00::1")}},
+			initial: baseHosts,
+			expectedAdded: baseHosts + "10.0.0.1\tproxy.example\t" + comment + "\n" +
+				"fd00::1\tproxy.example\t" + comment + "\n",
+			expectedFinal: baseHosts,
+		},
+		"existing manual entry": {
+			initial:       baseHosts + "10.0.0.2 forward-proxy.scion\n",
+			expectedAdded: baseHosts + "10.0.0.2 forward-proxy.scion\n",
+			expectedFinal: baseHosts + "10.0.0.2 forward-proxy.scion\n",
+		},
+		"commented out entry": {
+			initial:       baseHosts + "# 10.0.0.2 forward-proxy.scion\n",
+			expectedAdded: baseHosts + "# 10.0.0.2 forward-proxy.scion\n127.0.0.1\tforward-proxy.scion\t" + comment + "\n",
+			expectedFinal: baseHosts + "# 10.0.0.2 forward-proxy.scion\n",
+		},
+		"entry of previous version": {
+			initial:       baseHosts + " " + comment + "\n127.0.0.1\tforward-proxy.scion\n",
+			expectedAdded: baseHosts + "127.0.0.1\tforward-proxy.scion\t" + comment + "\n",
+			expectedFinal: baseHosts,
+		},
+		"disabled": {
+			config:        Config{Disabled: true},
+			initial:       baseHosts,
+			expectedAdded: baseHosts,
+			expectedFinal: baseHosts,
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			c.config.Path = filepath.Join(t.TempDir(), "hosts")
+			require.NoError(t, os.WriteFile(c.config.Path, []byte(c.initial), 0o644))
+			m, err := New(zap.NewNop(), c.config)
+			require.NoError(t, err)
+
+			require.NoError(t, m.Add())
+			assertContent(t, c.config.Path, c.expectedAdded)
+			require.NoError(t, m.Add(), "adding twice")
+			assertContent(t, c.config.Path, c.expectedAdded)
+
+			require.NoError(t, m.Remove())
+			assertContent(t, c.config.Path, c.expectedFinal)
+
+			info, err := os.Stat(c.config.Path)
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0o644), info.Mode().Perm(), "mode not preserved")
+			entries, err := os.ReadDir(filepath.Dir(c.config.Path))
+			require.NoError(t, err)
+			assert.Len(t, entries, 1, "temporary file left behind")
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(zap.NewNop(), Config{HostName: "forward proxy"})
+	assert.Error(t, err, "host name with space accepted")
+	_, err = New(zap.NewNop(), Config{Addresses: []netip.Addr{{}}})
+	assert.Error(t, err, "invalid address accepted")
+}
+
+func TestReplaceModified(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(path, []byte(baseHosts), 0o644))
+	m, err := New(zap.NewNop(), Config{Path: path})
+	require.NoError(t, err)
+
+	read, err := os.Stat(path)
+	require.NoError(t, err)
+	// modified by another tool after it was read
+	require.NoError(t, os.WriteFile(path, []byte(baseHosts+"10.0.0.3\tother\n"), 0o644))
+
+	assert.ErrorIs(t, m.replace(read, []byte("clobbered")), errModified)
+	assertContent(t, path, baseHosts+"10.0.0.3\tother\n")
+}
+
+func assertContent(t *testing.T, path, expected string) {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(content))
+}
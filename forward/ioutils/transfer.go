@@ -15,9 +15,13 @@
 package ioutils
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var bufferPool = sync.Pool{
@@ -27,27 +31,296 @@ var bufferPool = sync.Pool{
 	},
 }
 
-// Copies data target->clientReader and clientWriter->target, and flushes as needed
-// Returns when clientWriter-> target stream is done.
-// Caddy should finish writing target -> clientReader.
-func DualStream(targetConn io.ReadWriter, clientReader io.Reader, clientWriter io.Writer) error {
-	go stream(clientReader, targetConn) //nolint: errcheck
-	return stream(targetConn, clientWriter)
+var (
+	// ErrIdleTimeout ends a stream without data copied in either direction for the idle timeout.
+	ErrIdleTimeout = errors.New("stream idle timeout")
+	// ErrMaxLifetime ends a stream that lasted for its maximum lifetime.
+	ErrMaxLifetime = errors.New("stream maximum lifetime exceeded")
+)
+
+// Options are the timeouts of a DualStream, zero disables a timeout.
+type Options struct {
+	// IdleTimeout ends the stream if no data was copied in either direction for its duration.
+	IdleTimeout time.Duration
+	// MaxLifetime ends the stream once it lasted for its duration, regardless of activity.
+	MaxLifetime time.Duration
+	// Limiter limits the rate of the bytes copied in both directions together, if set.
+	Limiter Limiter
+}
+
+// Limiter limits the rate of copied bytes, e.g., a golang.org/x/time/rate.Limiter.
+type Limiter interface {
+	// WaitN blocks until n bytes may be copied, n is at most Burst.
+	WaitN(ctx context.Context, n int) error
+	// Burst is the maximum number of bytes copied at once.
+	Burst() int
+}
+
+// NewLimitedReader returns a reader that reads from r at the rate allowed by the limiter
+// until the context is done.
+func NewLimitedReader(ctx context.Context, r io.Reader, limiter Limiter) io.Reader {
+	return &limitedReader{Reader: r, ctx: ctx, limiter: limiter}
+}
+
+type limitedReader struct {
+	io.Reader
+	ctx     context.Context
+	limiter Limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if burst := r.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		if werr := r.limiter.WaitN(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Result is the outcome of a DualStream.
+type Result struct {
+	// Upstream is the number of bytes copied from the client to the target.
+	Upstream int64
+	// Downstream is the number of bytes copied from the target to the client.
+	Downstream int64
+	// UpstreamErr is the error of the copy from the client to the target, if any.
+	UpstreamErr error
+	// DownstreamErr is the error of the copy from the target to the client, if any.
+	DownstreamErr error
+	// Timeout is ErrIdleTimeout or ErrMaxLifetime if the stream was ended by a timeout.
+	Timeout error
+	Start   time.Time
+	End     time.Time
+}
+
+// Err returns the errors of both directions joined, nil if the stream ended cleanly.
+// Streams ended by a timeout are not considered failed, see Timeout.
+func (r Result) Err() error {
+	return errors.Join(r.DownstreamErr, r.UpstreamErr)
+}
+
+// Duration returns how long the stream lasted.
+func (r Result) Duration() time.Duration {
+	return r.End.Sub(r.Start)
+}
+
+// Copies data target->clientWriter and clientReader->target, and flushes as needed.
+// Once a direction reaches the end of its input, the end is propagated by half-closing
+// its destination (see closeWriter), while the other direction keeps going. DualStream
+// returns once both directions are done, reporting the bytes copied and the errors of both.
+//
+// If clientWriter cannot be half-closed, e.g., an HTTP/2 response, whose end is only sent
+// once the handler returns, the stream ends with the target->clientWriter direction: the
+// clientReader->target direction is stopped by closing (or expiring the read deadline of)
+// clientReader only, such that the response still ends cleanly. The stream is torn down by
+// closing (or expiring the deadlines of) all ends if either direction fails, or on timeout.
+func DualStream(targetConn io.ReadWriter, clientReader io.Reader, clientWriter io.Writer, opts Options) Result {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &dualStream{ends: []any{targetConn, clientReader, clientWriter}, limiter: opts.Limiter, ctx: ctx, cancel: cancel}
+	s.touch()
+	res := Result{Start: time.Now()}
+
+	upstreamDone, downstreamDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(upstreamDone)
+		res.Upstream, res.UpstreamErr = s.copy(targetConn, clientReader)
+	}()
+	go func() {
+		defer close(downstreamDone)
+		res.Downstream, res.DownstreamErr = s.copy(clientWriter, targetConn)
+		if _, ok := clientWriter.(closeWriter); !ok {
+			s.stopReading(clientReader)
+		}
+	}()
+	done := make(chan struct{})
+	go func() {
+		<-upstreamDone
+		<-downstreamDone
+		close(done)
+	}()
+
+	s.watch(done, opts)
+	res.Timeout = s.abortReason()
+	res.End = time.Now()
+	return res
+}
+
+// dualStream is the state shared by both directions of a DualStream.
+type dualStream struct {
+	ends         []any
+	lastActivity atomic.Int64
+	limiter      Limiter
+	// ctx is cancelled once the stream is torn down, to stop waiting for the limiter
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex   sync.Mutex
+	aborted bool
+	reason  error
+	// stopped is set once the client side is no longer read, see stopReading
+	stopped bool
+}
+
+func (s *dualStream) touch() {
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (s *dualStream) idleFor() time.Duration {
+	return time.Since(time.Unix(0, s.lastActivity.Load()))
+}
+
+// copy copies src to dst and tears down the stream if the copy fails. Failures caused by
+// tearing down the stream are not reported.
+func (s *dualStream) copy(dst io.Writer, src io.Reader) (int64, error) {
+	src = &activityReader{Reader: src, stream: s}
+	if s.limiter != nil {
+		src = NewLimitedReader(s.ctx, src, s.limiter)
+	}
+	n, err := stream(src, dst)
+	if err == nil {
+		return n, nil
+	}
+	if s.isInterrupted() {
+		return n, nil
+	}
+	s.abort(nil)
+	return n, err
+}
+
+// watch enforces the timeouts until done is closed.
+func (s *dualStream) watch(done <-chan struct{}, opts Options) {
+	var lifetime, idle <-chan time.Time
+	if opts.MaxLifetime > 0 {
+		lifetimeTimer := time.NewTimer(opts.MaxLifetime)
+		defer lifetimeTimer.Stop()
+		lifetime = lifetimeTimer.C
+	}
+	var idleTimer *time.Timer
+	if opts.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(opts.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-lifetime:
+			s.abort(ErrMaxLifetime)
+			lifetime, idle = nil, nil
+		case <-idle:
+			if idleFor := s.idleFor(); idleFor < opts.IdleTimeout {
+				idleTimer.Reset(opts.IdleTimeout - idleFor)
+				continue
+			}
+			s.abort(ErrIdleTimeout)
+			lifetime, idle = nil, nil
+		}
+	}
+}
+
+// abort tears down the stream by expiring the deadlines of all ends and closing them.
+// The reason is reported as Result.Timeout, nil if the stream ended otherwise.
+func (s *dualStream) abort(reason error) {
+	s.mutex.Lock()
+	if s.aborted {
+		s.mutex.Unlock()
+		return
+	}
+	s.aborted = true
+	s.reason = reason
+	s.mutex.Unlock()
+	s.cancel()
+
+	now := time.Now()
+	for _, end := range s.ends {
+		switch e := end.(type) {
+		case deadliner:
+			_ = e.SetDeadline(now)
+		case http.ResponseWriter:
+			_ = http.NewResponseController(e).SetWriteDeadline(now)
+		}
+		if c, ok := end.(io.Closer); ok {
+			_ = c.Close()
+		}
+	}
+}
+
+// stopReading stops the clientReader->target direction once the client cannot be sent
+// the end of the target, by closing (or expiring the read deadline of) clientReader.
+// Unlike abort, the other ends are left intact.
+func (s *dualStream) stopReading(clientReader io.Reader) {
+	s.mutex.Lock()
+	if s.aborted || s.stopped {
+		s.mutex.Unlock()
+		return
+	}
+	s.stopped = true
+	s.mutex.Unlock()
+
+	switch r := clientReader.(type) {
+	case readDeadliner:
+		_ = r.SetReadDeadline(time.Now())
+	case io.Closer:
+		_ = r.Close()
+	}
+}
+
+// isInterrupted returns whether the stream was aborted or stopped reading, such that
+// failures of the copies are expected.
+func (s *dualStream) isInterrupted() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.aborted || s.stopped
+}
+
+func (s *dualStream) abortReason() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.reason
+}
+
+// activityReader records the time data was last read, see Options.IdleTimeout.
+type activityReader struct {
+	io.Reader
+	stream *dualStream
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.stream.touch()
+	}
+	return n, err
+}
+
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
 }
 
-func stream(r io.Reader, w io.Writer) error {
+func stream(r io.Reader, w io.Writer) (int64, error) {
 	// copy bytes from r to w
 	bufPtr := bufferPool.Get().(*[]byte)
 	buf := *bufPtr
 	buf = buf[0:cap(buf)]
 	defer bufferPool.Put(bufPtr)
 
-	_, _err := flushingIoCopy(w, r, buf)
+	written, _err := flushingIoCopy(w, r, buf)
 
 	if cw, ok := w.(closeWriter); ok {
 		_ = cw.CloseWrite()
 	}
-	return _err
+	return written, _err
 }
 
 type closeWriter interface {
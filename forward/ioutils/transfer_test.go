@@ -16,23 +16,42 @@ package ioutils
 
 import (
 	"bytes"
-	"fmt"
+	"context"
+	"errors"
+	"io"
+	"net"
 	"net/http"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
 )
 
+// target is a stream target with separate buffers for the data read from and written to it.
+type target struct {
+	*bytes.Reader
+	written *bytes.Buffer
+}
+
+func newTarget(content []byte) *target {
+	return &target{Reader: bytes.NewReader(content), written: new(bytes.Buffer)}
+}
+
+func (t *target) Write(p []byte) (int, error) {
+	return t.written.Write(p)
+}
+
 func TestStream(t *testing.T) {
 	rb := new(bytes.Buffer)
 	wb := new(bytes.Buffer)
 
 	rb.WriteString("hello, world.")
 
-	err := stream(rb, wb)
+	n, err := stream(rb, wb)
 	require.NoError(t, err)
+	assert.Equal(t, int64(13), n, "stream reported wrong number of bytes")
 	assert.Equal(t, "hello, world.", wb.String(), "stream did not work properly")
 }
 
@@ -40,79 +59,234 @@ func TestDualStream(t *testing.T) {
 	rbA := new(bytes.Buffer)
 	wbA := new(bytes.Buffer)
 
-	rwbB := new(bytes.Buffer)
-
 	rbA.WriteString("hello, Bob.")
-	rwbB.WriteString("hello, Alice.")
+	rwbB := newTarget([]byte("hello, Alice."))
 
-	err := DualStream(rwbB, rbA, wbA)
-	require.NoError(t, err)
-	time.Sleep(1 * time.Second) // streaming from A to B is async
+	res := DualStream(rwbB, rbA, wbA, Options{})
+	require.NoError(t, res.Err())
 
 	assert.Equal(t, "hello, Alice.", wbA.String(), "Dual stream to A did not work properly")
-	assert.Equal(t, "hello, Bob.", rwbB.String(), "Dual stream to B did not work properly")
+	assert.Equal(t, "hello, Bob.", rwbB.written.String(), "Dual stream to B did not work properly")
+	assert.Equal(t, int64(11), res.Upstream, "wrong number of upstream bytes")
+	assert.Equal(t, int64(13), res.Downstream, "wrong number of downstream bytes")
+	assert.False(t, res.End.Before(res.Start), "stream ended before it started")
 }
+
 func TestDualStream_EmptyInput(t *testing.T) {
 	rbA := new(bytes.Buffer)
 	wbA := new(bytes.Buffer)
 
-	rwbB := new(bytes.Buffer)
+	rwbB := newTarget(nil)
 
-	err := DualStream(rwbB, rbA, wbA)
-	require.NoError(t, err)
-	time.Sleep(1 * time.Second) // streaming from A to B is async
+	res := DualStream(rwbB, rbA, wbA, Options{})
+	require.NoError(t, res.Err())
 
 	assert.Empty(t, wbA.String(), "Dual stream to A should be empty")
-	assert.Empty(t, rwbB.String(), "Dual stream to B should be empty")
+	assert.Empty(t, rwbB.written.String(), "Dual stream to B should be empty")
+	assert.Zero(t, res.Upstream)
+	assert.Zero(t, res.Downstream)
 }
 
 func TestDualStream_LargerInput(t *testing.T) {
 	rbA := new(bytes.Buffer)
 	wbA := new(bytes.Buffer)
 
-	rwbB := new(bytes.Buffer)
-
-	largeStringAlice := make([]byte, 32*1024) // 1MB of data
+	largeStringAlice := make([]byte, 32*1024)
 	for i := range largeStringAlice {
 		largeStringAlice[i] = 'a'
 	}
-	largeStringBob := make([]byte, 256*1024) // 1MB of data
+	largeStringBob := make([]byte, 256*1024)
 	for i := range largeStringBob {
 		largeStringBob[i] = 'b'
 	}
 
 	rbA.Write(largeStringBob)
-	rwbB.Write(largeStringAlice)
+	rwbB := newTarget(largeStringAlice)
 
-	err := DualStream(rwbB, rbA, wbA)
-	require.NoError(t, err)
-	time.Sleep(5 * time.Second) // streaming from A to B is async, being a bit linient here with the sleep
-
-	fmt.Println("A:", wbA.Len())
-	fmt.Println("B:", rwbB.Len())
+	res := DualStream(rwbB, rbA, wbA, Options{})
+	require.NoError(t, res.Err())
 
 	assert.Equal(t, string(largeStringAlice), wbA.String(), "Dual stream to A did not work properly with large input")
-	assert.Equal(t, string(largeStringBob), rwbB.String(), "Dual stream to B did not work properly with large input")
+	assert.Equal(t, string(largeStringBob), rwbB.written.String(), "Dual stream to B did not work properly with large input")
+	assert.Equal(t, int64(len(largeStringBob)), res.Upstream)
+	assert.Equal(t, int64(len(largeStringAlice)), res.Downstream)
 }
 
 func TestDualStream_WithResponseWriter(t *testing.T) {
 	rbA := new(bytes.Buffer)
 	wbA := new(bytes.Buffer)
 
-	rwbB := new(bytes.Buffer)
-
 	rbA.WriteString("hello, Bob.")
-	rwbB.WriteString("hello, Alice.")
+	rwbB := newTarget([]byte("hello, Alice."))
 
 	// Mock http.ResponseWriter
 	mockResponseWriter := &mockResponseWriter{Buffer: wbA}
 
-	err := DualStream(rwbB, rbA, mockResponseWriter)
-	require.NoError(t, err)
-	time.Sleep(1 * time.Second) // streaming from A to B is async
+	res := DualStream(rwbB, rbA, mockResponseWriter, Options{})
+	require.NoError(t, res.Err())
 
 	assert.Equal(t, "hello, Alice.", wbA.String(), "Dual stream to A did not work properly")
-	assert.Equal(t, "hello, Bob.", rwbB.String(), "Dual stream to B did not work properly")
+	assert.Equal(t, "hello, Bob.", rwbB.written.String(), "Dual stream to B did not work properly")
+}
+
+func TestDualStream_TargetFailure(t *testing.T) {
+	targetConn, targetPeer := net.Pipe()
+	clientConn, clientPeer := net.Pipe()
+	defer clientPeer.Close()
+
+	go func() {
+		_, _ = targetPeer.Write([]byte("partial"))
+		targetPeer.Close()
+	}()
+	go func() { _, _ = io.Copy(io.Discard, clientPeer) }()
+
+	// the client never finishes sending, the stream ends with the target anyway
+	res := DualStream(&failingConn{Conn: targetConn, failAfter: 7}, clientConn, clientConn, Options{})
+	assert.Error(t, res.DownstreamErr, "failure of the target was not reported")
+	assert.NoError(t, res.UpstreamErr, "interrupted client side reported as failure")
+	assert.Equal(t, int64(7), res.Downstream)
+}
+
+// tcpPair returns both ends of a TCP connection over the loopback interface.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	peer := <-accepted
+	require.NotNil(t, peer, "accepting failed")
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	return conn, peer
+}
+
+func TestDualStream_HalfClose(t *testing.T) {
+	targetConn, targetPeer := tcpPair(t)
+	clientConn, clientPeer := tcpPair(t)
+
+	// the target responds only once the client finished sending, like an upload
+	go func() {
+		request, _ := io.ReadAll(targetPeer)
+		_, _ = targetPeer.Write([]byte("got " + string(request)))
+		targetPeer.Close()
+	}()
+	received := make(chan string, 1)
+	go func() {
+		_, _ = clientPeer.Write([]byte("upload"))
+		_ = clientPeer.(*net.TCPConn).CloseWrite()
+		response, _ := io.ReadAll(clientPeer)
+		received <- string(response)
+	}()
+
+	res := DualStream(targetConn, clientConn, clientConn, Options{IdleTimeout: 5 * time.Second})
+	require.NoError(t, res.Err())
+	assert.NoError(t, res.Timeout)
+	assert.Equal(t, "got upload", <-received, "end of client not propagated to target")
+	assert.Equal(t, int64(6), res.Upstream)
+	assert.Equal(t, int64(10), res.Downstream)
+}
+
+func TestDualStream_Timeouts(t *testing.T) {
+	cases := map[string]struct {
+		opts            Options
+		activeClient    bool
+		expectedTimeout error
+	}{
+		"idle timeout": {
+			opts:            Options{IdleTimeout: 50 * time.Millisecond},
+			expectedTimeout: ErrIdleTimeout,
+		},
+		"max lifetime": {
+			opts:            Options{IdleTimeout: 50 * time.Millisecond, MaxLifetime: 200 * time.Millisecond},
+			activeClient:    true,
+			expectedTimeout: ErrMaxLifetime,
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			targetConn, targetPeer := tcpPair(t)
+			clientConn, clientPeer := tcpPair(t)
+			go func() { _, _ = io.Copy(io.Discard, targetPeer) }()
+			go func() { _, _ = io.Copy(io.Discard, clientPeer) }()
+			if c.activeClient {
+				go func() {
+					for {
+						if _, err := clientPeer.Write([]byte("keep-alive")); err != nil {
+							return
+						}
+						time.Sleep(10 * time.Millisecond)
+					}
+				}()
+			}
+
+			res := DualStream(targetConn, clientConn, clientConn, c.opts)
+			assert.NoError(t, res.Err(), "stream ended by timeout reported as failure")
+			assert.ErrorIs(t, res.Timeout, c.expectedTimeout)
+			if c.activeClient {
+				assert.Positive(t, res.Upstream)
+				assert.GreaterOrEqual(t, res.Duration(), c.opts.MaxLifetime)
+			}
+		})
+	}
+}
+
+func TestDualStream_RateLimit(t *testing.T) {
+	rbA := bytes.NewBuffer(make([]byte, 20*1024))
+	wbA := new(bytes.Buffer)
+	rwbB := newTarget(make([]byte, 20*1024))
+
+	// 40KiB in both directions together at 80KiB/s take about half a second
+	limiter := rate.NewLimiter(80*1024, 4*1024)
+	limiter.AllowN(time.Now(), 4*1024)
+
+	res := DualStream(rwbB, rbA, wbA, Options{Limiter: limiter})
+	require.NoError(t, res.Err())
+	assert.Equal(t, int64(20*1024), res.Upstream)
+	assert.Equal(t, int64(20*1024), res.Downstream)
+	assert.GreaterOrEqual(t, res.Duration(), 400*time.Millisecond, "rate limit not enforced")
+}
+
+func TestLimitedReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	limiter := rate.NewLimiter(1, 10)
+	r := NewLimitedReader(ctx, bytes.NewReader(make([]byte, 100)), limiter)
+
+	// reads are capped at the burst
+	b := make([]byte, 100)
+	n, err := r.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, 10, n)
+
+	// waiting for tokens stops with the context
+	cancel()
+	_, err = r.Read(b)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// failingConn fails reading once failAfter bytes were read.
+type failingConn struct {
+	net.Conn
+	failAfter int
+	read      int
+}
+
+func (c *failingConn) Read(p []byte) (int, error) {
+	if c.read >= c.failAfter {
+		return 0, errors.New("connection reset")
+	}
+	n, err := c.Conn.Read(p[:min(len(p), c.failAfter-c.read)])
+	c.read += n
+	return n, err
 }
 
 // mockResponseWriter is a mock implementation of http.ResponseWriter
@@ -0,0 +1,231 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics exports the operational metrics of the forward proxy to Prometheus,
+// e.g., to alert on a degradation of SCION connectivity.
+package metrics
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "scion_forward_proxy"
+
+// Request kinds
+const (
+	KindTunnel  = "tunnel"
+	KindForward = "forward"
+	KindSOCKS5  = "socks5"
+)
+
+// Transports
+const (
+	TransportSCION = "scion"
+	TransportIP    = "ip"
+	// TransportNone is recorded for requests refused before a transport was chosen.
+	TransportNone = "none"
+)
+
+// Request outcomes
+const (
+	OutcomeSuccess = "success"
+	// OutcomeRejected is a request refused by the proxy, e.g., due to missing authorization.
+	OutcomeRejected = "rejected"
+	// OutcomeUpstreamError is a request for which the destination could not be reached.
+	OutcomeUpstreamError = "upstream_error"
+	OutcomeError         = "error"
+)
+
+// Dial outcomes
+const (
+	DialSuccess = "success"
+	DialFailure = "failure"
+)
+
+// Resolve outcomes
+const (
+	// ResolveSCION is a host that resolved to a SCION address.
+	ResolveSCION = "scion"
+	// ResolveNone is a host without SCION address, reached over TCP/IP.
+	ResolveNone = "none"
+	// ResolveTimeout is a host whose resolution timed out.
+	ResolveTimeout = "timeout"
+)
+
+// Transfer directions
+const (
+	// DirectionUpstream is from the client to the destination.
+	DirectionUpstream = "upstream"
+	// DirectionDownstream is from the destination to the client.
+	DirectionDownstream = "downstream"
+)
+
+var _ prometheus.Collector = (*Collector)(nil)
+
+// DialerStats provides the state of the dialers that is collected on each scrape.
+type DialerStats interface {
+	// OpenConnections returns the number of open connections tracked by the dialers.
+	OpenConnections() int
+	// PurgeStats returns the number of purge runs and the total number of dialers purged.
+	PurgeStats() (runs, purged uint64)
+}
+
+// Collector collects the metrics of the forward proxy. The request, dial, resolve and
+// transfer metrics are recorded by the proxy as they happen, the state of the dialers
+// is read from DialerStats whenever the collector is scraped.
+type Collector struct {
+	requests        *prometheus.CounterVec
+	dialDuration    *prometheus.HistogramVec
+	resolveDuration *prometheus.HistogramVec
+	transferred     *prometheus.CounterVec
+
+	openConnections *prometheus.Desc
+	purgeRuns       *prometheus.Desc
+	purgedDialers   *prometheus.Desc
+
+	stats DialerStats
+}
+
+// NewCollector creates a collector reporting the stats of the dialers, if not nil.
+func NewCollector(stats DialerStats) *Collector {
+	return &Collector{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Number of proxied requests by kind (tunnel or forward), transport and outcome.",
+		}, []string{"kind", "transport", "outcome"}),
+		dialDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "dial_duration_seconds",
+			Help:      "Latency of dials to destinations by transport and outcome.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+		}, []string{"transport", "outcome"}),
+		resolveDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "resolve_duration_seconds",
+			Help:      "Latency of SCION address resolutions by outcome.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+		}, []string{"outcome"}),
+		transferred: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tunnel_transferred_bytes_total",
+			Help:      "Bytes transferred through tunnels by direction and transport.",
+		}, []string{"direction", "transport"}),
+		openConnections: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "open_connections"),
+			"Number of open SCION connections tracked by the dialers.", nil, nil),
+		purgeRuns: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "dialer_purge_runs_total"),
+			"Number of runs purging inactive dialers.", nil, nil),
+		purgedDialers: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "purged_dialers_total"),
+			"Number of inactive dialers purged.", nil, nil),
+		stats: stats,
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.requests.Describe(ch)
+	c.dialDuration.Describe(ch)
+	c.resolveDuration.Describe(ch)
+	c.transferred.Describe(ch)
+	ch <- c.openConnections
+	ch <- c.purgeRuns
+	ch <- c.purgedDialers
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.requests.Collect(ch)
+	c.dialDuration.Collect(ch)
+	c.resolveDuration.Collect(ch)
+	c.transferred.Collect(ch)
+
+	if c.stats == nil {
+		return
+	}
+	runs, purged := c.stats.PurgeStats()
+	ch <- prometheus.MustNewConstMetric(c.openConnections, prometheus.GaugeValue, float64(c.stats.OpenConnections()))
+	ch <- prometheus.MustNewConstMetric(c.purgeRuns, prometheus.CounterValue, float64(runs))
+	ch <- prometheus.MustNewConstMetric(c.purgedDialers, prometheus.CounterValue, float64(purged))
+}
+
+// ObserveRequest records a proxied request.
+func (c *Collector) ObserveRequest(kind, transport, outcome string) {
+	c.requests.WithLabelValues(kind, transport, outcome).Inc()
+}
+
+// ObserveDial records a dial that took d over transport and failed with err, if not nil.
+func (c *Collector) ObserveDial(transport string, d time.Duration, err error) {
+	outcome := DialSuccess
+	if err != nil {
+		outcome = DialFailure
+	}
+	c.dialDuration.WithLabelValues(transport, outcome).Observe(d.Seconds())
+}
+
+// ObserveResolve records a resolution that took d.
+func (c *Collector) ObserveResolve(outcome string, d time.Duration) {
+	c.resolveDuration.WithLabelValues(outcome).Observe(d.Seconds())
+}
+
+// CountTransferred wraps the connection to the destination of a tunnel, such that the bytes
+// written to and read from it are counted as upstream and downstream bytes respectively.
+// The counters are updated as the data flows, i.e., also for long-lived tunnels.
+func (c *Collector) CountTransferred(conn net.Conn, transport string) net.Conn {
+	return &countingConn{
+		Conn:       conn,
+		upstream:   c.transferred.WithLabelValues(DirectionUpstream, transport),
+		downstream: c.transferred.WithLabelValues(DirectionDownstream, transport),
+	}
+}
+
+// TransportOf returns the transport the connection was established over.
+func TransportOf(conn net.Conn) string {
+	if _, ok := conn.RemoteAddr().(pan.UDPAddr); ok {
+		return TransportSCION
+	}
+	return TransportIP
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+type countingConn struct {
+	net.Conn
+	upstream   prometheus.Counter
+	downstream prometheus.Counter
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.downstream.Add(float64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.upstream.Add(float64(n))
+	return n, err
+}
+
+// CloseWrite half-closes the connection if supported, see ioutils.DualStream.
+func (c *countingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,89 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type staticStats struct {
+	open         int
+	runs, purged uint64
+}
+
+func (s staticStats) OpenConnections() int              { return s.open }
+func (s staticStats) PurgeStats() (runs, purged uint64) { return s.runs, s.purged }
+
+func TestCollector(t *testing.T) {
+	c := NewCollector(staticStats{open: 3, runs: 5, purged: 2})
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(c))
+
+	c.ObserveRequest(KindTunnel, TransportSCION, OutcomeSuccess)
+	c.ObserveRequest(KindTunnel, TransportSCION, OutcomeSuccess)
+	c.ObserveRequest(KindForward, TransportIP, OutcomeUpstreamError)
+	c.ObserveDial(TransportSCION, 20*time.Millisecond, nil)
+	c.ObserveDial(TransportSCION, time.Second, errors.New("no path"))
+	c.ObserveResolve(ResolveSCION, 5*time.Millisecond)
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(c.requests.WithLabelValues(KindTunnel, TransportSCION, OutcomeSuccess)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(c.requests.WithLabelValues(KindForward, TransportIP, OutcomeUpstreamError)))
+	assert.Equal(t, 2, testutil.CollectAndCount(c, namespace+"_dial_duration_seconds"))
+	assert.Equal(t, 1, testutil.CollectAndCount(c, namespace+"_resolve_duration_seconds"))
+
+	expected := `
+# HELP scion_forward_proxy_open_connections Number of open SCION connections tracked by the dialers.
+# TYPE scion_forward_proxy_open_connections gauge
+scion_forward_proxy_open_connections 3
+# HELP scion_forward_proxy_dialer_purge_runs_total Number of runs purging inactive dialers.
+# TYPE scion_forward_proxy_dialer_purge_runs_total counter
+scion_forward_proxy_dialer_purge_runs_total 5
+# HELP scion_forward_proxy_purged_dialers_total Number of inactive dialers purged.
+# TYPE scion_forward_proxy_purged_dialers_total counter
+scion_forward_proxy_purged_dialers_total 2
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		namespace+"_open_connections", namespace+"_dialer_purge_runs_total", namespace+"_purged_dialers_total"))
+}
+
+func TestCountTransferred(t *testing.T) {
+	c := NewCollector(staticStats{})
+	client, target := net.Pipe()
+	defer target.Close()
+	conn := c.CountTransferred(client, TransportIP)
+	defer conn.Close()
+
+	go func() {
+		_, _ = io.ReadFull(target, make([]byte, 5))
+		_, _ = target.Write([]byte("world!"))
+	}()
+	_, err := conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 6))
+	require.NoError(t, err)
+
+	assert.Equal(t, 5.0, testutil.ToFloat64(c.transferred.WithLabelValues(DirectionUpstream, TransportIP)))
+	assert.Equal(t, 6.0, testutil.ToFloat64(c.transferred.WithLabelValues(DirectionDownstream, TransportIP)))
+	assert.Equal(t, TransportIP, TransportOf(conn))
+}
@@ -0,0 +1,161 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pac generates proxy auto-config files, which make browsers without the extension
+// use the proxy for the hosts known to be SCION-enabled and connect to all others directly.
+package pac
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ContentType = "application/x-ns-proxy-autoconfig"
+
+	// DefaultMaxAge is the time after which hosts learned from the requests are forgotten,
+	// unless they are reached over SCION again.
+	DefaultMaxAge = 24 * time.Hour
+	// DefaultMaxHosts is the number of hosts learned, the hosts expiring first are forgotten
+	// once it is exceeded.
+	DefaultMaxHosts = 10000
+)
+
+// Config is the configuration of the proxy auto-config file.
+type Config struct {
+	// Proxy is the address of the proxy in the file, e.g., forward-proxy.scion:8080. By
+	// default, the host the file is requested from.
+	Proxy string `json:"proxy,omitempty"`
+	// Hosts are SCION-enabled hosts or patterns of them, as in shExpMatch, e.g., *.ethz.ch,
+	// in addition to the hosts learned from the requests.
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+// Store remembers the hosts that were reached over SCION.
+type Store struct {
+	maxAge   time.Duration
+	maxHosts int
+
+	hostsMu sync.Mutex
+	hosts   map[string]time.Time // host -> expiry
+}
+
+func NewStore(maxAge time.Duration, maxHosts int) *Store {
+	return &Store{
+		maxAge:   maxAge,
+		maxHosts: maxHosts,
+		hosts:    make(map[string]time.Time),
+	}
+}
+
+// Observe records that host was reached over SCION.
+func (s *Store) Observe(host string) {
+	s.hostsMu.Lock()
+	defer s.hostsMu.Unlock()
+
+	host = normalize(host)
+	if _, ok := s.hosts[host]; !ok && len(s.hosts) >= s.maxHosts {
+		s.evict()
+	}
+	s.hosts[host] = time.Now().Add(s.maxAge)
+}
+
+// evict forgets the host expiring first.
+func (s *Store) evict() {
+	var first string
+	var firstExpiry time.Time
+	for host, expiry := range s.hosts {
+		if first == "" || expiry.Before(firstExpiry) {
+			first, firstExpiry = host, expiry
+		}
+	}
+	delete(s.hosts, first)
+}
+
+// Hosts returns the sorted hosts that have not expired.
+func (s *Store) Hosts() []string {
+	s.hostsMu.Lock()
+	defer s.hostsMu.Unlock()
+
+	now := time.Now()
+	hosts := make([]string, 0, len(s.hosts))
+	for host, expiry := range s.hosts {
+		if now.After(expiry) {
+			delete(s.hosts, host)
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	slices.Sort(hosts)
+	return hosts
+}
+
+// Write writes the proxy auto-config file returning the proxy directive, e.g.,
+// "PROXY forward-proxy.scion:8080", for the hosts and the hosts matching the patterns,
+// and DIRECT for all others.
+func Write(w io.Writer, directive string, hosts, patterns []string) error {
+	known := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		known[normalize(host)] = true
+	}
+	lowered := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		lowered = append(lowered, strings.ToLower(pattern))
+	}
+	// JSON is valid JavaScript, and escapes the strings
+	directiveJSON, err := json.Marshal(directive)
+	if err != nil {
+		return err
+	}
+	hostsJSON, err := json.Marshal(known)
+	if err != nil {
+		return err
+	}
+	patternsJSON, err := json.Marshal(lowered)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, `// Proxy auto-config of the SCION HTTP forward proxy, SCION-enabled hosts are reached through the proxy.
+var proxy = %s;
+var hosts = %s;
+var patterns = %s;
+
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	if (Object.prototype.hasOwnProperty.call(hosts, host)) {
+		return proxy;
+	}
+	for (var i = 0; i < patterns.length; i++) {
+		if (shExpMatch(host, patterns[i])) {
+			return proxy;
+		}
+	}
+	return "DIRECT";
+}
+`, directiveJSON, hostsJSON, patternsJSON)
+	return err
+}
+
+func normalize(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
@@ -0,0 +1,51 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package pac
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	s := NewStore(time.Hour, 2)
+	s.Observe("ethz.ch:443")
+	s.Observe("WWW.ScionLab.org.")
+	s.Observe("ethz.ch")
+	assert.Equal(t, []string{"ethz.ch", "www.scionlab.org"}, s.Hosts())
+
+	// the host expiring first is forgotten
+	s.Observe("netsec.ethz.ch")
+	assert.Equal(t, []string{"ethz.ch", "netsec.ethz.ch"}, s.Hosts())
+
+	expired := NewStore(-time.Second, DefaultMaxHosts)
+	expired.Observe("ethz.ch")
+	assert.Empty(t, expired.Hosts())
+}
+
+func TestWrite(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, Write(&b, "PROXY forward-proxy.scion:8080", []string{"ethz.ch"}, []string{"*.SCIONLab.org", `"quoted"`}))
+
+	file := b.String()
+	assert.Contains(t, file, `var proxy = "PROXY forward-proxy.scion:8080";`)
+	assert.Contains(t, file, `var hosts = {"ethz.ch":true};`)
+	assert.Contains(t, file, `var patterns = ["*.scionlab.org","\"quoted\""];`)
+	assert.Contains(t, file, "function FindProxyForURL(url, host)")
+	assert.Contains(t, file, `return "DIRECT";`)
+}
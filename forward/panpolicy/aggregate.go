@@ -0,0 +1,190 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panpolicy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
+	"go.uber.org/zap"
+
+	"github.com/scionproto-contrib/http-proxy/forward/session"
+	"github.com/scionproto-contrib/http-proxy/forward/utils"
+)
+
+// AggregateMetrics are the path metrics of a dialer aggregated per destination ISD-AS.
+// Unlike DialerMetrics, they contain neither host names nor anything tied to a session,
+// hence they can be reported for the shared dialer.
+type AggregateMetrics struct {
+	Destinations []DestinationMetrics
+}
+
+type DestinationMetrics struct {
+	// IA is the destination ISD-AS, 0-0 for destinations that could not be resolved.
+	IA              string
+	OpenConnections int
+	Dials           int
+	DialFailures    int
+	Paths           []PathUsage
+}
+
+// PathUsage is a path in use and the number of open connections using it.
+type PathUsage struct {
+	Hops        []string
+	Connections int
+}
+
+// dialStats counts the dials of a dialer per destination ISD-AS.
+type dialStats struct {
+	mutex sync.Mutex
+	perIA map[pan.IA]*iaDialStats
+}
+
+type iaDialStats struct {
+	dials    int
+	failures int
+}
+
+func newDialStats() *dialStats {
+	return &dialStats{perIA: make(map[pan.IA]*iaDialStats)}
+}
+
+func (s *dialStats) Record(ia pan.IA, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats, ok := s.perIA[ia]
+	if !ok {
+		stats = &iaDialStats{}
+		s.perIA[ia] = stats
+	}
+	stats.dials++
+	if err != nil {
+		stats.failures++
+	}
+}
+
+// AggregateMetrics returns the paths of the open connections and the dials of the
+// dialer aggregated per destination ISD-AS, sorted by ISD-AS.
+func (d *SCIONDialer) AggregateMetrics() *AggregateMetrics {
+	destinations := make(map[pan.IA]*DestinationMetrics)
+	destination := func(ia pan.IA) *DestinationMetrics {
+		dm, ok := destinations[ia]
+		if !ok {
+			dm = &DestinationMetrics{IA: ia.String()}
+			destinations[ia] = dm
+		}
+		return dm
+	}
+
+	d.dialStats.mutex.Lock()
+	for ia, stats := range d.dialStats.perIA {
+		dm := destination(ia)
+		dm.Dials = stats.dials
+		dm.DialFailures = stats.failures
+	}
+	d.dialStats.mutex.Unlock()
+
+	pathIndex := make(map[pan.IA]map[pan.PathFingerprint]int)
+	for addr, conns := range d.connectionTracker.GetAllConnections() {
+		for _, conn := range conns {
+			panConn, ok := conn.(pathAwareConn)
+			if !ok {
+				continue
+			}
+			path := panConn.GetPath()
+			ia := destinationIA(addr, panConn)
+			dm := destination(ia)
+			dm.OpenConnections++
+			if path == nil {
+				continue
+			}
+
+			if pathIndex[ia] == nil {
+				pathIndex[ia] = make(map[pan.PathFingerprint]int)
+			}
+			i, ok := pathIndex[ia][path.Fingerprint]
+			if !ok {
+				var local pan.IA
+				if addr, ok := panConn.LocalAddr().(pan.UDPAddr); ok {
+					local = addr.IA
+				}
+				i = len(dm.Paths)
+				pathIndex[ia][path.Fingerprint] = i
+				dm.Paths = append(dm.Paths, PathUsage{Hops: hopsToPathHops(&pathInfo{path, local})})
+			}
+			dm.Paths[i].Connections++
+		}
+	}
+
+	am := &AggregateMetrics{Destinations: make([]DestinationMetrics, 0, len(destinations))}
+	for _, dm := range destinations {
+		sort.SliceStable(dm.Paths, func(i, j int) bool { return dm.Paths[i].Connections > dm.Paths[j].Connections })
+		am.Destinations = append(am.Destinations, *dm)
+	}
+	sort.Slice(am.Destinations, func(i, j int) bool { return am.Destinations[i].IA < am.Destinations[j].IA })
+	return am
+}
+
+type aggregateReporter interface {
+	AggregateMetrics() *AggregateMetrics
+}
+
+// AggregateMetricsHandler reports the aggregate metrics of the shared dialer. Access
+// control is up to the caller, the endpoint is meant for operators only.
+type AggregateMetricsHandler struct {
+	policyManager DialerManager
+
+	logger *zap.Logger
+}
+
+func NewAggregateMetricsHandler(policyManager DialerManager, logger *zap.Logger) *AggregateMetricsHandler {
+	return &AggregateMetricsHandler{
+		policyManager: policyManager,
+		logger:        logger,
+	}
+}
+
+func (h *AggregateMetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return utils.NewHandlerError(http.StatusMethodNotAllowed, errors.New("HTTP GET allowed only"))
+	}
+
+	// a session without policy is served by the shared dialer
+	dialer, err := h.policyManager.GetDialer(session.SessionData{}, true)
+	if err != nil {
+		return utils.NewHandlerError(http.StatusInternalServerError, err)
+	}
+	reporter, ok := dialer.(aggregateReporter)
+	if !ok {
+		return utils.NewHandlerError(http.StatusInternalServerError, errors.New("shared dialer does not report aggregate metrics"))
+	}
+
+	j, err := json.Marshal(reporter.AggregateMetrics())
+	if err != nil {
+		return utils.NewHandlerError(http.StatusInternalServerError, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(j)
+	if err != nil {
+		return utils.NewHandlerError(http.StatusInternalServerError, err)
+	}
+	return nil
+}
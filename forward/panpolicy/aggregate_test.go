@@ -0,0 +1,116 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package panpolicy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/scionproto-contrib/http-proxy/forward/utils"
+)
+
+// pathDialer returns connections over the path configured for the address.
+type pathDialer struct {
+	checkDialer
+	paths map[string]*pan.Path
+}
+
+func (d *pathDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if addr == "unreachable.org:443" {
+		return nil, &dialError{ia: pan.MustParseIA("1-ff00:0:113"), err: errors.New("no path")}
+	}
+	path, ok := d.paths[addr]
+	if !ok {
+		return nil, errors.New("cannot resolve")
+	}
+	return &noopConn{ia: path.Source, path: path}, nil
+}
+
+func TestAggregateMetrics(t *testing.T) {
+	pathA := newSelectorTestPath("A", time.Millisecond, 10, "1-ff00:0:110", "1-ff00:0:111")
+	pathA.Source, pathA.Destination = pan.MustParseIA("1-ff00:0:110"), pan.MustParseIA("1-ff00:0:111")
+	pathB := newSelectorTestPath("B", time.Millisecond, 10, "1-ff00:0:110", "1-ff00:0:112", "1-ff00:0:111")
+	pathB.Source, pathB.Destination = pathA.Source, pathA.Destination
+
+	d := NewSCIONDialer(zap.NewNop(), 1*time.Second, true)
+	d.dialSCION = &pathDialer{paths: map[string]*pan.Path{
+		"www.example.org:443": pathA,
+		"cdn.example.org:443": pathA,
+		"api.example.org:443": pathB,
+	}}
+
+	for _, addr := range []string{"www.example.org:443", "cdn.example.org:443", "api.example.org:443", "1-ff00:0:112,[10.0.0.1]:443", "unknown.org:443", "unreachable.org:443"} {
+		_, _ = d.DialContext(context.Background(), "tcp", addr)
+	}
+
+	expected := &AggregateMetrics{Destinations: []DestinationMetrics{
+		{IA: "0-0", Dials: 1, DialFailures: 1},
+		{
+			IA:              "1-ff00:0:111",
+			OpenConnections: 3,
+			Dials:           3,
+			Paths: []PathUsage{
+				{Hops: []string{"1-ff00:0:110", "1-ff00:0:111"}, Connections: 2},
+				{Hops: []string{"1-ff00:0:110", "1-ff00:0:112", "1-ff00:0:111"}, Connections: 1},
+			},
+		},
+		{IA: "1-ff00:0:112", Dials: 1, DialFailures: 1},
+		{IA: "1-ff00:0:113", Dials: 1, DialFailures: 1},
+	}}
+	assert.Equal(t, expected, d.AggregateMetrics())
+
+	// no host names are reported
+	j, err := json.Marshal(d.AggregateMetrics())
+	require.NoError(t, err)
+	assert.NotContains(t, string(j), "example.org")
+}
+
+func TestAggregateMetricsHandler(t *testing.T) {
+	m := NewPolicyManager(zap.NewNop(), newTestSessionStore(), 1*time.Second, true, 0, 0)
+	h := NewAggregateMetricsHandler(m, zap.NewNop())
+
+	cases := map[string]struct {
+		method       string
+		expectedCode int
+	}{
+		"get":          {http.MethodGet, http.StatusOK},
+		"wrong method": {http.MethodPost, http.StatusMethodNotAllowed},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			err := h.ServeHTTP(w, httptest.NewRequest(c.method, "/admin/path-usage", nil))
+			if c.expectedCode != http.StatusOK {
+				var handlerErr *utils.HandlerError
+				require.ErrorAs(t, err, &handlerErr)
+				assert.Equal(t, c.expectedCode, handlerErr.StatusCode)
+				return
+			}
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"Destinations": []}`, w.Body.String())
+		})
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panpolicy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
+	"github.com/scionproto/scion/private/path/pathpol"
+)
+
+const policyDocumentVersion = 1
+
+type preference string
+
+const (
+	preferLatency   preference = "latency"
+	preferBandwidth preference = "bandwidth"
+	preferHops      preference = "hops"
+	preferMTU       preference = "mtu"
+)
+
+// policyDocument is the structured policy format. It combines an ACL, a geofence, a
+// sequence and an ordered list of preferences into a single policy, e.g.,
+//
+//	{
+//	  "version": 1,
+//	  "acl": ["- 2", "+"],
+//	  "geofence": {"allowCountries": ["CH", "DE"]},
+//	  "sequence": "1-ff00:0:110 0* 1-ff00:0:111",
+//	  "preferences": ["latency", "hops"],
+//	  "strategy": "bandwidth"
+//	}
+//
+// The sequence is either given in the path policy language or in the show paths format,
+// see parsePolicy. The first preference is the primary sort key, the following ones
+// break ties. The strategy selects the path of each connection among the resulting
+// paths at dial time and whenever the paths are refreshed, see qualitySelector.
+type policyDocument struct {
+	Version     int          `json:"version"`
+	ACL         []string     `json:"acl,omitempty"`
+	Geofence    *geofence    `json:"geofence,omitempty"`
+	Sequence    string       `json:"sequence,omitempty"`
+	Preferences []preference `json:"preferences,omitempty"`
+	Strategy    preference   `json:"strategy,omitempty"`
+}
+
+// PolicyFieldError is returned for an invalid structured policy, Field points at the
+// offending field, e.g., "acl[1]".
+type PolicyFieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *PolicyFieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Err)
+}
+
+func (e *PolicyFieldError) Unwrap() error {
+	return e.Err
+}
+
+func isPolicyDocument(b []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(b), []byte("{"))
+}
+
+// parsePolicyDocument parses a structured policy and compiles it into a pan.PolicyChain
+// applying the ACL, the geofence, the sequence and the preferences in this order.
+// The countries are used to resolve the countries of a geofence.
+func parsePolicyDocument(b []byte, countries CountryMapping) (pan.PolicyChain, error) {
+	var doc policyDocument
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&doc); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return nil, &PolicyFieldError{
+				Field: fieldPath(typeErr.Field),
+				Err:   fmt.Errorf("expected %s, got %s", typeErr.Type, typeErr.Value),
+			}
+		}
+		return nil, fmt.Errorf("invalid policy document: %w", err)
+	}
+	return doc.compile(countries)
+}
+
+// fieldPath converts the field path of a JSON error, e.g., "acl.1", to the
+// notation used by PolicyFieldError, e.g., "acl[1]".
+func fieldPath(jsonField string) string {
+	parts := strings.Split(jsonField, ".")
+	b := &strings.Builder{}
+	for i, part := range parts {
+		if _, err := strconv.Atoi(part); err == nil {
+			fmt.Fprintf(b, "[%s]", part)
+			continue
+		}
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(part)
+	}
+	return b.String()
+}
+
+func (doc *policyDocument) compile(countries CountryMapping) (pan.PolicyChain, error) {
+	if doc.Version != policyDocumentVersion {
+		return nil, &PolicyFieldError{
+			Field: "version",
+			Err:   fmt.Errorf("unsupported version %d, expected %d", doc.Version, policyDocumentVersion),
+		}
+	}
+	if len(doc.ACL) == 0 && doc.Geofence == nil && doc.Sequence == "" && len(doc.Preferences) == 0 && doc.Strategy == "" {
+		return nil, errors.New("policy document must contain at least one of acl, geofence, sequence, preferences or strategy")
+	}
+
+	var chain pan.PolicyChain
+
+	if len(doc.ACL) != 0 {
+		for i, entry := range doc.ACL {
+			if err := (&pathpol.ACLEntry{}).LoadFromString(entry); err != nil {
+				return nil, &PolicyFieldError{Field: fmt.Sprintf("acl[%d]", i), Err: err}
+			}
+		}
+		acl, err := pan.NewACL(doc.ACL)
+		if err != nil {
+			return nil, &PolicyFieldError{Field: "acl", Err: err}
+		}
+		chain = append(chain, &acl)
+	}
+
+	if doc.Geofence != nil {
+		fence, err := doc.Geofence.compile(countries)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, fence)
+	}
+
+	if doc.Sequence != "" {
+		seqStr := doc.Sequence
+		if strings.Contains(seqStr, ">") {
+			var err error
+			seqStr, err = parseShowPathToSeq(seqStr)
+			if err != nil {
+				return nil, &PolicyFieldError{Field: "sequence", Err: err}
+			}
+		}
+		sequence, err := pan.NewSequence(seqStr)
+		if err != nil {
+			return nil, &PolicyFieldError{Field: "sequence", Err: err}
+		}
+		chain = append(chain, sequence)
+	}
+
+	// the sort orders are stable, hence the primary preference is applied last
+	seen := make(map[preference]bool, len(doc.Preferences))
+	prefs := make(pan.PolicyChain, len(doc.Preferences))
+	for i, pref := range doc.Preferences {
+		field := fmt.Sprintf("preferences[%d]", i)
+		if seen[pref] {
+			return nil, &PolicyFieldError{Field: field, Err: fmt.Errorf("duplicate preference %q", pref)}
+		}
+		seen[pref] = true
+
+		p, err := pref.policy()
+		if err != nil {
+			return nil, &PolicyFieldError{Field: field, Err: err}
+		}
+		prefs[len(prefs)-1-i] = p
+	}
+	chain = append(chain, prefs...)
+
+	if doc.Strategy != "" {
+		if _, err := doc.Strategy.policy(); err != nil {
+			return nil, &PolicyFieldError{Field: "strategy", Err: err}
+		}
+	}
+
+	return chain, nil
+}
+
+// parseSelectionStrategy returns the selection strategy of a structured policy. Policies
+// in other formats and invalid documents have no strategy.
+func parseSelectionStrategy(b []byte) preference {
+	if !isPolicyDocument(b) {
+		return ""
+	}
+	var doc policyDocument
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return ""
+	}
+	return doc.Strategy
+}
+
+// newSelector returns a selector choosing the best path according to the preference.
+func (p preference) newSelector() (pan.Selector, error) {
+	order, err := p.policy()
+	if err != nil {
+		return nil, err
+	}
+	return newQualitySelector(order), nil
+}
+
+func (p preference) policy() (pan.Policy, error) {
+	switch p {
+	case preferLatency:
+		return pan.LowestLatency{}, nil
+	case preferBandwidth:
+		return pan.HighestBandwidth{}, nil
+	case preferHops:
+		return pan.LeastHops{}, nil
+	case preferMTU:
+		return pan.HighestMTU{}, nil
+	default:
+		return nil, fmt.Errorf("unknown preference %q, expected one of %q, %q, %q or %q",
+			p, preferLatency, preferBandwidth, preferHops, preferMTU)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package panpolicy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePolicyDocument(t *testing.T) {
+	acl, err := pan.NewACL([]string{"- 2", "+"})
+	require.NoError(t, err, "error creating expected ACL")
+	sequence, err := pan.NewSequence("42-1 #11 42-2 #20")
+	require.NoError(t, err, "error creating expected sequence")
+
+	cases := map[string]struct {
+		policy        string
+		expectedChain pan.PolicyChain
+		expectedErr   bool
+		expectedField string
+	}{
+		"ACL with preference": {
+			policy:        `{"version": 1, "acl": ["- 2", "+"], "preferences": ["latency"]}`,
+			expectedChain: pan.PolicyChain{&acl, pan.LowestLatency{}},
+		},
+		"sequence in show paths format": {
+			policy:        `{"version": 1, "sequence": "42-1 11>20 42-2"}`,
+			expectedChain: pan.PolicyChain{sequence},
+		},
+		"sequence in path policy language": {
+			policy:        `{"version": 1, "sequence": "42-1 #11 42-2 #20"}`,
+			expectedChain: pan.PolicyChain{sequence},
+		},
+		"preferences applied primary last": {
+			policy:        `{"version": 1, "preferences": ["latency", "bandwidth", "hops", "mtu"]}`,
+			expectedChain: pan.PolicyChain{pan.HighestMTU{}, pan.LeastHops{}, pan.HighestBandwidth{}, pan.LowestLatency{}},
+		},
+		"strategy only": {
+			policy:        `{"version": 1, "strategy": "latency"}`,
+			expectedChain: nil,
+		},
+		"unknown strategy": {
+			policy:        `{"version": 1, "strategy": "fastest"}`,
+			expectedErr:   true,
+			expectedField: "strategy",
+		},
+		"missing version": {
+			policy:        `{"acl": ["+"]}`,
+			expectedErr:   true,
+			expectedField: "version",
+		},
+		"empty document": {
+			policy:      `{"version": 1}`,
+			expectedErr: true,
+		},
+		"unknown field": {
+			policy:      `{"version": 1, "acls": ["+"]}`,
+			expectedErr: true,
+		},
+		"invalid ACL entry": {
+			policy:        `{"version": 1, "acl": ["- 2", "* 3", "+"]}`,
+			expectedErr:   true,
+			expectedField: "acl[1]",
+		},
+		"ACL without default": {
+			policy:        `{"version": 1, "acl": ["- 2"]}`,
+			expectedErr:   true,
+			expectedField: "acl",
+		},
+		"ACL entry of wrong type": {
+			policy:        `{"version": 1, "acl": ["- 2", 3]}`,
+			expectedErr:   true,
+			expectedField: "acl[1]",
+		},
+		"ACL of wrong type": {
+			policy:        `{"version": 1, "acl": "- 2"}`,
+			expectedErr:   true,
+			expectedField: "acl",
+		},
+		"invalid sequence": {
+			policy:        `{"version": 1, "sequence": "42-1 #x"}`,
+			expectedErr:   true,
+			expectedField: "sequence",
+		},
+		"unknown preference": {
+			policy:        `{"version": 1, "preferences": ["latency", "jitter"]}`,
+			expectedErr:   true,
+			expectedField: "preferences[1]",
+		},
+		"duplicate preference": {
+			policy:        `{"version": 1, "preferences": ["hops", "hops"]}`,
+			expectedErr:   true,
+			expectedField: "preferences[1]",
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			policy, err := parsePolicy([]byte(c.policy), nil)
+
+			if c.expectedErr {
+				require.Error(t, err, "expected an error but got none")
+				if c.expectedField != "" {
+					var fieldErr *PolicyFieldError
+					require.ErrorAs(t, err, &fieldErr, "error does not point at a field")
+					assert.Equal(t, c.expectedField, fieldErr.Field, "error points at wrong field")
+				}
+				return
+			}
+			require.NoError(t, err, "unexpected error")
+
+			assert.True(t, reflect.DeepEqual(c.expectedChain, policy), "parsed policy does not match expected policy")
+		})
+	}
+}
+
+func TestPolicyDocumentPreferenceOrder(t *testing.T) {
+	newPath := func(hops int, mtu uint16) *pan.Path {
+		return &pan.Path{Metadata: &pan.PathMetadata{Interfaces: make([]pan.PathInterface, 2*hops), MTU: mtu}}
+	}
+	long := newPath(2, 1500)
+	shortLowMTU := newPath(1, 1200)
+	shortHighMTU := newPath(1, 1400)
+
+	policy, err := parsePolicy([]byte(`{"version": 1, "preferences": ["hops", "mtu"]}`), nil)
+	require.NoError(t, err, "unexpected error")
+
+	paths := policy.Filter([]*pan.Path{long, shortLowMTU, shortHighMTU})
+	assert.Equal(t, []*pan.Path{shortHighMTU, shortLowMTU, long}, paths, "paths not sorted by hops first and MTU second")
+}
@@ -0,0 +1,175 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panpolicy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
+	"go.uber.org/zap"
+)
+
+var _ PANDialer = (*FallbackDialer)(nil)
+
+// FallbackTracker records per destination whether SCION dials failed recently.
+// Destinations that failed are skipped for SCION until the cool-down expires.
+// It is shared among all sessions, since the reachability of a destination over
+// SCION does not depend on the session.
+type FallbackTracker struct {
+	cooldown time.Duration
+
+	failedUntilMu sync.Mutex
+	failedUntil   map[string]time.Time
+	lastPrune     time.Time
+}
+
+func NewFallbackTracker(cooldown time.Duration) *FallbackTracker {
+	return &FallbackTracker{
+		cooldown:    cooldown,
+		failedUntil: make(map[string]time.Time),
+		lastPrune:   time.Now(),
+	}
+}
+
+// InCooldown reports whether SCION should be skipped for the given destination.
+func (t *FallbackTracker) InCooldown(addr string) bool {
+	t.failedUntilMu.Lock()
+	defer t.failedUntilMu.Unlock()
+
+	host := hostOnly(addr)
+	until, ok := t.failedUntil[host]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(t.failedUntil, host)
+		return false
+	}
+	return true
+}
+
+// RecordFailure marks the destination as unreachable over SCION for the cool-down period.
+func (t *FallbackTracker) RecordFailure(addr string) {
+	t.failedUntilMu.Lock()
+	defer t.failedUntilMu.Unlock()
+
+	now := time.Now()
+	t.prune(now)
+	t.failedUntil[hostOnly(addr)] = now.Add(t.cooldown)
+}
+
+// prune drops the destinations whose cool-down expired, at most once per cool-down period,
+// since destinations that are not dialed again are otherwise never removed.
+func (t *FallbackTracker) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < t.cooldown {
+		return
+	}
+	t.lastPrune = now
+	for host, until := range t.failedUntil {
+		if now.After(until) {
+			delete(t.failedUntil, host)
+		}
+	}
+}
+
+// RecordSuccess clears any recorded failure for the destination.
+func (t *FallbackTracker) RecordSuccess(addr string) {
+	t.failedUntilMu.Lock()
+	defer t.failedUntilMu.Unlock()
+
+	delete(t.failedUntil, hostOnly(addr))
+}
+
+// hostOnly strips the port, if any, since SCION reachability is a property of the host.
+func hostOnly(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// FallbackDialer dials over SCION and transparently retries over TCP/IP if the
+// SCION dial fails or times out. All policy and metrics related operations are
+// delegated to the SCION dialer.
+type FallbackDialer struct {
+	scionDialer PANDialer
+	stdDialer   PANDialer
+	tracker     *FallbackTracker
+
+	logger *zap.Logger
+}
+
+func NewFallbackDialer(logger *zap.Logger, scionDialer, stdDialer PANDialer, tracker *FallbackTracker) *FallbackDialer {
+	return &FallbackDialer{
+		scionDialer: scionDialer,
+		stdDialer:   stdDialer,
+		tracker:     tracker,
+		logger:      logger,
+	}
+}
+
+func (d *FallbackDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	log := d.logger.With(zap.String("network", network), zap.String("addr", addr))
+
+	conn, err := d.scionDialer.DialContext(ctx, network, addr)
+	if err == nil {
+		d.tracker.RecordSuccess(addr)
+		d.recordTransport(addr, transportSCION)
+		return conn, nil
+	}
+	if ctx.Err() != nil {
+		// the client gave up, there is no point in retrying
+		return nil, err
+	}
+
+	log.Info("Failed to dial over SCION; falling back to TCP/IP.", zap.Error(err))
+	d.tracker.RecordFailure(addr)
+	conn, err = d.stdDialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	d.recordTransport(addr, transportIP)
+	return conn, nil
+}
+
+func (d *FallbackDialer) recordTransport(addr string, transport transportType) {
+	if r, ok := d.scionDialer.(transportRecorder); ok {
+		r.RecordTransport(addr, transport)
+	}
+}
+
+func (d *FallbackDialer) SetPolicy(policy pan.Policy) error {
+	return d.scionDialer.SetPolicy(policy)
+}
+
+func (d *FallbackDialer) GetPolicy() pan.Policy {
+	return d.scionDialer.GetPolicy()
+}
+
+func (d *FallbackDialer) GetMetrics(filteredAddrs []string) (*DialerMetrics, error) {
+	return d.scionDialer.GetMetrics(filteredAddrs)
+}
+
+func (d *FallbackDialer) HasOpenConnections() (bool, error) {
+	return d.scionDialer.HasOpenConnections()
+}
+
+func (d *FallbackDialer) HasDialedWithinTimeWindow(t time.Duration) (bool, error) {
+	return d.scionDialer.HasDialedWithinTimeWindow(t)
+}
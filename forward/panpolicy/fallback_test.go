@@ -0,0 +1,113 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panpolicy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestFallbackDialer(t *testing.T) {
+	cases := map[string]struct {
+		scionErr         error
+		expectedStdDial  bool
+		expectedCooldown bool
+	}{
+		"scion dial succeeds":  {scionErr: nil, expectedStdDial: false, expectedCooldown: false},
+		"scion dial times out": {scionErr: ErrDialTimeout, expectedStdDial: true, expectedCooldown: true},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			tracker := NewFallbackTracker(time.Minute)
+			scion := &failingDialer{err: c.scionErr}
+			std := &checkDialer{}
+			d := NewFallbackDialer(zap.NewNop(), scion, std, tracker)
+
+			conn, err := d.DialContext(context.Background(), "tcp", "example.org:443")
+			require.NoError(t, err)
+			assert.NotNil(t, conn)
+
+			assert.True(t, scion.dialCalled, "fallback dialer did not try scion first")
+			assert.Equal(t, c.expectedStdDial, std.dialCalled, "fallback dialer used the wrong transport")
+			assert.Equal(t, c.expectedCooldown, tracker.InCooldown("example.org:80"), "destination has wrong cool-down state")
+		})
+	}
+}
+
+func TestFallbackDialerCancelledContext(t *testing.T) {
+	tracker := NewFallbackTracker(time.Minute)
+	std := &checkDialer{}
+	d := NewFallbackDialer(zap.NewNop(), &failingDialer{err: context.Canceled}, std, tracker)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := d.DialContext(ctx, "tcp", "example.org:443")
+	require.Error(t, err)
+	assert.False(t, std.dialCalled, "fallback dialer should not retry a cancelled dial")
+	assert.False(t, tracker.InCooldown("example.org:443"), "cancelled dial should not be recorded as failure")
+}
+
+func TestFallbackTrackerCooldownExpires(t *testing.T) {
+	tracker := NewFallbackTracker(10 * time.Millisecond)
+
+	tracker.RecordFailure("example.org:443")
+	assert.True(t, tracker.InCooldown("example.org:443"))
+
+	time.Sleep(20 * time.Millisecond)
+	assert.False(t, tracker.InCooldown("example.org:443"))
+
+	tracker.RecordFailure("example.org:443")
+	tracker.RecordSuccess("example.org:443")
+	assert.False(t, tracker.InCooldown("example.org:443"))
+}
+
+func TestFallbackTrackerPrunesExpired(t *testing.T) {
+	tracker := NewFallbackTracker(10 * time.Millisecond)
+
+	tracker.RecordFailure("unvisited.example.org:443")
+	time.Sleep(20 * time.Millisecond)
+
+	// recording a failure removes the expired destinations that were not looked up again
+	tracker.RecordFailure("example.org:443")
+	assert.Len(t, tracker.failedUntil, 1)
+	assert.Contains(t, tracker.failedUntil, "example.org")
+}
+
+type failingDialer struct {
+	err        error
+	dialCalled bool
+}
+
+func (d *failingDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	d.dialCalled = true
+	if d.err != nil {
+		return nil, d.err
+	}
+	return &noopConn{}, nil
+}
+func (d failingDialer) GetMetrics(filteredAddrs []string) (*DialerMetrics, error) { return nil, nil }
+func (d failingDialer) SetPolicy(policy pan.Policy) error                         { return nil }
+func (d failingDialer) GetPolicy() pan.Policy                                     { return nil }
+func (d failingDialer) HasOpenConnections() (bool, error)                         { return true, nil }
+func (d failingDialer) HasDialedWithinTimeWindow(t time.Duration) (bool, error)   { return true, nil }
@@ -0,0 +1,177 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panpolicy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
+	"github.com/scionproto/scion/pkg/addr"
+)
+
+// CountryMapping maps ASes to ISO 3166-1 alpha-2 country codes. An entry with
+// AS 0, e.g., 64-0, applies to all ASes of the ISD without a more specific entry.
+type CountryMapping map[addr.IA]string
+
+// LoadCountryMapping loads a country mapping from a JSON file of the form
+//
+//	{"64-2:0:9": "CH", "71-0": "DE"}
+func LoadCountryMapping(path string) (CountryMapping, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read country mapping: %w", err)
+	}
+
+	var raw map[string]string
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse country mapping: %w", err)
+	}
+
+	m := make(CountryMapping, len(raw))
+	for k, v := range raw {
+		ia, err := addr.ParseIA(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid country mapping entry %q: %w", k, err)
+		}
+		country, err := normalizeCountry(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid country mapping entry %q: %w", k, err)
+		}
+		m[ia] = country
+	}
+	return m, nil
+}
+
+// Country returns the country of the AS ia.
+func (m CountryMapping) Country(ia addr.IA) (string, bool) {
+	if country, ok := m[ia]; ok {
+		return country, true
+	}
+	country, ok := m[addr.MustIAFrom(ia.ISD(), 0)]
+	return country, ok
+}
+
+func normalizeCountry(c string) (string, error) {
+	c = strings.ToUpper(strings.TrimSpace(c))
+	if len(c) != 2 || c[0] < 'A' || c[0] > 'Z' || c[1] < 'A' || c[1] > 'Z' {
+		return "", fmt.Errorf("invalid country code %q", c)
+	}
+	return c, nil
+}
+
+// geofence restricts the ASes a path may traverse. A path is allowed if none of its
+// ASes is in a denied ISD or country and, if an allow list is given, all of its ASes
+// are in an allowed ISD or country. ASes without a known country only pass allow
+// lists by their ISD.
+type geofence struct {
+	AllowISDs      []addr.ISD `json:"allowISDs,omitempty"`
+	DenyISDs       []addr.ISD `json:"denyISDs,omitempty"`
+	AllowCountries []string   `json:"allowCountries,omitempty"`
+	DenyCountries  []string   `json:"denyCountries,omitempty"`
+}
+
+func (g *geofence) compile(countries CountryMapping) (*geofencePolicy, error) {
+	if len(g.AllowISDs) == 0 && len(g.DenyISDs) == 0 && len(g.AllowCountries) == 0 && len(g.DenyCountries) == 0 {
+		return nil, &PolicyFieldError{Field: "geofence", Err: errors.New("no ISDs or countries given")}
+	}
+
+	p := &geofencePolicy{
+		allowISDs:      make(map[addr.ISD]bool, len(g.AllowISDs)),
+		denyISDs:       make(map[addr.ISD]bool, len(g.DenyISDs)),
+		allowCountries: make(map[string]bool, len(g.AllowCountries)),
+		denyCountries:  make(map[string]bool, len(g.DenyCountries)),
+		countries:      countries,
+	}
+	for _, isd := range g.AllowISDs {
+		p.allowISDs[isd] = true
+	}
+	for _, isd := range g.DenyISDs {
+		p.denyISDs[isd] = true
+	}
+
+	countryLists := []struct {
+		field string
+		list  []string
+		set   map[string]bool
+	}{
+		{"geofence.allowCountries", g.AllowCountries, p.allowCountries},
+		{"geofence.denyCountries", g.DenyCountries, p.denyCountries},
+	}
+	for _, cl := range countryLists {
+		if len(cl.list) != 0 && len(countries) == 0 {
+			return nil, &PolicyFieldError{Field: cl.field, Err: errors.New("no country mapping configured on the proxy")}
+		}
+		for i, c := range cl.list {
+			country, err := normalizeCountry(c)
+			if err != nil {
+				return nil, &PolicyFieldError{Field: fmt.Sprintf("%s[%d]", cl.field, i), Err: err}
+			}
+			cl.set[country] = true
+		}
+	}
+	return p, nil
+}
+
+var _ pan.Policy = (*geofencePolicy)(nil)
+
+// geofencePolicy is the pan.Policy compiled from a geofence.
+type geofencePolicy struct {
+	allowISDs      map[addr.ISD]bool
+	denyISDs       map[addr.ISD]bool
+	allowCountries map[string]bool
+	denyCountries  map[string]bool
+	countries      CountryMapping
+}
+
+func (p *geofencePolicy) Filter(paths []*pan.Path) []*pan.Path {
+	filtered := make([]*pan.Path, 0, len(paths))
+	for _, path := range paths {
+		if p.allowsPath(path) {
+			filtered = append(filtered, path)
+		}
+	}
+	return filtered
+}
+
+func (p *geofencePolicy) allowsPath(path *pan.Path) bool {
+	if !p.allowsIA(addr.IA(path.Source)) || !p.allowsIA(addr.IA(path.Destination)) {
+		return false
+	}
+	if path.Metadata == nil {
+		// the traversed ASes are unknown unless the path stays within a single AS
+		return path.Source == path.Destination
+	}
+	for _, intf := range path.Metadata.Interfaces {
+		if !p.allowsIA(addr.IA(intf.IA)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *geofencePolicy) allowsIA(ia addr.IA) bool {
+	country, hasCountry := p.countries.Country(ia)
+	if p.denyISDs[ia.ISD()] || (hasCountry && p.denyCountries[country]) {
+		return false
+	}
+	if len(p.allowISDs) == 0 && len(p.allowCountries) == 0 {
+		return true
+	}
+	return p.allowISDs[ia.ISD()] || (hasCountry && p.allowCountries[country])
+}
@@ -0,0 +1,167 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package panpolicy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadCountryMapping(t *testing.T) {
+	cases := map[string]struct {
+		content     string
+		expected    CountryMapping
+		expectedErr bool
+	}{
+		"valid mapping": {
+			content: `{"64-2:0:9": "ch", "71-0": "DE"}`,
+			expected: CountryMapping{
+				addr.MustParseIA("64-2:0:9"): "CH",
+				addr.MustParseIA("71-0"):     "DE",
+			},
+		},
+		"invalid IA":      {content: `{"64": "CH"}`, expectedErr: true},
+		"invalid country": {content: `{"64-2:0:9": "CHE"}`, expectedErr: true},
+		"invalid JSON":    {content: `["64-2:0:9"]`, expectedErr: true},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "countries.json")
+			require.NoError(t, os.WriteFile(path, []byte(c.content), 0600))
+
+			m, err := LoadCountryMapping(path)
+			if c.expectedErr {
+				require.Error(t, err, "expected an error but got none")
+				return
+			}
+			require.NoError(t, err, "unexpected error")
+			assert.Equal(t, c.expected, m)
+		})
+	}
+}
+
+func TestGeofencePolicy(t *testing.T) {
+	countries := CountryMapping{
+		addr.MustParseIA("1-ff00:0:110"): "CH",
+		addr.MustParseIA("1-ff00:0:111"): "DE",
+		addr.MustParseIA("2-0"):          "US",
+	}
+	newPath := func(ias ...string) *pan.Path {
+		intfs := make([]pan.PathInterface, len(ias))
+		for i, ia := range ias {
+			intfs[i] = pan.PathInterface{IA: pan.IA(addr.MustParseIA(ia))}
+		}
+		return &pan.Path{
+			Source:      intfs[0].IA,
+			Destination: intfs[len(intfs)-1].IA,
+			Metadata:    &pan.PathMetadata{Interfaces: intfs},
+		}
+	}
+	viaCH := newPath("1-ff00:0:110", "1-ff00:0:110")
+	viaDE := newPath("1-ff00:0:110", "1-ff00:0:111", "1-ff00:0:111", "1-ff00:0:110")
+	viaUS := newPath("1-ff00:0:110", "2-ff00:0:210", "2-ff00:0:210", "1-ff00:0:110")
+	viaUnknown := newPath("1-ff00:0:110", "1-ff00:0:112", "1-ff00:0:112", "1-ff00:0:110")
+	noMetadata := &pan.Path{Source: viaCH.Source, Destination: pan.IA(addr.MustParseIA("1-ff00:0:112"))}
+
+	cases := map[string]struct {
+		fence    geofence
+		expected []*pan.Path
+	}{
+		"deny ISD":           {geofence{DenyISDs: []addr.ISD{2}}, []*pan.Path{viaCH, viaDE, viaUnknown}},
+		"allow ISD":          {geofence{AllowISDs: []addr.ISD{1}}, []*pan.Path{viaCH, viaDE, viaUnknown}},
+		"deny country":       {geofence{DenyCountries: []string{"de"}}, []*pan.Path{viaCH, viaUS, viaUnknown}},
+		"allow countries":    {geofence{AllowCountries: []string{"CH", "US"}}, []*pan.Path{viaCH, viaUS}},
+		"allow ISD and deny": {geofence{AllowISDs: []addr.ISD{1}, DenyCountries: []string{"DE"}}, []*pan.Path{viaCH, viaUnknown}},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			policy, err := c.fence.compile(countries)
+			require.NoError(t, err, "unexpected error")
+
+			paths := policy.Filter([]*pan.Path{viaCH, viaDE, viaUS, viaUnknown})
+			assert.Equal(t, c.expected, paths, "filtered paths do not match")
+
+			// paths without metadata are only allowed within a single AS
+			assert.Empty(t, policy.Filter([]*pan.Path{noMetadata}), "path without metadata was not filtered")
+		})
+	}
+}
+
+func TestParsePolicyDocumentWithGeofence(t *testing.T) {
+	countries := CountryMapping{addr.MustParseIA("1-ff00:0:110"): "CH"}
+
+	cases := map[string]struct {
+		policy        string
+		countries     CountryMapping
+		expectedErr   bool
+		expectedField string
+	}{
+		"allow countries": {
+			policy:    `{"version": 1, "geofence": {"allowCountries": ["CH"]}, "preferences": ["latency"]}`,
+			countries: countries,
+		},
+		"deny ISDs without mapping": {
+			policy: `{"version": 1, "geofence": {"denyISDs": [2, 3]}}`,
+		},
+		"countries without mapping": {
+			policy:        `{"version": 1, "geofence": {"denyCountries": ["CH"]}}`,
+			expectedErr:   true,
+			expectedField: "geofence.denyCountries",
+		},
+		"invalid country": {
+			policy:        `{"version": 1, "geofence": {"allowCountries": ["CH", "Switzerland"]}}`,
+			countries:     countries,
+			expectedErr:   true,
+			expectedField: "geofence.allowCountries[1]",
+		},
+		"empty geofence": {
+			policy:        `{"version": 1, "geofence": {}}`,
+			expectedErr:   true,
+			expectedField: "geofence",
+		},
+		"ISD of wrong type": {
+			policy:        `{"version": 1, "geofence": {"allowISDs": ["1"]}}`,
+			expectedErr:   true,
+			expectedField: "geofence.allowISDs[0]",
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			policy, err := parsePolicy([]byte(c.policy), c.countries)
+
+			if c.expectedErr {
+				require.Error(t, err, "expected an error but got none")
+				var fieldErr *PolicyFieldError
+				require.ErrorAs(t, err, &fieldErr, "error does not point at a field")
+				assert.Equal(t, c.expectedField, fieldErr.Field, "error points at wrong field")
+				return
+			}
+			require.NoError(t, err, "unexpected error")
+
+			chain, ok := policy.(pan.PolicyChain)
+			require.True(t, ok, "policy is not a policy chain")
+			_, ok = chain[0].(*geofencePolicy)
+			assert.True(t, ok, "policy chain does not start with the geofence")
+		})
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panpolicy
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
+)
+
+// pathDownTimeout is the time after which a path that went down is tried again.
+const pathDownTimeout = 1 * time.Minute
+
+// healthIdleEviction is the time after which the health of a destination that was neither
+// dialed nor reported is dropped, including its failovers.
+const healthIdleEviction = 10 * time.Minute
+
+// DestinationHealth summarizes the path health of a destination.
+type DestinationHealth struct {
+	Addr string
+	// DownPaths is the number of paths currently considered down.
+	DownPaths int
+	// Failovers is the number of times a connection migrated to another path.
+	Failovers int
+}
+
+// pathHealth records per destination the paths that went down, as reported by SCMP
+// path down notifications, so that new connections to the destination avoid them.
+type pathHealth struct {
+	downTimeout time.Duration
+
+	mutex        sync.Mutex
+	destinations map[string]*destinationHealth
+	lastSweep    time.Time
+}
+
+type destinationHealth struct {
+	downSince map[pan.PathFingerprint]time.Time
+	failovers int
+	lastUsed  time.Time
+}
+
+func newPathHealth(downTimeout time.Duration) *pathHealth {
+	return &pathHealth{
+		downTimeout:  downTimeout,
+		destinations: make(map[string]*destinationHealth),
+		lastSweep:    time.Now(),
+	}
+}
+
+func (h *pathHealth) destination(addr string) *destinationHealth {
+	now := time.Now()
+	h.sweep(now)
+	dh, ok := h.destinations[addr]
+	if !ok {
+		dh = &destinationHealth{downSince: make(map[pan.PathFingerprint]time.Time)}
+		h.destinations[addr] = dh
+	}
+	dh.lastUsed = now
+	return dh
+}
+
+// sweep drops the destinations not used within healthIdleEviction, at most once per
+// healthIdleEviction.
+func (h *pathHealth) sweep(now time.Time) {
+	if now.Sub(h.lastSweep) < healthIdleEviction {
+		return
+	}
+	h.lastSweep = now
+	for addr, dh := range h.destinations {
+		if now.Sub(dh.lastUsed) > healthIdleEviction {
+			delete(h.destinations, addr)
+		}
+	}
+}
+
+func (h *pathHealth) RecordDown(addr string, pf pan.PathFingerprint) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.destination(addr).downSince[pf] = time.Now()
+}
+
+func (h *pathHealth) RecordFailover(addr string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.destination(addr).failovers++
+}
+
+// FilterHealthy removes the paths to addr that are considered down. If all paths
+// are down, they are all kept, i.e., a down path is better than none.
+func (h *pathHealth) FilterHealthy(addr string, paths []*pan.Path) []*pan.Path {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := time.Now()
+	h.sweep(now)
+	dh, ok := h.destinations[addr]
+	if !ok {
+		return paths
+	}
+	dh.lastUsed = now
+	h.expire(dh)
+
+	healthy := make([]*pan.Path, 0, len(paths))
+	for _, p := range paths {
+		if _, down := dh.downSince[p.Fingerprint]; !down {
+			healthy = append(healthy, p)
+		}
+	}
+	if len(healthy) == 0 {
+		return paths
+	}
+	return healthy
+}
+
+// Snapshot returns the health of all destinations sorted by address.
+func (h *pathHealth) Snapshot() []DestinationHealth {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	snapshot := make([]DestinationHealth, 0, len(h.destinations))
+	for addr, dh := range h.destinations {
+		h.expire(dh)
+		snapshot = append(snapshot, DestinationHealth{
+			Addr:      addr,
+			DownPaths: len(dh.downSince),
+			Failovers: dh.failovers,
+		})
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Addr < snapshot[j].Addr })
+	return snapshot
+}
+
+func (h *pathHealth) expire(dh *destinationHealth) {
+	for pf, since := range dh.downSince {
+		if time.Since(since) > h.downTimeout {
+			delete(dh.downSince, pf)
+		}
+	}
+}
+
+var _ pan.Selector = (*healthSelector)(nil)
+
+// healthSelector wraps the selector of a connection to addr. It hides paths known to be
+// down from the wrapped selector and records path down notifications affecting the
+// current path as well as the resulting failovers, i.e., the migration of the
+// connection to another path.
+type healthSelector struct {
+	pan.Selector
+	addr   string
+	health *pathHealth
+}
+
+func newHealthSelector(selector pan.Selector, addr string, health *pathHealth) *healthSelector {
+	return &healthSelector{
+		Selector: selector,
+		addr:     addr,
+		health:   health,
+	}
+}
+
+func (s *healthSelector) Initialize(local, remote pan.UDPAddr, paths []*pan.Path) {
+	s.Selector.Initialize(local, remote, s.health.FilterHealthy(s.addr, paths))
+}
+
+func (s *healthSelector) Refresh(paths []*pan.Path) {
+	s.Selector.Refresh(s.health.FilterHealthy(s.addr, paths))
+}
+
+func (s *healthSelector) PathDown(pf pan.PathFingerprint, pi pan.PathInterface) {
+	current := s.Selector.Path()
+	if current == nil {
+		// not initialized yet, nothing to fail over
+		return
+	}
+	if !isAffected(current, pf, pi) {
+		s.Selector.PathDown(pf, pi)
+		return
+	}
+
+	s.health.RecordDown(s.addr, current.Fingerprint)
+	s.Selector.PathDown(pf, pi)
+	if next := s.Selector.Path(); next != nil && next.Fingerprint != current.Fingerprint {
+		s.health.RecordFailover(s.addr)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package panpolicy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathHealth(t *testing.T) {
+	fast := newSelectorTestPath("fast", 5*time.Millisecond, 10, "1-1", "1-3", "1-2")
+	slow := newSelectorTestPath("slow", 20*time.Millisecond, 10, "1-1", "1-4", "1-2")
+	paths := []*pan.Path{fast, slow}
+
+	cases := map[string]struct {
+		down        []*pan.Path
+		downTimeout time.Duration
+		expected    []*pan.Path
+	}{
+		"no path down":      {downTimeout: time.Minute, expected: paths},
+		"one path down":     {down: []*pan.Path{fast}, downTimeout: time.Minute, expected: []*pan.Path{slow}},
+		"all paths down":    {down: paths, downTimeout: time.Minute, expected: paths},
+		"down path expired": {down: []*pan.Path{fast}, downTimeout: 0, expected: paths},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			h := newPathHealth(c.downTimeout)
+			for _, p := range c.down {
+				h.RecordDown("dst:443", p.Fingerprint)
+			}
+			time.Sleep(time.Millisecond)
+
+			assert.Equal(t, c.expected, h.FilterHealthy("dst:443", paths), "wrong healthy paths")
+			assert.Equal(t, paths, h.FilterHealthy("other:443", paths), "health leaked to other destination")
+		})
+	}
+}
+
+func TestPathHealthEvictsIdleDestinations(t *testing.T) {
+	fast := newSelectorTestPath("fast", 5*time.Millisecond, 10, "1-1", "1-3", "1-2")
+	h := newPathHealth(time.Minute)
+	h.RecordDown("idle:443", fast.Fingerprint)
+	h.RecordFailover("active:443")
+
+	// inactive destinations are dropped
+	h.lastSweep = time.Now().Add(-2 * healthIdleEviction)
+	h.destinations["idle:443"].lastUsed = time.Now().Add(-2 * healthIdleEviction)
+	h.FilterHealthy("active:443", []*pan.Path{fast})
+
+	require.Len(t, h.destinations, 1)
+	assert.Equal(t, []DestinationHealth{{Addr: "active:443", Failovers: 1}}, h.Snapshot())
+}
+
+func TestHealthSelectorFailover(t *testing.T) {
+	fast := newSelectorTestPath("fast", 5*time.Millisecond, 10, "1-1", "1-3", "1-2")
+	slow := newSelectorTestPath("slow", 20*time.Millisecond, 10, "1-1", "1-4", "1-2")
+	h := newPathHealth(time.Minute)
+
+	s := newHealthSelector(newQualitySelector(pan.LowestLatency{}), "dst:443", h)
+	s.PathDown("fast", pan.PathInterface{})
+	assert.Empty(t, h.Snapshot(), "uninitialized selector recorded health")
+
+	s.Initialize(pan.UDPAddr{}, pan.UDPAddr{}, []*pan.Path{slow, fast})
+	require.Equal(t, fast, s.Path())
+
+	// unrelated notification
+	s.PathDown("other", pan.PathInterface{IA: pan.MustParseIA("1-5"), IfID: 1})
+	assert.Equal(t, fast, s.Path(), "selector switched path on unrelated notification")
+	assert.Empty(t, h.Snapshot(), "unrelated notification recorded health")
+
+	// the open connection migrates to the slow path
+	s.PathDown("", fast.Metadata.Interfaces[1])
+	assert.Equal(t, slow, s.Path(), "selector did not fail over")
+	assert.Equal(t, []DestinationHealth{{Addr: "dst:443", DownPaths: 1, Failovers: 1}}, h.Snapshot())
+
+	// a new connection to the same destination avoids the down path
+	next := newHealthSelector(newQualitySelector(pan.LowestLatency{}), "dst:443", h)
+	next.Initialize(pan.UDPAddr{}, pan.UDPAddr{}, []*pan.Path{slow, fast})
+	assert.Equal(t, slow, next.Path(), "new connection uses the down path")
+
+	// a connection to another destination is not affected
+	other := newHealthSelector(newQualitySelector(pan.LowestLatency{}), "other:443", h)
+	other.Initialize(pan.UDPAddr{}, pan.UDPAddr{}, []*pan.Path{slow, fast})
+	assert.Equal(t, fast, other.Path(), "connection to other destination avoids the down path")
+}
@@ -17,8 +17,10 @@ package panpolicy
 import (
 	"encoding/json"
 	"errors"
+	"net"
 	"net/http"
 
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
 	"go.uber.org/zap"
 
 	"github.com/scionproto-contrib/http-proxy/forward/session"
@@ -28,40 +30,48 @@ import (
 type strategyType string
 
 const (
-	shortestPath strategyType = "Shortest Path (AS hops)"
-	geofenced    strategyType = "Geofenced"
+	shortestPath     strategyType = "Shortest Path (AS hops)"
+	geofenced        strategyType = "Geofenced"
+	lowestLatency    strategyType = "Lowest Latency"
+	highestBandwidth strategyType = "Highest Bandwidth"
+	highestMTU       strategyType = "Highest MTU"
 )
 
 type MetricsHandler struct {
 	policyManager DialerManager
+	sessionStore  session.SessionStore
 
 	logger *zap.Logger
 }
 
-func NewMetricsHandler(policyManager DialerManager, logger *zap.Logger) *MetricsHandler {
+func NewMetricsHandler(policyManager DialerManager, sessionStore session.SessionStore, logger *zap.Logger) *MetricsHandler {
 	return &MetricsHandler{
 		policyManager: policyManager,
+		sessionStore:  sessionStore,
 		logger:        logger,
 	}
 }
 
 // TODO maybe we should key this with the address (instead of it being a member)
 type pathMetrics struct {
-	Addr     string
-	PathInfo *pathInfo
-	Strategy strategyType
+	Addr      string
+	PathInfo  *pathInfo
+	Strategy  strategyType
+	Transport transportType
 }
 
 // MarshalJSON marshals the pathMetrics in the format the browser extension expects it
 func (p *pathMetrics) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&struct {
-		Addr     string   `json:"Domain"`
-		Path     []string `json:"Path"`
-		Strategy string   `json:"Strategy"`
+		Addr      string   `json:"Domain"`
+		Path      []string `json:"Path"`
+		Strategy  string   `json:"Strategy"`
+		Transport string   `json:"Transport,omitempty"`
 	}{
-		Addr:     p.Addr,
-		Path:     hopsToPathHops(p.PathInfo),
-		Strategy: string(p.Strategy),
+		Addr:      p.Addr,
+		Path:      hopsToPathHops(p.PathInfo),
+		Strategy:  string(p.Strategy),
+		Transport: string(p.Transport),
 	})
 }
 
@@ -85,7 +95,7 @@ func (p *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error
 }
 
 func (p *MetricsHandler) getMetrics(r *http.Request) ([]*pathMetrics, error) {
-	sessionData, err := session.GetSessionData(p.logger, r)
+	sessionData, err := p.sessionStore.GetSessionData(r)
 	if err != nil {
 		return nil, err
 	}
@@ -104,23 +114,38 @@ func (p *MetricsHandler) getMetrics(r *http.Request) ([]*pathMetrics, error) {
 		return nil, err
 	}
 
-	strategy := shortestPath
-	if metrics.policy != nil {
-		strategy = geofenced
-	}
+	strategy := metricsStrategy(metrics)
 
 	pms := make([]*pathMetrics, len(metrics.connInfo))
 	for i, ci := range metrics.connInfo {
 		pms[i] = &pathMetrics{
-			Addr:     ci.Addr,
-			PathInfo: ci.PathInfo,
-			Strategy: strategy,
+			Addr:      ci.Addr,
+			PathInfo:  ci.PathInfo,
+			Strategy:  strategy,
+			Transport: ci.Transport,
 		}
 	}
 
 	return pms, nil
 }
 
+func metricsStrategy(metrics *DialerMetrics) strategyType {
+	switch metrics.strategy {
+	case preferLatency:
+		return lowestLatency
+	case preferBandwidth:
+		return highestBandwidth
+	case preferHops:
+		return shortestPath
+	case preferMTU:
+		return highestMTU
+	}
+	if metrics.policy != nil {
+		return geofenced
+	}
+	return shortestPath
+}
+
 func hopsToPathHops(pathInfo *pathInfo) []string {
 	if pathInfo == nil {
 		return []string{}
@@ -144,3 +169,20 @@ func hopsToPathHops(pathInfo *pathInfo) []string {
 
 	return hops
 }
+
+// PathHops returns the ISD-ASes of the path a connection returned by a dialer uses,
+// or nil if it is not a SCION connection.
+func PathHops(conn net.Conn) []string {
+	if tc, ok := conn.(*trackedConnection); ok {
+		conn = tc.Conn
+	}
+	panConn, ok := conn.(pathAwareConn)
+	if !ok {
+		return nil
+	}
+	var ia pan.IA
+	if addr, ok := panConn.LocalAddr().(pan.UDPAddr); ok {
+		ia = addr.IA
+	}
+	return hopsToPathHops(&pathInfo{panConn.GetPath(), ia})
+}
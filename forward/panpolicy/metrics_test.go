@@ -34,6 +34,7 @@ import (
 func TestMetricsHandler(t *testing.T) {
 	cases := map[string]struct {
 		policy       pan.Policy
+		strategy     preference
 		connInfos    []*ConnInfo
 		expectedBody string
 	}{
@@ -77,6 +78,20 @@ func TestMetricsHandler(t *testing.T) {
 			},
 			expectedBody: `[{"Domain":"addr1","Path":["42-0"],"Strategy":"Geofenced"}]`,
 		},
+		"request with selection strategy": {
+			policy:   MustParseACL(t, "+"),
+			strategy: preferLatency,
+			connInfos: []*ConnInfo{
+				{Addr: "addr1", PathInfo: &pathInfo{nil, pan.MustParseIA("42-0")}},
+			},
+			expectedBody: `[{"Domain":"addr1","Path":["42-0"],"Strategy":"Lowest Latency"}]`,
+		},
+		"request won by TCP/IP": {
+			connInfos: []*ConnInfo{
+				{Addr: "addr1", Transport: transportIP},
+			},
+			expectedBody: `[{"Domain":"addr1","Path":[],"Strategy":"Shortest Path (AS hops)","Transport":"IP"}]`,
+		},
 	}
 
 	for name, c := range cases {
@@ -85,9 +100,11 @@ func TestMetricsHandler(t *testing.T) {
 				mockDialerPool{
 					dialer: mockDialer{
 						policy:    c.policy,
+						strategy:  c.strategy,
 						connInfos: c.connInfos,
 					},
 				},
+				newTestSessionStore(),
 				zap.NewNop(),
 			)
 
@@ -123,6 +140,7 @@ func (dp mockDialerPool) ServeHTTP(w http.ResponseWriter, r *http.Request) error
 
 type mockDialer struct {
 	policy    pan.Policy
+	strategy  preference
 	connInfos []*ConnInfo
 }
 
@@ -131,7 +149,9 @@ func (d mockDialer) GetMetrics(filteredAddrs []string) (*DialerMetrics, error) {
 		return nil, ErrNoConnections
 	}
 	return &DialerMetrics{
-		d.policy, d.connInfos,
+		policy:   d.policy,
+		strategy: d.strategy,
+		connInfo: d.connInfos,
 	}, nil
 }
 func (d mockDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
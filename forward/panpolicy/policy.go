@@ -25,6 +25,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/netsec-ethz/scion-apps/pkg/pan"
@@ -36,7 +37,7 @@ import (
 )
 
 type DialerManager interface {
-	ServeHTTP(w http.ResponseWriter, r *http.Request) error // set policy endpoint
+	ServeHTTP(w http.ResponseWriter, r *http.Request) error // policy endpoint
 	GetDialer(sessionData session.SessionData, useScion bool) (PANDialer, error)
 	Start() error
 	Stop() error
@@ -57,10 +58,15 @@ type PANDialer interface {
 }
 
 type policyManager struct {
-	logger      *zap.Logger
-	dialTimeout time.Duration
+	logger       *zap.Logger
+	sessionStore session.SessionStore
+	dialTimeout  time.Duration
 
 	stdDialer PANDialer
+	// countries resolves the countries of geofence policies, may be nil
+	countries CountryMapping
+	// multipathSubflows is the maximum number of paths a tunnel is striped over, see WithMultipath
+	multipathSubflows int
 
 	// XXX(JordiSubira): Shared dialers have their pros and cons. They are shared among all sessions
 	// and thus can be reused, but they are also shared among all sessions and thus path information
@@ -76,11 +82,14 @@ type policyManager struct {
 	purgeTimeout  time.Duration
 	purgeInterval time.Duration
 	purgeTicker   *time.Ticker
+	purgeRuns     atomic.Uint64
+	purgedDialers atomic.Uint64
 }
 
-func NewPolicyManager(logger *zap.Logger, dialTimeout time.Duration, purge bool, purgeTimeout, purgeInterval time.Duration) *policyManager {
+func NewPolicyManager(logger *zap.Logger, sessionStore session.SessionStore, dialTimeout time.Duration, purge bool, purgeTimeout, purgeInterval time.Duration) *policyManager {
 	return &policyManager{
 		logger:         logger,
+		sessionStore:   sessionStore,
 		dialTimeout:    dialTimeout,
 		stdDialer:      NewStdDialer(logger, dialTimeout),
 		sharedSDialer:  NewSCIONDialer(logger, dialTimeout, true),
@@ -91,6 +100,29 @@ func NewPolicyManager(logger *zap.Logger, dialTimeout time.Duration, purge bool,
 	}
 }
 
+// SetCountryMapping sets the mapping used to resolve the countries of geofence policies.
+// It must be called before Start.
+func (h *policyManager) SetCountryMapping(countries CountryMapping) {
+	h.countries = countries
+}
+
+// SetMultipathSubflows enables striping tunnels over up to subflows disjoint paths to
+// destinations supporting it, see WithMultipath. It must be called before Start.
+func (h *policyManager) SetMultipathSubflows(subflows int) {
+	h.multipathSubflows = subflows
+	if ms, ok := h.sharedSDialer.(multipathSetter); ok {
+		ms.setMultipathSubflows(subflows)
+	}
+}
+
+// SetUpstream routes the connections dialed over TCP/IP through parent proxies. It must be
+// called before Start.
+func (h *policyManager) SetUpstream(upstream *Upstream) {
+	if us, ok := h.stdDialer.(upstreamSetter); ok {
+		us.setUpstream(upstream)
+	}
+}
+
 func (h *policyManager) Start() error {
 	if !h.purge {
 		return nil
@@ -118,11 +150,103 @@ func (h *policyManager) Stop() error {
 	return nil
 }
 
+// OpenConnections returns the number of open connections of the SCION dialers.
+func (h *policyManager) OpenConnections() int {
+	n := 0
+	for _, d := range append(h.customSDialers.Dialers(), h.sharedSDialer) {
+		if c, ok := d.(connectionCounter); ok {
+			n += c.OpenConnections()
+		}
+	}
+	return n
+}
+
+// PurgeStats returns the number of runs purging inactive dialers and the number of dialers purged.
+func (h *policyManager) PurgeStats() (runs, purged uint64) {
+	return h.purgeRuns.Load(), h.purgedDialers.Load()
+}
+
 func (h *policyManager) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
-	if r.Method != http.MethodPut {
-		return utils.NewHandlerError(http.StatusMethodNotAllowed, errors.New("HTTP PUT allowed only"))
+	switch r.Method {
+	case http.MethodGet:
+		return h.servePolicy(w, r)
+	case http.MethodPut:
+		return h.setPolicy(w, r)
+	case http.MethodDelete:
+		return h.deletePolicy(w, r)
+	default:
+		return utils.NewHandlerError(http.StatusMethodNotAllowed, errors.New("HTTP GET, PUT and DELETE allowed only"))
 	}
+}
 
+type policyKind string
+
+const (
+	noPolicy         policyKind = "None"
+	aclPolicy        policyKind = "ACL"
+	sequencePolicy   policyKind = "Sequence"
+	structuredPolicy policyKind = "Structured"
+)
+
+// effectivePolicy is the policy applied to the connections of a session, in the format
+// the browser extension expects it. Policy holds the policy as it was set, Sequence
+// the resulting sequence in the path policy language for show path formatted sequences.
+type effectivePolicy struct {
+	Type     policyKind      `json:"Type"`
+	Policy   json.RawMessage `json:"Policy,omitempty"`
+	Sequence string          `json:"Sequence,omitempty"`
+}
+
+func (h *policyManager) servePolicy(w http.ResponseWriter, r *http.Request) error {
+	sessionData, err := h.sessionStore.GetSessionData(r)
+	if err != nil {
+		return utils.NewHandlerError(http.StatusInternalServerError, err)
+	}
+
+	ep, err := newEffectivePolicy(sessionData.Policy, h.countries)
+	if err != nil {
+		return utils.NewHandlerError(http.StatusInternalServerError, err)
+	}
+
+	j, err := json.Marshal(ep)
+	if err != nil {
+		return utils.NewHandlerError(http.StatusInternalServerError, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(j)
+	if err != nil {
+		return utils.NewHandlerError(http.StatusInternalServerError, err)
+	}
+	return nil
+}
+
+func newEffectivePolicy(rawPolicy []byte, countries CountryMapping) (*effectivePolicy, error) {
+	if len(rawPolicy) == 0 {
+		return &effectivePolicy{Type: noPolicy}, nil
+	}
+
+	policy, err := parsePolicy(rawPolicy, countries)
+	if err != nil {
+		return nil, err
+	}
+
+	ep := &effectivePolicy{Policy: rawPolicy}
+	switch p := policy.(type) {
+	case *pan.ACL:
+		ep.Type = aclPolicy
+	case pan.Sequence:
+		ep.Type = sequencePolicy
+		ep.Sequence = p.String()
+	case pan.PolicyChain:
+		ep.Type = structuredPolicy
+	default:
+		return nil, fmt.Errorf("unsupported policy type %T", policy)
+	}
+	return ep, nil
+}
+
+func (h *policyManager) setPolicy(w http.ResponseWriter, r *http.Request) error {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		return utils.NewHandlerError(http.StatusBadRequest, err)
@@ -130,7 +254,7 @@ func (h *policyManager) ServeHTTP(w http.ResponseWriter, r *http.Request) error
 
 	log := h.logger.With(zap.String("policy", string(body)))
 
-	policy, err := parsePolicy(body)
+	policy, err := parsePolicy(body, h.countries)
 	if err != nil {
 		return utils.NewHandlerError(http.StatusBadRequest, err)
 	}
@@ -145,6 +269,27 @@ func (h *policyManager) ServeHTTP(w http.ResponseWriter, r *http.Request) error
 	return nil
 }
 
+// deletePolicy clears the policy of the session, i.e., subsequent connections of the
+// session use the shared dialer. The custom dialer is purged once it becomes inactive.
+func (h *policyManager) deletePolicy(w http.ResponseWriter, r *http.Request) error {
+	sessionData, err := h.sessionStore.GetSessionData(r)
+	if err != nil {
+		return utils.NewHandlerError(http.StatusInternalServerError, err)
+	}
+
+	if len(sessionData.Policy) != 0 {
+		sessionData.Policy = nil
+		err = h.sessionStore.SetSessionData(w, r, sessionData)
+		if err != nil {
+			return utils.NewHandlerError(http.StatusInternalServerError, err)
+		}
+		h.logger.Debug("Policy deleted.", zap.String("session-id", sessionData.ID))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
 func (h *policyManager) GetDialer(sd session.SessionData, useScion bool) (PANDialer, error) {
 	log := h.logger.With(zap.String("session-id", sd.ID), zap.Bool("use-scion", useScion))
 
@@ -169,7 +314,7 @@ func (h *policyManager) GetDialer(sd session.SessionData, useScion bool) (PANDia
 	}
 
 	// ensure policy
-	policy, err := parsePolicy(sd.Policy)
+	policy, err := parsePolicy(sd.Policy, h.countries)
 	if err != nil {
 		return nil, err
 	}
@@ -180,6 +325,14 @@ func (h *policyManager) GetDialer(sd session.SessionData, useScion bool) (PANDia
 		return nil, err
 	}
 
+	// ensure selection strategy
+	if ss, ok := dialer.(strategySetter); ok {
+		err = ss.setSelectionStrategy(parseSelectionStrategy(sd.Policy))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return dialer, nil
 }
 
@@ -189,13 +342,14 @@ func (h *policyManager) loadOrNewDialer(id string) (PANDialer, bool) {
 	}
 
 	d := NewSCIONDialer(h.logger, h.dialTimeout, false)
+	d.setMultipathSubflows(h.multipathSubflows)
 	h.customSDialers.Store(id, d)
 	return d, false
 }
 
 func (h *policyManager) persistPolicy(w http.ResponseWriter, r *http.Request, rawPolicy []byte, policy pan.Policy) error {
 	// save in session
-	sessionData, err := session.GetSessionData(h.logger, r)
+	sessionData, err := h.sessionStore.GetSessionData(r)
 	if err != nil {
 		return err
 	}
@@ -203,7 +357,7 @@ func (h *policyManager) persistPolicy(w http.ResponseWriter, r *http.Request, ra
 
 	sessionData.Policy = rawPolicy
 
-	err = session.SetSessionData(h.logger, w, r, sessionData)
+	err = h.sessionStore.SetSessionData(w, r, sessionData)
 	if err != nil {
 		return err
 	}
@@ -253,19 +407,26 @@ func (h *policyManager) purgeAbandonedDialers() {
 		h.logger.Debug("Purging dialer.", zap.String("session-id", id))
 		return true
 	}
-	h.customSDialers.Cleanup(cleaner)
+	purged := h.customSDialers.Cleanup(cleaner)
+	h.purgeRuns.Add(1)
+	h.purgedDialers.Add(uint64(purged))
 }
 
 // See https://docs.scion.org/en/latest/dev/design/PathPolicy.html.
 // example ACL policy: + 1-ff00:0:133, - 1-ff00:0:120, +
 // example sequence policy: 1-ff00:0:133#0 1-ff00:0:120#2,1 0 0 1-ff00:0:110#0
+// JSON objects are parsed as structured policy documents, see policyDocument.
 //
 // XXX(JordiSubira): Note that we expect as input either a ACL or a show path formatted sequence.
 // The show path format is a string with the following format:
 // <ingress> <ia> <egress> > <ingress> <ia> <egress> > ... <ingress> <ia> <egress>
 // this syntax is different from the one used in the sequence policy.
 // We may want to expect sequence policies directly in the future.
-func parsePolicy(b []byte) (pan.Policy, error) {
+func parsePolicy(b []byte, countries CountryMapping) (pan.Policy, error) {
+	if isPolicyDocument(b) {
+		return parsePolicyDocument(b, countries)
+	}
+
 	var acl pan.ACL
 	err := acl.UnmarshalJSON(b)
 	if err == nil {
@@ -404,13 +565,28 @@ func (p *dialerPool) Load(id string) (PANDialer, bool) {
 	return nil, false
 }
 
-// if the clean function returns true for a given id/dialer pair, it is deleted from the map
-func (p *dialerPool) Cleanup(clean func(id string, d PANDialer) bool) {
+// Dialers returns the dialers currently in the pool.
+func (p *dialerPool) Dialers() []PANDialer {
+	p.storeMu.Lock()
+	defer p.storeMu.Unlock()
+	dialers := make([]PANDialer, 0, len(p.store))
+	for _, d := range p.store {
+		dialers = append(dialers, d)
+	}
+	return dialers
+}
+
+// if the clean function returns true for a given id/dialer pair, it is deleted from the map.
+// Cleanup returns the number of deleted dialers.
+func (p *dialerPool) Cleanup(clean func(id string, d PANDialer) bool) int {
+	p.storeMu.Lock()
+	defer p.storeMu.Unlock()
+	deleted := 0
 	for id, d := range p.store {
 		if clean(id, d) {
-			p.storeMu.Lock()
 			delete(p.store, id)
-			defer p.storeMu.Unlock()
+			deleted++
 		}
 	}
+	return deleted
 }
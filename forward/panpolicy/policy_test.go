@@ -23,12 +23,14 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gorilla/securecookie"
 	"github.com/netsec-ethz/scion-apps/pkg/pan"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 
 	"github.com/scionproto-contrib/http-proxy/forward/session"
+	"github.com/scionproto-contrib/http-proxy/forward/utils"
 )
 
 type policyType int
@@ -99,7 +101,7 @@ func TestParsePolicy(t *testing.T) {
 
 	for name, c := range cases {
 		t.Run(name, func(t *testing.T) {
-			parsedPolicy, err := parsePolicy(c.policy)
+			parsedPolicy, err := parsePolicy(c.policy, nil)
 
 			if c.expectedErr {
 				require.Error(t, err, "expected an error but got none")
@@ -126,7 +128,7 @@ func TestParsePolicy(t *testing.T) {
 }
 
 func TestEnsurePolicyOnDialer(t *testing.T) {
-	m := NewPolicyManager(zap.NewNop(), 1*time.Second, true, 0, 0)
+	m := NewPolicyManager(zap.NewNop(), newTestSessionStore(), 1*time.Second, true, 0, 0)
 
 	// set new policy
 	method := http.MethodPut
@@ -174,12 +176,92 @@ func TestEnsurePolicyOnDialer(t *testing.T) {
 	require.NoError(t, err, "error creating request")
 	req.AddCookie(sessionCookie)
 
-	sessionData, err := session.GetSessionData(m.logger, req)
+	sessionData, err := m.sessionStore.GetSessionData(req)
 	require.NoError(t, err, "error getting session data")
 
 	assert.Equal(t, string(sessionData.Policy), rawPolicy, "session has wrong policy")
 }
 
+func TestGetAndDeletePolicy(t *testing.T) {
+	cases := map[string]struct {
+		policy       string
+		expectedBody string
+	}{
+		"ACL policy": {
+			policy:       `["+ 42", "-"]`,
+			expectedBody: `{"Type":"ACL","Policy":["+ 42","-"]}`,
+		},
+		"sequence policy": {
+			policy:       `"42-1 11>20 42-2"`,
+			expectedBody: `{"Type":"Sequence","Policy":"42-1 11>20 42-2","Sequence":"42-1 #11 42-2 #20"}`,
+		},
+		"structured policy": {
+			policy:       `{"version": 1, "acl": ["- 2", "+"], "preferences": ["latency"]}`,
+			expectedBody: `{"Type":"Structured","Policy":{"version":1,"acl":["- 2","+"],"preferences":["latency"]}}`,
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := NewPolicyManager(zap.NewNop(), newTestSessionStore(), 1*time.Second, true, 0, 0)
+
+			// no policy set yet
+			rr := httptest.NewRecorder()
+			err := m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+			require.NoError(t, err, "error serving HTTP request")
+			assert.JSONEq(t, `{"Type":"None"}`, rr.Body.String(), "handler returned unexpected body")
+
+			// set policy
+			rr = httptest.NewRecorder()
+			err = m.ServeHTTP(rr, httptest.NewRequest(http.MethodPut, "/", bytes.NewBufferString(c.policy)))
+			require.NoError(t, err, "error serving HTTP request")
+			sessionCookie := rr.Result().Cookies()[0]
+
+			// get policy
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.AddCookie(sessionCookie)
+			rr = httptest.NewRecorder()
+			err = m.ServeHTTP(rr, req)
+			require.NoError(t, err, "error serving HTTP request")
+			assert.Equal(t, http.StatusOK, rr.Code, "handler returned wrong status code")
+			assert.JSONEq(t, c.expectedBody, rr.Body.String(), "handler returned unexpected body")
+
+			// delete policy
+			req = httptest.NewRequest(http.MethodDelete, "/", nil)
+			req.AddCookie(sessionCookie)
+			rr = httptest.NewRecorder()
+			err = m.ServeHTTP(rr, req)
+			require.NoError(t, err, "error serving HTTP request")
+			assert.Equal(t, http.StatusOK, rr.Code, "handler returned wrong status code")
+			sessionCookie = rr.Result().Cookies()[0]
+
+			req = httptest.NewRequest(http.MethodGet, "/", nil)
+			req.AddCookie(sessionCookie)
+			sessionData, err := m.sessionStore.GetSessionData(req)
+			require.NoError(t, err, "error getting session data")
+			assert.Empty(t, sessionData.Policy, "session still has a policy")
+
+			d, err := m.GetDialer(sessionData, true)
+			require.NoError(t, err, "error getting dialer")
+			assert.Equal(t, m.sharedSDialer, d, "session does not use the shared dialer")
+
+			rr = httptest.NewRecorder()
+			err = m.ServeHTTP(rr, req)
+			require.NoError(t, err, "error serving HTTP request")
+			assert.JSONEq(t, `{"Type":"None"}`, rr.Body.String(), "handler returned unexpected body")
+		})
+	}
+}
+
+func TestPolicyEndpointMethodNotAllowed(t *testing.T) {
+	m := NewPolicyManager(zap.NewNop(), newTestSessionStore(), 1*time.Second, true, 0, 0)
+
+	err := m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+	var handlerErr *utils.HandlerError
+	require.ErrorAs(t, err, &handlerErr)
+	assert.Equal(t, http.StatusMethodNotAllowed, handlerErr.StatusCode)
+}
+
 type dialerType int
 
 const (
@@ -212,7 +294,7 @@ func TestGetDialerWithPolicy(t *testing.T) {
 
 	for name, c := range cases {
 		t.Run(name, func(t *testing.T) {
-			m := NewPolicyManager(zap.NewNop(), 1*time.Second, true, 0, 0)
+			m := NewPolicyManager(zap.NewNop(), newTestSessionStore(), 1*time.Second, true, 0, 0)
 			sd := session.SessionData{ID: "deadbeef", Policy: c.policy}
 
 			d, err := m.GetDialer(sd, c.useScion)
@@ -230,7 +312,7 @@ func TestGetDialerWithPolicy(t *testing.T) {
 					return
 				}
 
-				expectedPolicy, err := parsePolicy(c.policy)
+				expectedPolicy, err := parsePolicy(c.policy, nil)
 				require.NoError(t, err, "error parsing policy")
 
 				assert.True(t, reflect.DeepEqual(dd.GetPolicy(), expectedPolicy), "dialer has wrong policy")
@@ -269,7 +351,7 @@ func TestPurgeAbandonedDialers(t *testing.T) {
 	id := "deadbeef"
 	for name, c := range cases {
 		t.Run(name, func(t *testing.T) {
-			m := NewPolicyManager(zap.NewNop(), 1*time.Second, true, 0, 0)
+			m := NewPolicyManager(zap.NewNop(), newTestSessionStore(), 1*time.Second, true, 0, 0)
 			sd := session.SessionData{ID: id}
 			d := purgabelDialer{c.hasConnections, c.hasDialedRecently}
 
@@ -279,10 +361,30 @@ func TestPurgeAbandonedDialers(t *testing.T) {
 
 			_, ok := m.customSDialers.Load(id)
 			assert.Equal(t, c.expectedInMap, ok, "dialer presence in map does not match expectation")
+
+			runs, purged := m.PurgeStats()
+			assert.Equal(t, uint64(1), runs, "purge run not counted")
+			assert.Equal(t, !c.expectedInMap, purged == 1, "purged dialer not counted")
 		})
 	}
 }
 
+func TestPurgeSeveralAbandonedDialers(t *testing.T) {
+	m := NewPolicyManager(zap.NewNop(), newTestSessionStore(), 1*time.Second, true, 0, 0)
+	for _, id := range []string{"a", "b", "c"} {
+		m.customSDialers.Store(id, purgabelDialer{})
+	}
+	m.customSDialers.Store("d", purgabelDialer{hasConnections: true})
+
+	m.purgeAbandonedDialers()
+	m.purgeAbandonedDialers()
+
+	assert.Len(t, m.customSDialers.Dialers(), 1, "abandoned dialers were not purged")
+	runs, purged := m.PurgeStats()
+	assert.Equal(t, uint64(2), runs)
+	assert.Equal(t, uint64(3), purged)
+}
+
 type purgabelDialer struct {
 	hasConnections    bool
 	hasDialedRecently bool
@@ -306,10 +408,13 @@ func TestNewPolicyManager(t *testing.T) {
 	purgeTimeout := 5 * time.Minute
 	purgeInterval := 10 * time.Minute
 
-	m := NewPolicyManager(logger, dialTimeout, purge, purgeTimeout, purgeInterval)
+	sessionStore := newTestSessionStore()
+
+	m := NewPolicyManager(logger, sessionStore, dialTimeout, purge, purgeTimeout, purgeInterval)
 
 	assert.NotNil(t, m, "NewPolicyManager returned nil")
 	assert.Equal(t, logger, m.logger, "logger does not match")
+	assert.Equal(t, sessionStore, m.sessionStore, "sessionStore does not match")
 	assert.Equal(t, dialTimeout, m.dialTimeout, "dialTimeout does not match")
 	assert.Equal(t, purge, m.purge, "purge does not match")
 	assert.Equal(t, purgeTimeout, m.purgeTimeout, "purgeTimeout does not match")
@@ -326,7 +431,7 @@ func TestStartAndStopPolicyManager(t *testing.T) {
 	purgeTimeout := 5 * time.Minute
 	purgeInterval := 10 * time.Minute
 
-	m := NewPolicyManager(logger, dialTimeout, purge, purgeTimeout, purgeInterval)
+	m := NewPolicyManager(logger, newTestSessionStore(), dialTimeout, purge, purgeTimeout, purgeInterval)
 
 	err := m.Start()
 	require.NoError(t, err, "error starting policy manager")
@@ -336,3 +441,7 @@ func TestStartAndStopPolicyManager(t *testing.T) {
 	err = m.Stop()
 	require.NoError(t, err, "error stopping policy manager")
 }
+
+func newTestSessionStore() session.SessionStore {
+	return session.NewCookieStore(zap.NewNop(), securecookie.GenerateRandomKey(32))
+}
@@ -0,0 +1,139 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panpolicy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
+	"go.uber.org/zap"
+)
+
+var _ PANDialer = (*RacingDialer)(nil)
+
+// transportRecorder is implemented by dialers that keep track of the transport
+// that was eventually used to reach a destination.
+type transportRecorder interface {
+	RecordTransport(addr string, transport transportType)
+}
+
+// RacingDialer races a SCION dial against a TCP/IP dial to the same destination
+// and returns whichever connection is established first, closing the other one.
+// Similar to Happy Eyeballs (RFC 8305), SCION is given a head start, so that it
+// is preferred whenever both transports are healthy. All policy and metrics
+// related operations are delegated to the SCION dialer.
+type RacingDialer struct {
+	scionDialer PANDialer
+	stdDialer   PANDialer
+	headStart   time.Duration
+
+	logger *zap.Logger
+}
+
+func NewRacingDialer(logger *zap.Logger, scionDialer, stdDialer PANDialer, headStart time.Duration) *RacingDialer {
+	return &RacingDialer{
+		scionDialer: scionDialer,
+		stdDialer:   stdDialer,
+		headStart:   headStart,
+		logger:      logger,
+	}
+}
+
+type dialResult struct {
+	conn      net.Conn
+	err       error
+	transport transportType
+}
+
+func (d *RacingDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	log := d.logger.With(zap.String("network", network), zap.String("addr", addr))
+
+	ctxRace, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resultc := make(chan dialResult, 2)
+	scionFailed := make(chan struct{})
+	go func() {
+		conn, err := d.scionDialer.DialContext(ctxRace, network, addr)
+		if err != nil {
+			close(scionFailed)
+		}
+		resultc <- dialResult{conn, err, transportSCION}
+	}()
+	go func() {
+		timer := time.NewTimer(d.headStart)
+		defer timer.Stop()
+
+		// start immediately if SCION already failed, otherwise wait for the head start to elapse
+		select {
+		case <-ctxRace.Done():
+			resultc <- dialResult{nil, ctxRace.Err(), transportIP}
+			return
+		case <-scionFailed:
+		case <-timer.C:
+		}
+		conn, err := d.stdDialer.DialContext(ctxRace, network, addr)
+		resultc <- dialResult{conn, err, transportIP}
+	}()
+
+	var errs []error
+	for i := 0; i < 2; i++ {
+		res := <-resultc
+		if res.err != nil {
+			errs = append(errs, res.err)
+			continue
+		}
+
+		if i == 0 {
+			// close the loser once it is done, the race context is cancelled on return
+			go func() {
+				if loser := <-resultc; loser.conn != nil {
+					_ = loser.conn.Close()
+				}
+			}()
+		}
+
+		log.Debug("Won dial race.", zap.String("transport", string(res.transport)))
+		if r, ok := d.scionDialer.(transportRecorder); ok {
+			r.RecordTransport(addr, res.transport)
+		}
+		return res.conn, nil
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+func (d *RacingDialer) SetPolicy(policy pan.Policy) error {
+	return d.scionDialer.SetPolicy(policy)
+}
+
+func (d *RacingDialer) GetPolicy() pan.Policy {
+	return d.scionDialer.GetPolicy()
+}
+
+func (d *RacingDialer) GetMetrics(filteredAddrs []string) (*DialerMetrics, error) {
+	return d.scionDialer.GetMetrics(filteredAddrs)
+}
+
+func (d *RacingDialer) HasOpenConnections() (bool, error) {
+	return d.scionDialer.HasOpenConnections()
+}
+
+func (d *RacingDialer) HasDialedWithinTimeWindow(t time.Duration) (bool, error) {
+	return d.scionDialer.HasDialedWithinTimeWindow(t)
+}
@@ -0,0 +1,136 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panpolicy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRacingDialer(t *testing.T) {
+	errDial := errors.New("dial failed")
+
+	cases := map[string]struct {
+		scionDelay        time.Duration
+		scionErr          error
+		stdDelay          time.Duration
+		stdErr            error
+		headStart         time.Duration
+		expectedErr       bool
+		expectedTransport transportType
+		expectedStdDial   bool
+	}{
+		"scion wins within head start": {
+			scionDelay:        10 * time.Millisecond,
+			headStart:         200 * time.Millisecond,
+			expectedTransport: transportSCION,
+			expectedStdDial:   false,
+		},
+		"ip wins if scion is slow": {
+			scionDelay:        time.Second,
+			headStart:         10 * time.Millisecond,
+			expectedTransport: transportIP,
+			expectedStdDial:   true,
+		},
+		"ip starts early if scion fails": {
+			scionErr:          errDial,
+			headStart:         time.Hour,
+			expectedTransport: transportIP,
+			expectedStdDial:   true,
+		},
+		"both fail": {
+			scionErr:        errDial,
+			stdErr:          errDial,
+			headStart:       10 * time.Millisecond,
+			expectedErr:     true,
+			expectedStdDial: true,
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			scion := NewSCIONDialer(zap.NewNop(), time.Minute, false)
+			scion.dialSCION = &delayedDialer{delay: c.scionDelay, err: c.scionErr}
+			std := &delayedDialer{delay: c.stdDelay, err: c.stdErr}
+			d := NewRacingDialer(zap.NewNop(), scion, std, c.headStart)
+
+			conn, err := d.DialContext(context.Background(), "tcp", "addr1")
+			assert.Equal(t, c.expectedStdDial, std.dialCalled.Load(), "racing dialer started TCP/IP at the wrong time")
+			if c.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, conn)
+
+			assert.Equal(t, c.expectedTransport, scion.lastTransportForAddr["addr1"], "racing dialer recorded wrong transport")
+		})
+	}
+}
+
+func TestRacingDialerClosesLoser(t *testing.T) {
+	scion := &delayedDialer{delay: 100 * time.Millisecond}
+	std := &delayedDialer{}
+	d := NewRacingDialer(zap.NewNop(), scion, std, 0)
+
+	_, err := d.DialContext(context.Background(), "tcp", "addr1")
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return scion.closed.Load()
+	}, time.Second, 10*time.Millisecond, "losing connection was not closed")
+}
+
+// delayedDialer returns a connection after delay, regardless of context cancellation,
+// simulating a dial that completes after the race was decided.
+type delayedDialer struct {
+	delay      time.Duration
+	err        error
+	dialCalled atomic.Bool
+	closed     atomic.Bool
+}
+
+func (d *delayedDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	d.dialCalled.Store(true)
+	time.Sleep(d.delay)
+	if d.err != nil {
+		return nil, d.err
+	}
+	return &closeRecordingConn{closed: &d.closed}, nil
+}
+func (d *delayedDialer) GetMetrics(filteredAddrs []string) (*DialerMetrics, error) { return nil, nil }
+func (d *delayedDialer) SetPolicy(policy pan.Policy) error                         { return nil }
+func (d *delayedDialer) GetPolicy() pan.Policy                                     { return nil }
+func (d *delayedDialer) HasOpenConnections() (bool, error)                         { return true, nil }
+func (d *delayedDialer) HasDialedWithinTimeWindow(t time.Duration) (bool, error)   { return true, nil }
+
+type closeRecordingConn struct {
+	net.Conn
+	closed *atomic.Bool
+}
+
+func (c *closeRecordingConn) Close() error {
+	c.closed.Store(true)
+	return nil
+}
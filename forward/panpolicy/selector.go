@@ -0,0 +1,171 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package panpolicy
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
+)
+
+var _ pan.Selector = (*qualitySelector)(nil)
+
+// qualitySelector is a pan.Selector using the path with the best quality according to
+// the path metadata, e.g., the lowest advertised latency. Whenever the paths are refreshed,
+// the best path is selected again. Upon a down notification for the current path, it
+// switches to the next best path not affected by the notification.
+type qualitySelector struct {
+	order pan.Policy
+	// start is the rank of the path selected initially
+	start int
+
+	mutex   sync.Mutex
+	paths   []*pan.Path
+	current int
+}
+
+// newQualitySelector creates a selector ranking the paths by the sort order of a
+// preference policy, e.g., pan.LowestLatency.
+func newQualitySelector(order pan.Policy) *qualitySelector {
+	return &qualitySelector{order: order}
+}
+
+// newStripeSelector creates a selector for the subflow with the given index of a
+// multipath connection. The subflows use the paths in the order of disjointPaths,
+// hence each subflow starts on a path sharing as few interfaces as possible with
+// the paths of the preceding subflows.
+func newStripeSelector(index int) *qualitySelector {
+	return &qualitySelector{order: disjointPaths{}, start: index}
+}
+
+func (s *qualitySelector) Path() *pan.Path {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.paths) == 0 {
+		return nil
+	}
+	return s.paths[s.current]
+}
+
+func (s *qualitySelector) Initialize(local, remote pan.UDPAddr, paths []*pan.Path) {
+	s.Refresh(paths)
+}
+
+func (s *qualitySelector) Refresh(paths []*pan.Path) {
+	ranked := s.rank(paths)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.paths = ranked
+	s.current = 0
+	if len(ranked) != 0 {
+		s.current = s.start % len(ranked)
+	}
+}
+
+// numPaths returns the number of paths available to the selector.
+func (s *qualitySelector) numPaths() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.paths)
+}
+
+func (s *qualitySelector) PathDown(pf pan.PathFingerprint, pi pan.PathInterface) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.paths) == 0 || !isAffected(s.paths[s.current], pf, pi) {
+		return
+	}
+	for i := 1; i < len(s.paths); i++ {
+		next := (s.current + i) % len(s.paths)
+		if !isAffected(s.paths[next], pf, pi) {
+			s.current = next
+			return
+		}
+	}
+}
+
+func (s *qualitySelector) Close() error {
+	return nil
+}
+
+// rank sorts the paths by the order, paths without metadata cannot be compared and are
+// ranked last.
+func (s *qualitySelector) rank(paths []*pan.Path) []*pan.Path {
+	var withMetadata, withoutMetadata []*pan.Path
+	for _, p := range paths {
+		if p.Metadata == nil {
+			withoutMetadata = append(withoutMetadata, p)
+			continue
+		}
+		withMetadata = append(withMetadata, p)
+	}
+	return append(s.order.Filter(withMetadata), withoutMetadata...)
+}
+
+// disjointPaths orders the paths such that each path shares as few interfaces as
+// possible with the preceding paths, ties keep the original order of the paths.
+type disjointPaths struct{}
+
+func (disjointPaths) Filter(paths []*pan.Path) []*pan.Path {
+	remaining := slices.Clone(paths)
+	ordered := make([]*pan.Path, 0, len(paths))
+	used := make(map[pan.PathInterface]bool)
+	for len(remaining) > 0 {
+		best, bestShared := 0, -1
+		for i, p := range remaining {
+			shared := 0
+			if p.Metadata != nil {
+				for _, intf := range p.Metadata.Interfaces {
+					if used[intf] {
+						shared++
+					}
+				}
+			}
+			if bestShared < 0 || shared < bestShared {
+				best, bestShared = i, shared
+			}
+		}
+		p := remaining[best]
+		ordered = append(ordered, p)
+		remaining = slices.Delete(remaining, best, best+1)
+		if p.Metadata != nil {
+			for _, intf := range p.Metadata.Interfaces {
+				used[intf] = true
+			}
+		}
+	}
+	return ordered
+}
+
+func isAffected(p *pan.Path, pf pan.PathFingerprint, pi pan.PathInterface) bool {
+	if p.Fingerprint == pf {
+		return true
+	}
+	if p.Metadata == nil {
+		return false
+	}
+	for _, intf := range p.Metadata.Interfaces {
+		if intf == pi {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package panpolicy
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/scionproto-contrib/http-proxy/forward/session"
+)
+
+func newSelectorTestPath(fingerprint string, latency time.Duration, bandwidth uint64, ias ...string) *pan.Path {
+	intfs := make([]pan.PathInterface, 0, 2*(len(ias)-1))
+	for i := 0; i < len(ias)-1; i++ {
+		intfs = append(intfs,
+			pan.PathInterface{IA: pan.MustParseIA(ias[i]), IfID: pan.IfID(2*i + 1)},
+			pan.PathInterface{IA: pan.MustParseIA(ias[i+1]), IfID: pan.IfID(2*i + 2)},
+		)
+	}
+	latencies := make([]time.Duration, len(intfs)-1)
+	bandwidths := make([]uint64, len(intfs)-1)
+	for i := range latencies {
+		latencies[i] = latency
+		bandwidths[i] = bandwidth
+	}
+	return &pan.Path{
+		Fingerprint: pan.PathFingerprint(fingerprint),
+		Metadata: &pan.PathMetadata{
+			Interfaces: intfs,
+			Latency:    latencies,
+			Bandwidth:  bandwidths,
+		},
+	}
+}
+
+func TestQualitySelector(t *testing.T) {
+	short := newSelectorTestPath("short", 30*time.Millisecond, 100, "1-1", "1-2")
+	fast := newSelectorTestPath("fast", 5*time.Millisecond, 10, "1-1", "1-3", "1-2")
+	wide := newSelectorTestPath("wide", 20*time.Millisecond, 1000, "1-1", "1-4", "1-2")
+	noMetadata := &pan.Path{Fingerprint: "none"}
+
+	cases := map[string]struct {
+		strategy     preference
+		expectedPath *pan.Path
+	}{
+		"lowest latency":    {preferLatency, fast},
+		"highest bandwidth": {preferBandwidth, wide},
+		"fewest hops":       {preferHops, short},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			s, err := c.strategy.newSelector()
+			require.NoError(t, err)
+
+			s.Initialize(pan.UDPAddr{}, pan.UDPAddr{}, []*pan.Path{noMetadata, short, fast, wide})
+			assert.Equal(t, c.expectedPath, s.Path(), "selector did not select the best path")
+		})
+	}
+}
+
+func TestQualitySelectorFailover(t *testing.T) {
+	fast := newSelectorTestPath("fast", 5*time.Millisecond, 10, "1-1", "1-3", "1-2")
+	slow := newSelectorTestPath("slow", 20*time.Millisecond, 10, "1-1", "1-4", "1-2")
+	slower := newSelectorTestPath("slower", 30*time.Millisecond, 10, "1-1", "1-3", "1-4", "1-2")
+
+	s := newQualitySelector(pan.LowestLatency{})
+	assert.Nil(t, s.Path(), "uninitialized selector should not select a path")
+
+	s.Initialize(pan.UDPAddr{}, pan.UDPAddr{}, []*pan.Path{slower, slow, fast})
+	require.Equal(t, fast, s.Path())
+
+	// unrelated notification
+	s.PathDown("other", pan.PathInterface{IA: pan.MustParseIA("1-5"), IfID: 1})
+	assert.Equal(t, fast, s.Path(), "selector switched path on unrelated notification")
+
+	// interface 1-3#2 is on the fast and the slower path
+	s.PathDown("", fast.Metadata.Interfaces[1])
+	assert.Equal(t, slow, s.Path(), "selector did not fail over to the next best unaffected path")
+
+	// refreshing selects the best path again
+	s.Refresh([]*pan.Path{slow, fast})
+	assert.Equal(t, fast, s.Path(), "selector did not select the best path after refresh")
+}
+
+func TestSelectionStrategyOnDialer(t *testing.T) {
+	m := NewPolicyManager(zap.NewNop(), newTestSessionStore(), 1*time.Second, true, 0, 0)
+
+	sd := session.SessionData{ID: "deadbeef", Policy: []byte(`{"version": 1, "strategy": "bandwidth"}`)}
+	d, err := m.GetDialer(sd, true)
+	require.NoError(t, err)
+	dd, ok := d.(*SCIONDialer)
+	require.True(t, ok, "get dialer returned wrong dialer type")
+	assert.Equal(t, preferBandwidth, dd.strategy, "dialer has wrong strategy")
+	assert.NotNil(t, dd.dialSCION.(*internalSCIONDialer).newSelector, "internal dialer has no selector")
+
+	// switching back to a policy without strategy restores the default selector
+	sd.Policy = []byte(`["+"]`)
+	_, err = m.GetDialer(sd, true)
+	require.NoError(t, err)
+	assert.Equal(t, preference(""), dd.strategy, "dialer has wrong strategy")
+	assert.Nil(t, dd.dialSCION.(*internalSCIONDialer).newSelector, "internal dialer still has a selector")
+
+	// the shared dialer has no strategy
+	shared := NewSCIONDialer(zap.NewNop(), 1*time.Second, true)
+	assert.ErrorIs(t, shared.setSelectionStrategy(preferLatency), ErrInvalidOperation)
+}
+
+func TestSelectionStrategyConcurrentRequests(t *testing.T) {
+	m := NewPolicyManager(zap.NewNop(), newTestSessionStore(), 1*time.Second, true, 0, 0)
+	policies := [][]byte{[]byte(`{"version": 1, "strategy": "bandwidth"}`), []byte(`["+"]`)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d, err := m.GetDialer(session.SessionData{ID: "deadbeef", Policy: policies[i%2]}, true)
+			assert.NoError(t, err)
+			m.SetMultipathSubflows(i)
+			_, _ = d.GetMetrics(nil)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStripeSelector(t *testing.T) {
+	viaA := newSelectorTestPath("viaA", 5*time.Millisecond, 10, "1-1", "1-3", "1-2")
+	viaAB := newSelectorTestPath("viaAB", 5*time.Millisecond, 10, "1-1", "1-3", "1-4", "1-2")
+	viaC := newSelectorTestPath("viaC", 20*time.Millisecond, 10, "1-1", "1-5", "1-2")
+	paths := []*pan.Path{viaA, viaAB, viaC}
+
+	// viaAB shares the first hop with viaA, hence the disjoint viaC is used first
+	assert.Equal(t, []*pan.Path{viaA, viaC, viaAB}, disjointPaths{}.Filter(paths))
+
+	cases := map[string]struct {
+		index        int
+		expectedPath *pan.Path
+	}{
+		"first subflow":            {0, viaA},
+		"second subflow":           {1, viaC},
+		"third subflow":            {2, viaAB},
+		"more subflows than paths": {3, viaA},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			s := newStripeSelector(c.index)
+			s.Initialize(pan.UDPAddr{}, pan.UDPAddr{}, paths)
+			assert.Equal(t, c.expectedPath, s.Path(), "subflow uses wrong path")
+			assert.Equal(t, len(paths), s.numPaths())
+		})
+	}
+}
+
+func TestMultipathOnDialer(t *testing.T) {
+	m := NewPolicyManager(zap.NewNop(), newTestSessionStore(), 1*time.Second, true, 0, 0)
+	m.SetMultipathSubflows(3)
+
+	shared := m.sharedSDialer.(*SCIONDialer)
+	assert.Equal(t, 3, shared.dialSCION.(*internalSCIONDialer).multipathSubflows, "shared dialer has wrong subflows")
+
+	d, err := m.GetDialer(session.SessionData{ID: "deadbeef", Policy: []byte(`["+"]`)}, true)
+	require.NoError(t, err)
+	custom := d.(*SCIONDialer)
+	assert.Equal(t, 3, custom.dialSCION.(*internalSCIONDialer).multipathSubflows, "custom dialer has wrong subflows")
+
+	assert.True(t, multipathRequested(WithMultipath(context.Background())))
+	assert.False(t, multipathRequested(context.Background()))
+}
@@ -16,17 +16,25 @@ package panpolicy
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"reflect"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/netsec-ethz/scion-apps/pkg/pan"
 	"github.com/netsec-ethz/scion-apps/pkg/quicutil"
 	"github.com/netsec-ethz/scion-apps/pkg/shttp"
 	"go.uber.org/zap"
+
+	"github.com/scionproto-contrib/http-proxy/networks/multipath"
 )
 
 // Interface guards
@@ -36,16 +44,124 @@ var (
 	_ PANDialer = (*internalSCIONDialer)(nil)
 
 	_ pathAwareConn = (*quicutil.SingleStream)(nil)
+
+	_ transportRecorder = (*SCIONDialer)(nil)
+
+	_ aggregateReporter = (*SCIONDialer)(nil)
+
+	_ strategySetter = (*SCIONDialer)(nil)
+	_ strategySetter = (*internalSCIONDialer)(nil)
+
+	_ multipathSetter = (*SCIONDialer)(nil)
+	_ multipathSetter = (*internalSCIONDialer)(nil)
+
+	_ connectionCounter = (*SCIONDialer)(nil)
+
+	_ upstreamSetter = (*StdDialer)(nil)
 )
 
+// connectionCounter is implemented by dialers tracking their open connections.
+type connectionCounter interface {
+	OpenConnections() int
+}
+
+// strategySetter is implemented by dialers whose path selection strategy can be chosen.
+type strategySetter interface {
+	setSelectionStrategy(strategy preference) error
+}
+
+// multipathSetter is implemented by dialers able to stripe connections over several paths.
+type multipathSetter interface {
+	setMultipathSubflows(subflows int)
+}
+
+type multipathKey struct{}
+
+// WithMultipath marks the connections dialed with the returned context to be striped
+// over several paths, if enabled on the dialer and supported by the destination.
+// This is meant for long-lived bulk transfers, e.g., CONNECT tunnels.
+func WithMultipath(ctx context.Context) context.Context {
+	return context.WithValue(ctx, multipathKey{}, true)
+}
+
+func multipathRequested(ctx context.Context) bool {
+	requested, _ := ctx.Value(multipathKey{}).(bool)
+	return requested
+}
+
+type addressCheckKey struct{}
+
+// WithAddressCheck makes StdDialer check the addresses it connects to with the returned
+// context, once the host name is resolved, also locally if it is dialed through a parent
+// proxy, see UpstreamRule. Connections to addresses failing the check are
+// not attempted, the error of the check is returned by the dial.
+func WithAddressCheck(ctx context.Context, check func(netip.AddrPort) error) context.Context {
+	return context.WithValue(ctx, addressCheckKey{}, check)
+}
+
+func checkAddress(ctx context.Context, network, address string, _ syscall.RawConn) error {
+	check, ok := ctx.Value(addressCheckKey{}).(func(netip.AddrPort) error)
+	if !ok {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	return check(addrPort)
+}
+
+// checkHost checks the addresses of the destination, resolving host names locally, before
+// it is dialed through a parent proxy, which does not call back to checkAddress. The check
+// fails if the host name cannot be resolved.
+func checkHost(ctx context.Context, addr string) error {
+	check, ok := ctx.Value(addressCheckKey{}).(func(netip.AddrPort) error)
+	if !ok {
+		return nil
+	}
+	if addrPort, err := netip.ParseAddrPort(addr); err == nil {
+		return check(addrPort)
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %s: %w", portStr, err)
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("resolving %s to check its addresses: %w", host, err)
+	}
+	for _, ip := range ips {
+		if err := check(netip.AddrPortFrom(ip.Unmap(), uint16(port))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upstreamSetter is implemented by dialers that can dial through parent proxies.
+type upstreamSetter interface {
+	setUpstream(upstream *Upstream)
+}
+
 type SCIONDialer struct {
 	dialSCION   PANDialer
 	dialTimeout time.Duration
 
-	connectionTracker   *connectionTracker
-	lastUsedPathForAddr map[string]*pathInfo
+	connectionTracker *connectionTracker
+	health            *pathHealth
+	dialStats         *dialStats
 
-	lastDial *time.Time
+	// mu guards the selection strategy, the paths and transports last used and the
+	// time of the last dial
+	mu                   sync.Mutex
+	strategy             preference
+	lastUsedPathForAddr  map[string]*pathInfo
+	lastTransportForAddr map[string]transportType
+	lastDial             *time.Time
 
 	shared bool
 
@@ -64,15 +180,19 @@ type pathAwareConn interface {
 }
 
 func NewSCIONDialer(logger *zap.Logger, dialTimeout time.Duration, shared bool) *SCIONDialer {
+	health := newPathHealth(pathDownTimeout)
 	return &SCIONDialer{
-		dialSCION:   &internalSCIONDialer{dialer: &shttp.Dialer{}},
+		dialSCION:   &internalSCIONDialer{dialer: &shttp.Dialer{}, health: health},
 		dialTimeout: dialTimeout,
 		connectionTracker: &connectionTracker{
 			conns: make(map[string]map[net.Conn]struct{}),
 		},
-		lastUsedPathForAddr: make(map[string]*pathInfo),
-		shared:              shared,
-		logger:              logger,
+		health:               health,
+		dialStats:            newDialStats(),
+		lastUsedPathForAddr:  make(map[string]*pathInfo),
+		lastTransportForAddr: make(map[string]transportType),
+		shared:               shared,
+		logger:               logger,
 	}
 }
 
@@ -97,6 +217,7 @@ func (d *SCIONDialer) DialContext(ctx context.Context, network string, addr stri
 	connc, errc := make(chan net.Conn, 1), make(chan error, 1)
 	go func() {
 		conn, err := d.dialSCION.DialContext(ctxTimeout, network, addr)
+		d.dialStats.Record(dialedIA(addr, conn, err), err)
 		if err != nil {
 			errc <- err
 			return
@@ -119,7 +240,9 @@ func (d *SCIONDialer) DialContext(ctx context.Context, network string, addr stri
 			}
 
 			pi := &pathInfo{panConn.GetPath(), ia}
+			d.mu.Lock()
 			d.lastUsedPathForAddr[addr] = pi
+			d.mu.Unlock()
 			log.Debug("Using path.",
 				zap.String("addr", addr),
 				zap.String("path", strings.Join(hopsToPathHops(pi), ",")))
@@ -127,24 +250,77 @@ func (d *SCIONDialer) DialContext(ctx context.Context, network string, addr stri
 		}
 
 		t := time.Now()
+		d.mu.Lock()
 		d.lastDial = &t
+		d.mu.Unlock()
 
 		return conn, nil
 	}
 }
 
+// dialError is returned by internalSCIONDialer once the destination is resolved.
+type dialError struct {
+	ia  pan.IA
+	err error
+}
+
+func (e *dialError) Error() string {
+	return e.err.Error()
+}
+
+func (e *dialError) Unwrap() error {
+	return e.err
+}
+
+// dialedIA returns the ISD-AS of a dialed destination, or 0 if it is unknown.
+func dialedIA(addr string, conn net.Conn, err error) pan.IA {
+	var de *dialError
+	if errors.As(err, &de) {
+		return de.ia
+	}
+	if panConn, ok := conn.(pathAwareConn); ok {
+		return destinationIA(addr, panConn)
+	}
+	return destinationIA(addr, nil)
+}
+
+// destinationIA returns the ISD-AS of the connection's path, or of addr if it is a
+// SCION address.
+func destinationIA(addr string, conn pathAwareConn) pan.IA {
+	if conn != nil {
+		if path := conn.GetPath(); path != nil {
+			return path.Destination
+		}
+	}
+	if udpAddr, err := pan.ParseUDPAddr(addr); err == nil {
+		return udpAddr.IA
+	}
+	return 0
+}
+
 var ErrNoConnections = fmt.Errorf("dialer has no open connections")
 
 type DialerMetrics struct {
 	policy   pan.Policy
+	strategy preference
 	connInfo []*ConnInfo
 }
 
 type ConnInfo struct {
-	Addr     string
-	PathInfo *pathInfo
+	Addr      string
+	PathInfo  *pathInfo
+	Transport transportType
 }
 
+// transportType is the transport a connection was eventually established over.
+// It is only recorded if TCP/IP is an alternative to SCION, see FallbackDialer and RacingDialer.
+type transportType string
+
+const (
+	transportSCION transportType = "SCION"
+	transportIP    transportType = "IP"
+)
+
 func (d *SCIONDialer) GetMetrics(filteredAddrs []string) (*DialerMetrics, error) {
 	if d.shared {
 		// wont share any paths for the shared dialer
@@ -152,8 +328,11 @@ func (d *SCIONDialer) GetMetrics(filteredAddrs []string) (*DialerMetrics, error)
 		return &DialerMetrics{}, nil
 	}
 
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
 	panConnsPerAddr := d.connectionTracker.GetAllConnections()
-	if len(panConnsPerAddr) == 0 {
+	if len(panConnsPerAddr) == 0 && len(d.lastTransportForAddr) == 0 {
 		return nil, ErrNoConnections
 	}
 
@@ -173,13 +352,28 @@ func (d *SCIONDialer) GetMetrics(filteredAddrs []string) (*DialerMetrics, error)
 	}
 
 	var connInfos []*ConnInfo
+	for addr, transport := range d.lastTransportForAddr {
+		if transport != transportIP {
+			continue
+		}
+		// destinations last reached over TCP/IP have no SCION path to report
+		delete(panConnsPerAddr, addr)
+		if len(filteredAddrs) == 0 || slices.Contains(filteredAddrs, addr) {
+			connInfos = append(connInfos, &ConnInfo{
+				Addr:      addr,
+				Transport: transportIP,
+			})
+		}
+	}
+
 	for addr, conns := range panConnsPerAddr {
 		if len(conns) == 0 {
 			// no open connection, checking for last used
 			if lastUsedPath, ok := d.lastUsedPathForAddr[addr]; ok {
 				connInfos = append(connInfos, &ConnInfo{
-					Addr:     addr,
-					PathInfo: lastUsedPath,
+					Addr:      addr,
+					PathInfo:  lastUsedPath,
+					Transport: d.lastTransportForAddr[addr],
 				})
 			}
 			continue
@@ -199,8 +393,9 @@ func (d *SCIONDialer) GetMetrics(filteredAddrs []string) (*DialerMetrics, error)
 
 		path := panConn.GetPath()
 		connInfos = append(connInfos, &ConnInfo{
-			Addr:     addr,
-			PathInfo: &pathInfo{path, ia},
+			Addr:      addr,
+			PathInfo:  &pathInfo{path, ia},
+			Transport: d.lastTransportForAddr[addr],
 		})
 
 		for i, conn := range conns {
@@ -222,6 +417,7 @@ func (d *SCIONDialer) GetMetrics(filteredAddrs []string) (*DialerMetrics, error)
 	}
 	if !d.shared {
 		dm.policy = d.dialSCION.GetPolicy()
+		dm.strategy = d.strategy
 	}
 
 	return dm, nil
@@ -237,7 +433,9 @@ func (d *SCIONDialer) SetPolicy(policy pan.Policy) error {
 
 	if !reflect.DeepEqual(d.dialSCION.GetPolicy(), policy) {
 		// clear cached paths, to avoid inconsistenies
+		d.mu.Lock()
 		d.lastUsedPathForAddr = make(map[string]*pathInfo)
+		d.mu.Unlock()
 	}
 	return d.dialSCION.SetPolicy(policy)
 }
@@ -251,6 +449,55 @@ func (d *SCIONDialer) GetPolicy() pan.Policy {
 	return d.dialSCION.GetPolicy()
 }
 
+// setSelectionStrategy sets the strategy selecting the paths of new connections,
+// the empty strategy restores the default selector of pan.
+func (d *SCIONDialer) setSelectionStrategy(strategy preference) error {
+	if d.shared && strategy != "" {
+		// cant set a strategy on the shared dialer
+		return ErrInvalidOperation
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if strategy == d.strategy {
+		return nil
+	}
+
+	ss, ok := d.dialSCION.(strategySetter)
+	if !ok {
+		return ErrInvalidOperation
+	}
+	if err := ss.setSelectionStrategy(strategy); err != nil {
+		return err
+	}
+	d.strategy = strategy
+	return nil
+}
+
+// setMultipathSubflows sets the maximum number of paths a connection dialed with
+// WithMultipath is striped over, values below two disable multipath.
+func (d *SCIONDialer) setMultipathSubflows(subflows int) {
+	if ms, ok := d.dialSCION.(multipathSetter); ok {
+		ms.setMultipathSubflows(subflows)
+	}
+}
+
+// PathHealth returns the path health of the destinations dialed, i.e., the number of
+// paths that went down recently and the number of failovers of open connections.
+func (d *SCIONDialer) PathHealth() []DestinationHealth {
+	return d.health.Snapshot()
+}
+
+// RecordTransport records over which transport the destination was eventually reached.
+func (d *SCIONDialer) RecordTransport(addr string, transport transportType) {
+	if d.shared {
+		// the metrics of the shared dialer report no destinations
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastTransportForAddr[addr] = transport
+}
+
 func (d *SCIONDialer) HasOpenConnections() (bool, error) {
 	for _, cs := range d.connectionTracker.GetAllConnections() {
 		if len(cs) > 0 {
@@ -260,35 +507,187 @@ func (d *SCIONDialer) HasOpenConnections() (bool, error) {
 	return false, nil
 }
 
+// OpenConnections returns the number of open connections of the dialer.
+func (d *SCIONDialer) OpenConnections() int {
+	n := 0
+	for _, cs := range d.connectionTracker.GetAllConnections() {
+		n += len(cs)
+	}
+	return n
+}
+
 func (d *SCIONDialer) HasDialedWithinTimeWindow(window time.Duration) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	return d.lastDial != nil && time.Since(*d.lastDial) < window, nil
 }
 
 // internalSCIONDialer wraps shttp.Dialer and implement a usable interface (required for testing)
 type internalSCIONDialer struct {
 	dialer *shttp.Dialer
+	// health records the paths going down per destination, the selector of each
+	// connection is wrapped to avoid these paths and to report failovers
+	health *pathHealth
+
+	// optionsMu guards the policy of the dialer and the options below, which are set on
+	// every request while connections are dialed
+	optionsMu sync.Mutex
+	// newSelector creates the path selector of a new connection, if nil the default
+	// selector of pan is used
+	newSelector func() (pan.Selector, error)
+	// multipathSubflows is the maximum number of paths of a multipath connection
+	multipathSubflows int
+
+	sessionsMu sync.Mutex
+	sessions   []*pan.QUICSession
+}
+
+func (d *internalSCIONDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	remote, err := pan.ResolveUDPAddr(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.dial(ctx, addr, remote)
+	if err != nil {
+		return nil, &dialError{ia: remote.IA, err: err}
+	}
+	return conn, nil
 }
 
-func (d internalSCIONDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
-	return d.dialer.DialContext(ctx, network, addr)
+func (d *internalSCIONDialer) dial(ctx context.Context, addr string, remote pan.UDPAddr) (net.Conn, error) {
+	d.optionsMu.Lock()
+	newSelector, subflows := d.newSelector, d.multipathSubflows
+	d.optionsMu.Unlock()
+
+	var err error
+	if subflows > 1 && multipathRequested(ctx) {
+		return d.dialMultipath(ctx, addr, remote, subflows)
+	}
+
+	var selector pan.Selector = pan.NewDefaultSelector()
+	if newSelector != nil {
+		if selector, err = newSelector(); err != nil {
+			return nil, err
+		}
+	}
+	return d.dialStream(ctx, addr, remote, d.withHealth(selector, addr), quicutil.SingleStreamProto)
+}
+
+// dialMultipath stripes the connection over up to maxSubflows paths, which are as disjoint
+// as possible, see newStripeSelector. The subflows are dialed with multipath.Proto, if the
+// destination does not support it, the first subflow is used as single stream.
+// The selection strategy does not apply to multipath connections.
+func (d *internalSCIONDialer) dialMultipath(ctx context.Context, addr string, remote pan.UDPAddr, maxSubflows int) (net.Conn, error) {
+	first := newStripeSelector(0)
+	stream, err := d.dialStream(ctx, addr, remote, d.withHealth(first, addr), multipath.Proto, quicutil.SingleStreamProto)
+	if err != nil {
+		return nil, err
+	}
+	if stream.Connection.ConnectionState().TLS.NegotiatedProtocol != multipath.Proto {
+		return stream, nil
+	}
+
+	subflows := make([]net.Conn, min(maxSubflows, max(first.numPaths(), 1), multipath.MaxSubflows))
+	subflows[0] = stream
+	var wg sync.WaitGroup
+	for i := 1; i < len(subflows); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// a subflow failing to connect only reduces the number of paths
+			if s, err := d.dialStream(ctx, addr, remote, d.withHealth(newStripeSelector(i), addr), multipath.Proto); err == nil {
+				subflows[i] = s
+			}
+		}()
+	}
+	wg.Wait()
+	subflows = slices.DeleteFunc(subflows, func(s net.Conn) bool { return s == nil })
+
+	conn, err := multipath.Dial(subflows)
+	if err != nil {
+		for _, s := range subflows {
+			s.Close()
+		}
+		return nil, err
+	}
+	return conn, nil
 }
 
-func (d internalSCIONDialer) SetPolicy(policy pan.Policy) error {
+// dialStream is the same as shttp.Dialer.DialContext but with a custom selector and
+// application layer protocols.
+func (d *internalSCIONDialer) dialStream(ctx context.Context, addr string, remote pan.UDPAddr, selector pan.Selector, protos ...string) (*quicutil.SingleStream, error) {
+	tlsCfg := &tls.Config{
+		NextProtos:         protos,
+		InsecureSkipVerify: true,
+	}
+	session, err := pan.DialQUIC(ctx, d.dialer.Local, remote, d.GetPolicy(), selector, addr, tlsCfg, d.dialer.QuicConfig)
+	if err != nil {
+		return nil, err
+	}
+	d.sessionsMu.Lock()
+	d.sessions = append(slices.DeleteFunc(d.sessions, func(s *pan.QUICSession) bool {
+		return s.Context().Err() != nil
+	}), session)
+	d.sessionsMu.Unlock()
+	return quicutil.NewSingleStream(session)
+}
+
+// withHealth wraps the selector of a connection to addr to record the path health.
+func (d *internalSCIONDialer) withHealth(selector pan.Selector, addr string) pan.Selector {
+	if d.health == nil {
+		return selector
+	}
+	return newHealthSelector(selector, addr, d.health)
+}
+
+func (d *internalSCIONDialer) SetPolicy(policy pan.Policy) error {
+	d.optionsMu.Lock()
 	d.dialer.SetPolicy(policy)
+	d.optionsMu.Unlock()
+
+	d.sessionsMu.Lock()
+	defer d.sessionsMu.Unlock()
+	for _, s := range d.sessions {
+		s.Conn.SetPolicy(policy)
+	}
 	return nil
 }
 
-func (d internalSCIONDialer) GetPolicy() pan.Policy { return d.dialer.Policy }
+func (d *internalSCIONDialer) GetPolicy() pan.Policy {
+	d.optionsMu.Lock()
+	defer d.optionsMu.Unlock()
+	return d.dialer.Policy
+}
 
-func (d internalSCIONDialer) GetMetrics(filteredAddrs []string) (*DialerMetrics, error) {
+func (d *internalSCIONDialer) setSelectionStrategy(strategy preference) error {
+	var newSelector func() (pan.Selector, error)
+	if strategy != "" {
+		if _, err := strategy.policy(); err != nil {
+			return err
+		}
+		newSelector = strategy.newSelector
+	}
+	d.optionsMu.Lock()
+	defer d.optionsMu.Unlock()
+	d.newSelector = newSelector
+	return nil
+}
+
+func (d *internalSCIONDialer) setMultipathSubflows(subflows int) {
+	d.optionsMu.Lock()
+	defer d.optionsMu.Unlock()
+	d.multipathSubflows = subflows
+}
+
+func (d *internalSCIONDialer) GetMetrics(filteredAddrs []string) (*DialerMetrics, error) {
 	return nil, fmt.Errorf("operation not supported")
 }
 
-func (d internalSCIONDialer) HasOpenConnections() (bool, error) {
+func (d *internalSCIONDialer) HasOpenConnections() (bool, error) {
 	return false, fmt.Errorf("operation not supported")
 }
 
-func (d internalSCIONDialer) HasDialedWithinTimeWindow(t time.Duration) (bool, error) {
+func (d *internalSCIONDialer) HasDialedWithinTimeWindow(t time.Duration) (bool, error) {
 	return false, fmt.Errorf("operation not supported")
 }
 
@@ -296,20 +695,35 @@ var ErrOperationNotSupported = fmt.Errorf("not a scion dialer")
 
 type StdDialer struct {
 	dialer *net.Dialer
+	// upstream routes the connections through parent proxies, may be nil
+	upstream *Upstream
 }
 
 func NewStdDialer(logger *zap.Logger, dialTimeout time.Duration) *StdDialer {
 	return &StdDialer{
 		dialer: &net.Dialer{
-			Timeout: dialTimeout,
+			Timeout:        dialTimeout,
+			ControlContext: checkAddress,
 		},
 	}
 }
 
 func (d *StdDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if d.upstream != nil {
+		if parent := d.upstream.parent(addr); parent != nil {
+			if err := checkHost(ctx, addr); err != nil {
+				return nil, err
+			}
+			return parent.DialContext(ctx, network, addr)
+		}
+	}
 	return d.dialer.DialContext(ctx, network, addr)
 }
 
+func (d *StdDialer) setUpstream(upstream *Upstream) {
+	d.upstream = upstream
+}
+
 func (d *StdDialer) SetPolicy(policy pan.Policy) error {
 	return ErrOperationNotSupported
 }
@@ -377,6 +791,9 @@ func (c *connectionTracker) GetConnections(addr string) []net.Conn {
 }
 
 func (c *connectionTracker) GetAllConnections() map[string][]net.Conn {
+	c.connsMu.RLock()
+	defer c.connsMu.RUnlock()
+
 	connsPerAddr := make(map[string][]net.Conn, len(c.conns))
 
 	for addr, c := range c.conns {
@@ -411,3 +828,12 @@ func (c *trackedConnection) Close() error {
 	c.tracker.RemoveConnection(c.addr, c.Conn)
 	return c.Conn.Close()
 }
+
+// CloseWrite half-closes the connection if supported, such that the end of a tunnel
+// can be propagated to the destination.
+func (c *trackedConnection) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -15,8 +15,10 @@ package panpolicy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"reflect"
 	"strings"
 	"testing"
@@ -93,6 +95,27 @@ func TestDialContext(t *testing.T) {
 	assert.Equal(t, 1, len(conns), "connection tracker has wrong number of tracked connections for addr %s", addr)
 }
 
+func TestStdDialerAddressCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	errDenied := errors.New("denied")
+
+	d := NewStdDialer(zap.NewNop(), time.Second)
+	var checked netip.AddrPort
+	ctx := WithAddressCheck(context.Background(), func(addrPort netip.AddrPort) error {
+		checked = addrPort
+		return errDenied
+	})
+	_, err = d.DialContext(ctx, "tcp", listener.Addr().String())
+	assert.ErrorIs(t, err, errDenied)
+	assert.Equal(t, listener.Addr().String(), checked.String())
+
+	conn, err := d.DialContext(context.Background(), "tcp", listener.Addr().String())
+	require.NoError(t, err)
+	assert.NoError(t, conn.Close())
+}
+
 type checkDialer struct{ dialCalled bool }
 
 func (d *checkDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
@@ -115,6 +138,7 @@ func TestGetMetrics(t *testing.T) {
 	cases := map[string]struct {
 		conns         map[string][]pathAwareConn
 		lastPath      map[string]*pathInfo
+		lastTransport map[string]transportType
 		filter        []string
 		expectedErr   bool
 		expectedPaths []*ConnInfo
@@ -175,6 +199,21 @@ func TestGetMetrics(t *testing.T) {
 				{Addr: addr2, PathInfo: &pathInfo{pathB, emptyIA}},
 			},
 		},
+		"addr reached over TCP/IP": {
+			conns: map[string][]pathAwareConn{
+				addr1: {
+					noopConn{path: pathA},
+				},
+			},
+			lastTransport: map[string]transportType{
+				addr1: transportSCION,
+				addr2: transportIP,
+			},
+			expectedPaths: []*ConnInfo{
+				{Addr: addr1, PathInfo: &pathInfo{pathA, emptyIA}, Transport: transportSCION},
+				{Addr: addr2, Transport: transportIP},
+			},
+		},
 		"filter addresses": {
 			conns: map[string][]pathAwareConn{
 				addr1: {
@@ -196,6 +235,9 @@ func TestGetMetrics(t *testing.T) {
 			fmt.Println(name)
 			d := NewSCIONDialer(zap.NewNop(), 1*time.Second, false)
 			d.lastUsedPathForAddr = c.lastPath
+			if c.lastTransport != nil {
+				d.lastTransportForAddr = c.lastTransport
+			}
 			for addr, ac := range c.conns {
 				if ac != nil && len(ac) == 0 {
 					// HACK to simulate added and later closed connection
@@ -284,10 +326,33 @@ func (d *metricsDialer) DialContext(ctx context.Context, network string, addr st
 }
 func (d metricsDialer) GetMetrics(filteredAddrs []string) (*DialerMetrics, error) {
 	return &DialerMetrics{
-		nil, []*ConnInfo{{Addr: "foo.bar", PathInfo: nil}},
+		connInfo: []*ConnInfo{{Addr: "foo.bar", PathInfo: nil}},
 	}, nil
 }
 func (d metricsDialer) SetPolicy(policy pan.Policy) error                       { return nil }
 func (d metricsDialer) GetPolicy() pan.Policy                                   { return nil }
 func (d metricsDialer) HasOpenConnections() (bool, error)                       { return true, nil }
 func (d metricsDialer) HasDialedWithinTimeWindow(t time.Duration) (bool, error) { return true, nil }
+
+func TestRecordTransport(t *testing.T) {
+	d := NewSCIONDialer(zap.NewNop(), 1*time.Second, false)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			d.RecordTransport(fmt.Sprintf("host-%d:443", i), transportIP)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		_, _ = d.GetMetrics(nil)
+	}
+	<-done
+
+	metrics, err := d.GetMetrics(nil)
+	require.NoError(t, err)
+	assert.Len(t, metrics.connInfo, 100)
+
+	shared := NewSCIONDialer(zap.NewNop(), 1*time.Second, true)
+	shared.RecordTransport("host:443", transportIP)
+	assert.Empty(t, shared.lastTransportForAddr, "shared dialer should not record transports")
+}
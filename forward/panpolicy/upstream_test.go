@@ -0,0 +1,266 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package panpolicy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// greetingServer greets clients and echoes what they send.
+func greetingServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = conn.Write([]byte("hello\n"))
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+// fakeParent is a parent proxy connecting all clients to the target, recording the
+// destinations requested.
+type fakeParent struct {
+	listener net.Listener
+	target   string
+
+	mutex     sync.Mutex
+	requested []string
+}
+
+func newFakeParent(t *testing.T, target string, handshake func(conn net.Conn, reader *bufio.Reader) (string, error)) *fakeParent {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	p := &fakeParent{listener: listener, target: target}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				requested, err := handshake(conn, reader)
+				if err != nil {
+					return
+				}
+				p.mutex.Lock()
+				p.requested = append(p.requested, requested)
+				p.mutex.Unlock()
+				targetConn, err := net.Dial("tcp", p.target)
+				if err != nil {
+					return
+				}
+				defer targetConn.Close()
+				go func() { _, _ = io.Copy(targetConn, reader) }()
+				_, _ = io.Copy(conn, targetConn)
+			}()
+		}
+	}()
+	return p
+}
+
+func (p *fakeParent) Requested() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]string(nil), p.requested...)
+}
+
+func connectHandshake(authorization string) func(net.Conn, *bufio.Reader) (string, error) {
+	return func(conn net.Conn, reader *bufio.Reader) (string, error) {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return "", err
+		}
+		if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != authorization {
+			_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return "", errors.New("refused")
+		}
+		_, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		return req.Host, err
+	}
+}
+
+// socks5Handshake implements the CONNECT command of RFC 1928 with username/password
+// authentication of RFC 1929.
+func socks5Handshake(user, password string) func(net.Conn, *bufio.Reader) (string, error) {
+	return func(conn net.Conn, reader *bufio.Reader) (string, error) {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(reader, make([]byte, header[1])); err != nil {
+			return "", err
+		}
+		if _, err := conn.Write([]byte{5, 2}); err != nil {
+			return "", err
+		}
+		credentials := make([]string, 2)
+		if _, err := reader.ReadByte(); err != nil {
+			return "", err
+		}
+		for i := range credentials {
+			n, err := reader.ReadByte()
+			if err != nil {
+				return "", err
+			}
+			b := make([]byte, n)
+			if _, err := io.ReadFull(reader, b); err != nil {
+				return "", err
+			}
+			credentials[i] = string(b)
+		}
+		if credentials[0] != user || credentials[1] != password {
+			_, _ = conn.Write([]byte{1, 1})
+			return "", errors.New("refused")
+		}
+		if _, err := conn.Write([]byte{1, 0}); err != nil {
+			return "", err
+		}
+
+		request := make([]byte, 5)
+		if _, err := io.ReadFull(reader, request); err != nil {
+			return "", err
+		}
+		if request[1] != 1 || request[3] != 3 {
+			return "", errors.New("expected CONNECT to a domain name")
+		}
+		host := make([]byte, request[4]+2)
+		if _, err := io.ReadFull(reader, host); err != nil {
+			return "", err
+		}
+		port := binary.BigEndian.Uint16(host[len(host)-2:])
+		_, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		return net.JoinHostPort(string(host[:len(host)-2]), strconv.Itoa(int(port))), err
+	}
+}
+
+func TestUpstream(t *testing.T) {
+	target := greetingServer(t)
+	connectParent := newFakeParent(t, target.Addr().String(), connectHandshake("Basic dXNlcjpzZWNyZXQ=")) // user:secret
+	socksParent := newFakeParent(t, target.Addr().String(), socks5Handshake("user", "secret"))
+
+	upstream, err := NewUpstream(UpstreamConfig{
+		Rules: []UpstreamRule{
+			{Hosts: []string{"*.socks.example"}, Proxy: "socks5://user:secret@" + socksParent.listener.Addr().String()},
+			{Hosts: []string{"direct.example"}, Networks: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}, Proxy: UpstreamDirect},
+		},
+		Default: "http://user:secret@" + connectParent.listener.Addr().String(),
+	}, time.Second)
+	require.NoError(t, err)
+	d := NewStdDialer(zap.NewNop(), time.Second)
+	d.setUpstream(upstream)
+
+	cases := map[string]struct {
+		addr     string
+		expected *fakeParent
+	}{
+		"connect": {addr: "www.example.org:443", expected: connectParent},
+		"socks5":  {addr: "git.socks.example:22", expected: socksParent},
+		"direct":  {addr: target.Addr().String()},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			conn, err := d.DialContext(context.Background(), "tcp", c.addr)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			reader := bufio.NewReader(conn)
+			greeting, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, "hello\n", greeting)
+			_, err = conn.Write([]byte("ping\n"))
+			require.NoError(t, err)
+			echo, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, "ping\n", echo)
+
+			if c.expected != nil {
+				assert.Contains(t, c.expected.Requested(), c.addr, "destination not requested from parent")
+			}
+		})
+	}
+
+	// addresses dialed through parents are checked, e.g., by the access control list
+	errDenied := errors.New("denied")
+	ctx := WithAddressCheck(context.Background(), func(netip.AddrPort) error { return errDenied })
+	_, err = d.DialContext(ctx, "tcp", "192.0.2.1:443")
+	assert.ErrorIs(t, err, errDenied)
+
+	// host names are resolved locally to check their addresses before handing them to parents
+	var checked []netip.AddrPort
+	ctx = WithAddressCheck(context.Background(), func(addrPort netip.AddrPort) error {
+		checked = append(checked, addrPort)
+		if addrPort.Addr().IsLoopback() {
+			return errDenied
+		}
+		return nil
+	})
+	_, err = d.DialContext(ctx, "tcp", "localhost:8080")
+	assert.ErrorIs(t, err, errDenied)
+	require.NotEmpty(t, checked)
+	assert.Equal(t, uint16(8080), checked[0].Port())
+	assert.NotContains(t, connectParent.Requested(), "localhost:8080", "denied destination requested from parent")
+
+	// host names that cannot be resolved locally are refused
+	_, err = d.DialContext(ctx, "tcp", "unresolvable.invalid:443")
+	assert.ErrorContains(t, err, "resolving unresolvable.invalid")
+	assert.NotContains(t, connectParent.Requested(), "unresolvable.invalid:443", "unchecked destination requested from parent")
+}
+
+func TestUpstreamRefused(t *testing.T) {
+	target := greetingServer(t)
+	parent := newFakeParent(t, target.Addr().String(), connectHandshake("Basic dXNlcjpzZWNyZXQ="))
+
+	upstream, err := NewUpstream(UpstreamConfig{Default: "http://" + parent.listener.Addr().String()}, time.Second)
+	require.NoError(t, err)
+	_, err = upstream.parent("www.example.org:443").DialContext(context.Background(), "tcp", "www.example.org:443")
+	assert.ErrorContains(t, err, "407")
+
+	for name, config := range map[string]UpstreamConfig{
+		"unknown scheme": {Default: "ftp://gateway"},
+		"no host":        {Default: "http://"},
+		"bad pattern":    {Rules: []UpstreamRule{{Hosts: []string{"[example.org"}, Proxy: UpstreamDirect}}},
+	} {
+		_, err := NewUpstream(config, time.Second)
+		assert.Error(t, err, name)
+	}
+}
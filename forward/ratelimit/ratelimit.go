@@ -0,0 +1,213 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ratelimit limits the bandwidth of the proxied traffic with token buckets,
+// globally, per client and per destination host.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/scionproto-contrib/http-proxy/forward/ioutils"
+)
+
+// idleEviction is the time after which the bucket of an inactive session or destination
+// is dropped. A dropped bucket is recreated full, hence it must have refilled by then.
+const idleEviction = 10 * time.Minute
+
+// Limit is a bandwidth limit, the zero value is unlimited.
+type Limit struct {
+	// BytesPerSecond is the sustained rate of the traffic in both directions.
+	BytesPerSecond int
+	// Burst is the number of bytes that may be transferred at once, one second worth of
+	// traffic if not set.
+	Burst int
+}
+
+func (l Limit) enabled() bool {
+	return l.BytesPerSecond > 0
+}
+
+func (l Limit) newLimiter() *rate.Limiter {
+	burst := l.Burst
+	if burst == 0 {
+		burst = l.BytesPerSecond
+	}
+	return rate.NewLimiter(rate.Limit(l.BytesPerSecond), burst)
+}
+
+func (l Limit) validate(name string) error {
+	if l.BytesPerSecond < 0 || l.Burst < 0 {
+		return fmt.Errorf("%s bandwidth limit must not be negative", name)
+	}
+	if l.Burst > 0 && !l.enabled() {
+		return fmt.Errorf("%s bandwidth limit has a burst but no rate", name)
+	}
+	return nil
+}
+
+// Config is the bandwidth limits of the proxy, all of which apply at the same time.
+type Config struct {
+	// Global limits all traffic of the proxy.
+	Global Limit
+	// PerSession limits the traffic of each client, see ClientKey. The session IDs are not
+	// stable, clients without a stored policy get a new session on every request.
+	PerSession Limit
+	// PerDestination limits the traffic to each destination host, regardless of the port.
+	PerDestination Limit
+}
+
+// Enabled returns whether any limit is configured.
+func (c Config) Enabled() bool {
+	return c.Global.enabled() || c.PerSession.enabled() || c.PerDestination.enabled()
+}
+
+// Limiters hands out the token buckets applying to the traffic of a client to a destination.
+// The buckets of clients and destinations are created on demand and dropped once inactive.
+type Limiters struct {
+	config Config
+	global *rate.Limiter
+
+	mutex        sync.Mutex
+	clients      map[string]*bucket
+	destinations map[string]*bucket
+	lastSweep    time.Time
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+func New(config Config) (*Limiters, error) {
+	for name, limit := range map[string]Limit{
+		"global":          config.Global,
+		"per-session":     config.PerSession,
+		"per-destination": config.PerDestination,
+	} {
+		if err := limit.validate(name); err != nil {
+			return nil, err
+		}
+	}
+
+	l := &Limiters{
+		config:       config,
+		clients:      make(map[string]*bucket),
+		destinations: make(map[string]*bucket),
+		lastSweep:    time.Now(),
+	}
+	if config.Global.enabled() {
+		l.global = config.Global.newLimiter()
+	}
+	return l, nil
+}
+
+// ClientKey identifies the client of the traffic by its authenticated user, if any, and
+// otherwise by the IP address of remoteAddr, which is given as host:port.
+func ClientKey(user, remoteAddr string) string {
+	if user != "" {
+		return "user " + user
+	}
+	return "address " + hostOnly(remoteAddr)
+}
+
+// For returns the limiter for the traffic of the client, see ClientKey, to the destination,
+// which is given as host or host:port. It returns nil if no limit applies, in particular if
+// l is nil.
+func (l *Limiters) For(client, destination string) ioutils.Limiter {
+	if l == nil {
+		return nil
+	}
+
+	var limiters multiLimiter
+	if l.global != nil {
+		limiters = append(limiters, l.global)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	if l.config.PerSession.enabled() {
+		limiters = append(limiters, l.bucket(l.clients, client, l.config.PerSession, now))
+	}
+	if l.config.PerDestination.enabled() {
+		limiters = append(limiters, l.bucket(l.destinations, hostOnly(destination), l.config.PerDestination, now))
+	}
+
+	if len(limiters) == 0 {
+		return nil
+	}
+	return limiters
+}
+
+func (l *Limiters) bucket(buckets map[string]*bucket, key string, limit Limit, now time.Time) *rate.Limiter {
+	b, ok := buckets[key]
+	if !ok {
+		b = &bucket{limiter: limit.newLimiter()}
+		buckets[key] = b
+	}
+	b.lastUsed = now
+	return b.limiter
+}
+
+// sweep drops the buckets not used within idleEviction, at most once per idleEviction.
+func (l *Limiters) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < idleEviction {
+		return
+	}
+	l.lastSweep = now
+	for _, buckets := range []map[string]*bucket{l.clients, l.destinations} {
+		for key, b := range buckets {
+			if now.Sub(b.lastUsed) > idleEviction {
+				delete(buckets, key)
+			}
+		}
+	}
+}
+
+func hostOnly(destination string) string {
+	host, _, err := net.SplitHostPort(destination)
+	if err != nil {
+		host = destination
+	}
+	return strings.ToLower(host)
+}
+
+// multiLimiter waits for all of its limiters.
+type multiLimiter []*rate.Limiter
+
+func (m multiLimiter) WaitN(ctx context.Context, n int) error {
+	for _, l := range m {
+		if err := l.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiLimiter) Burst() int {
+	burst := m[0].Burst()
+	for _, l := range m[1:] {
+		burst = min(burst, l.Burst())
+	}
+	return burst
+}
@@ -0,0 +1,106 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	cases := map[string]struct {
+		config      Config
+		expectedErr bool
+	}{
+		"no limits":       {config: Config{}},
+		"all limits":      {config: Config{Global: Limit{BytesPerSecond: 1000}, PerSession: Limit{BytesPerSecond: 100, Burst: 50}, PerDestination: Limit{BytesPerSecond: 10}}},
+		"negative rate":   {config: Config{PerSession: Limit{BytesPerSecond: -1}}, expectedErr: true},
+		"negative burst":  {config: Config{Global: Limit{BytesPerSecond: 1, Burst: -1}}, expectedErr: true},
+		"burst sans rate": {config: Config{PerDestination: Limit{Burst: 10}}, expectedErr: true},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := New(c.config)
+			if c.expectedErr {
+				assert.Error(t, err, "expected an error but got none")
+				return
+			}
+			assert.NoError(t, err, "unexpected error")
+		})
+	}
+}
+
+func TestLimitersFor(t *testing.T) {
+	cases := map[string]struct {
+		config         Config
+		expectedLimits int
+		expectedBurst  int
+	}{
+		"no limits":       {config: Config{}},
+		"global":          {config: Config{Global: Limit{BytesPerSecond: 1000}}, expectedLimits: 1, expectedBurst: 1000},
+		"per session":     {config: Config{PerSession: Limit{BytesPerSecond: 100, Burst: 500}}, expectedLimits: 1, expectedBurst: 500},
+		"all with lowest": {config: Config{Global: Limit{BytesPerSecond: 1000}, PerSession: Limit{BytesPerSecond: 100}, PerDestination: Limit{BytesPerSecond: 10}}, expectedLimits: 3, expectedBurst: 10},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			l, err := New(c.config)
+			require.NoError(t, err)
+
+			limiter := l.For("deadbeef", "example.org:443")
+			if c.expectedLimits == 0 {
+				assert.Nil(t, limiter, "limiter without limits")
+				return
+			}
+			require.NotNil(t, limiter)
+			assert.Len(t, limiter, c.expectedLimits)
+			assert.Equal(t, c.expectedBurst, limiter.Burst())
+		})
+	}
+
+	var l *Limiters
+	assert.Nil(t, l.For("deadbeef", "example.org:443"), "nil limiters returned a limiter")
+}
+
+func TestLimitersShareBuckets(t *testing.T) {
+	l, err := New(Config{PerSession: Limit{BytesPerSecond: 100}, PerDestination: Limit{BytesPerSecond: 10}})
+	require.NoError(t, err)
+
+	a := l.For("a", "Example.org:443").(multiLimiter)
+	b := l.For("b", "example.org:80").(multiLimiter)
+	assert.NotSame(t, a[0], b[0], "clients share a bucket")
+	assert.Same(t, a[1], b[1], "ports of the same destination do not share a bucket")
+
+	// inactive buckets are dropped
+	l.lastSweep = time.Now().Add(-2 * idleEviction)
+	for _, buckets := range []map[string]*bucket{l.clients, l.destinations} {
+		for _, b := range buckets {
+			b.lastUsed = time.Now().Add(-2 * idleEviction)
+		}
+	}
+	l.For("c", "example.com")
+	assert.Len(t, l.clients, 1)
+	assert.Len(t, l.destinations, 1)
+}
+
+func TestClientKey(t *testing.T) {
+	assert.Equal(t, ClientKey("", "192.0.2.1:1234"), ClientKey("", "192.0.2.1:5678"), "connections of a client do not share a key")
+	assert.NotEqual(t, ClientKey("", "192.0.2.1:1234"), ClientKey("", "192.0.2.2:1234"))
+	assert.Equal(t, ClientKey("alice", "192.0.2.1:1234"), ClientKey("alice", "192.0.2.2:1234"), "addresses of a user do not share a key")
+	assert.NotEqual(t, ClientKey("alice", "192.0.2.1:1234"), ClientKey("bob", "192.0.2.1:1234"))
+}
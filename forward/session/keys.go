@@ -0,0 +1,132 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	sessionKeysEnvName     = "SESSION_KEYS"
+	sessionKeysFileEnvName = "SESSION_KEYS_FILE"
+
+	blockKeyLength = 32 // AES-256
+)
+
+var ErrNoSessionKeys = errors.New("no session keys configured")
+
+// KeyRotator is implemented by session stores whose keys can be replaced at runtime.
+type KeyRotator interface {
+	SetKeyPairs(keyPairs ...[]byte) error
+}
+
+// KeysFromEnv loads the session key pairs from the environment. The following sources
+// are consulted in order:
+//   - the file referenced by SESSION_KEYS_FILE, see ParseKeys for the format,
+//   - the key pairs in SESSION_KEYS, separated by commas or new lines,
+//   - the legacy SESSION_KEY, a single raw hash key of 32 bytes without encryption.
+//
+// The key pairs are returned in the format expected by the store constructors, i.e.,
+// alternating hash and block keys with the newest pair first. If none of the sources
+// is set, ErrNoSessionKeys is returned.
+func KeysFromEnv() ([][]byte, error) {
+	if path := os.Getenv(sessionKeysFileEnvName); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open session keys file: %w", err)
+		}
+		defer f.Close()
+		return ParseKeys(f)
+	}
+
+	if keys := os.Getenv(sessionKeysEnvName); keys != "" {
+		return ParseKeys(strings.NewReader(strings.ReplaceAll(keys, ",", "\n")))
+	}
+
+	if sessionKey := []byte(os.Getenv(sessionKeyEnvName)); len(sessionKey) != 0 {
+		if len(sessionKey) != sessionKeyLength {
+			return nil, fmt.Errorf("expected session key of %d bytes, but was %d", sessionKeyLength, len(sessionKey))
+		}
+		return [][]byte{sessionKey, nil}, nil
+	}
+
+	return nil, ErrNoSessionKeys
+}
+
+// ParseKeys parses session key pairs, one pair per line with the newest pair first.
+// A line contains the base64 encoded hash key (32 or 64 bytes) used to authenticate the
+// session cookie, optionally followed by a space and the base64 encoded block key
+// (16, 24 or 32 bytes) used to encrypt it. Empty lines and lines starting with '#' are ignored.
+// The newest pair is used to sign (and encrypt) new cookies, all pairs are used to verify.
+func ParseKeys(r io.Reader) ([][]byte, error) {
+	var keyPairs [][]byte
+	scanner := bufio.NewScanner(r)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: expected hash key and optional block key, got %d fields", i, len(fields))
+		}
+
+		hashKey, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid hash key: %w", i, err)
+		}
+		if len(hashKey) != 32 && len(hashKey) != 64 {
+			return nil, fmt.Errorf("line %d: expected hash key of 32 or 64 bytes, but was %d", i, len(hashKey))
+		}
+
+		var blockKey []byte
+		if len(fields) == 2 {
+			blockKey, err = base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid block key: %w", i, err)
+			}
+			if len(blockKey) != 16 && len(blockKey) != 24 && len(blockKey) != 32 {
+				return nil, fmt.Errorf("line %d: expected block key of 16, 24 or 32 bytes, but was %d", i, len(blockKey))
+			}
+		}
+
+		keyPairs = append(keyPairs, hashKey, blockKey)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keyPairs) == 0 {
+		return nil, ErrNoSessionKeys
+	}
+	return keyPairs, nil
+}
+
+// GenerateRandomKeys returns a random hash and block key pair.
+// Sessions using it do not survive restarts.
+func GenerateRandomKeys() [][]byte {
+	return [][]byte{
+		securecookie.GenerateRandomKey(sessionKeyLength),
+		securecookie.GenerateRandomKey(blockKeyLength),
+	}
+}
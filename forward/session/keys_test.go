@@ -0,0 +1,152 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package session
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseKeys(t *testing.T) {
+	hashKey := securecookie.GenerateRandomKey(32)
+	blockKey := securecookie.GenerateRandomKey(32)
+	b64 := base64.StdEncoding.EncodeToString
+
+	cases := map[string]struct {
+		input        string
+		expectedKeys [][]byte
+		expectedErr  bool
+	}{
+		"hash key only":       {b64(hashKey), [][]byte{hashKey, nil}, false},
+		"hash and block key":  {b64(hashKey) + " " + b64(blockKey), [][]byte{hashKey, blockKey}, false},
+		"multiple key pairs":  {b64(hashKey) + " " + b64(blockKey) + "\n" + b64(blockKey), [][]byte{hashKey, blockKey, blockKey, nil}, false},
+		"comments and blanks": {"# current\n\n" + b64(hashKey) + "\n", [][]byte{hashKey, nil}, false},
+		"empty":               {"# nothing\n", nil, true},
+		"invalid base64":      {"not base64!", nil, true},
+		"short hash key":      {b64(hashKey[:16]), nil, true},
+		"invalid block key":   {b64(hashKey) + " " + b64(blockKey[:20]), nil, true},
+		"too many fields":     {b64(hashKey) + " " + b64(blockKey) + " " + b64(blockKey), nil, true},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			keys, err := ParseKeys(strings.NewReader(c.input))
+			if c.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.expectedKeys, keys)
+		})
+	}
+}
+
+func TestKeysFromEnv(t *testing.T) {
+	hashKey := securecookie.GenerateRandomKey(32)
+	encoded := base64.StdEncoding.EncodeToString(hashKey)
+
+	t.Run("none configured", func(t *testing.T) {
+		t.Setenv(sessionKeysFileEnvName, "")
+		t.Setenv(sessionKeysEnvName, "")
+		t.Setenv(sessionKeyEnvName, "")
+		_, err := KeysFromEnv()
+		assert.ErrorIs(t, err, ErrNoSessionKeys)
+	})
+
+	t.Run("legacy key", func(t *testing.T) {
+		t.Setenv(sessionKeysFileEnvName, "")
+		t.Setenv(sessionKeysEnvName, "")
+		t.Setenv(sessionKeyEnvName, strings.Repeat("k", sessionKeyLength))
+		keys, err := KeysFromEnv()
+		require.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte(strings.Repeat("k", sessionKeyLength)), nil}, keys)
+	})
+
+	t.Run("key list", func(t *testing.T) {
+		t.Setenv(sessionKeysFileEnvName, "")
+		t.Setenv(sessionKeysEnvName, encoded+","+encoded)
+		keys, err := KeysFromEnv()
+		require.NoError(t, err)
+		assert.Equal(t, [][]byte{hashKey, nil, hashKey, nil}, keys)
+	})
+
+	t.Run("key file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "keys")
+		require.NoError(t, os.WriteFile(path, []byte(encoded+"\n"), 0600))
+		t.Setenv(sessionKeysFileEnvName, path)
+		t.Setenv(sessionKeysEnvName, "ignored")
+		keys, err := KeysFromEnv()
+		require.NoError(t, err)
+		assert.Equal(t, [][]byte{hashKey, nil}, keys)
+	})
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKeys := GenerateRandomKeys()
+	newKeys := GenerateRandomKeys()
+	stores := map[string]func(t *testing.T) RotatingSessionStore{
+		"cookie store": func(t *testing.T) RotatingSessionStore { return NewCookieStore(zap.NewNop(), oldKeys...) },
+		"memory store": func(t *testing.T) RotatingSessionStore { return NewMemoryStore(zap.NewNop(), oldKeys...) },
+		"file store":   func(t *testing.T) RotatingSessionStore { return NewFileStore(zap.NewNop(), t.TempDir(), oldKeys...) },
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			data := SessionData{"blub", []byte("+ 42")}
+
+			rr := httptest.NewRecorder()
+			err := store.SetSessionData(rr, httptest.NewRequest(http.MethodPut, "/", nil), data)
+			require.NoError(t, err)
+			oldCookie := rr.Result().Cookies()[0]
+
+			// the old key still verifies, the new key signs
+			require.NoError(t, store.SetKeyPairs(append(newKeys, oldKeys...)...))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.AddCookie(oldCookie)
+			actual, err := store.GetSessionData(req)
+			require.NoError(t, err)
+			assert.Equal(t, data, actual)
+
+			rr = httptest.NewRecorder()
+			err = store.SetSessionData(rr, req, data)
+			require.NoError(t, err)
+			newCookie := rr.Result().Cookies()[0]
+
+			// once the old key is dropped, only cookies signed with the new key are accepted
+			require.NoError(t, store.SetKeyPairs(newKeys...))
+			req = httptest.NewRequest(http.MethodGet, "/", nil)
+			req.AddCookie(oldCookie)
+			actual, err = store.GetSessionData(req)
+			require.NoError(t, err)
+			assert.NotEqual(t, data, actual)
+
+			req = httptest.NewRequest(http.MethodGet, "/", nil)
+			req.AddCookie(newCookie)
+			actual, err = store.GetSessionData(req)
+			require.NoError(t, err)
+			assert.Equal(t, data, actual)
+		})
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+var _ sessions.Store = (*memoryStore)(nil)
+
+// memoryStore is a gorilla sessions.Store keeping the session values in memory.
+// It follows the implementation of sessions.FilesystemStore.
+type memoryStore struct {
+	codecs  []securecookie.Codec
+	options *sessions.Options
+
+	entriesMu sync.Mutex
+	entries   map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	values map[interface{}]interface{}
+	expiry time.Time
+}
+
+func newMemoryStore(keyPairs ...[]byte) *memoryStore {
+	s := &memoryStore{
+		options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   86400 * 30,
+			HttpOnly: true,
+		},
+		entries: make(map[string]memoryEntry),
+	}
+	s.setCodecs(securecookie.CodecsFromPairs(keyPairs...))
+	return s
+}
+
+func (s *memoryStore) setCodecs(codecs []securecookie.Codec) {
+	for _, codec := range codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(s.options.MaxAge)
+		}
+	}
+	s.codecs = codecs
+}
+
+func (s *memoryStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *memoryStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, errCookie := r.Cookie(name)
+	if errCookie != nil {
+		return session, nil
+	}
+	err := securecookie.DecodeMulti(name, c.Value, &session.ID, s.codecs...)
+	if err != nil {
+		return session, err
+	}
+	if s.load(session) {
+		session.IsNew = false
+	}
+	return session, nil
+}
+
+func (s *memoryStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		s.erase(session)
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = base32RawStdEncoding.EncodeToString(securecookie.GenerateRandomKey(sessionIDLength))
+	}
+	s.save(session)
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+func (s *memoryStore) save(session *sessions.Session) {
+	s.entriesMu.Lock()
+	defer s.entriesMu.Unlock()
+
+	// purge expired sessions so that abandoned sessions do not pile up
+	now := time.Now()
+	for id, e := range s.entries {
+		if now.After(e.expiry) {
+			delete(s.entries, id)
+		}
+	}
+
+	values := make(map[interface{}]interface{}, len(session.Values))
+	for k, v := range session.Values {
+		values[k] = v
+	}
+	s.entries[session.ID] = memoryEntry{
+		values: values,
+		expiry: now.Add(time.Duration(session.Options.MaxAge) * time.Second),
+	}
+}
+
+func (s *memoryStore) load(session *sessions.Session) bool {
+	s.entriesMu.Lock()
+	defer s.entriesMu.Unlock()
+
+	e, ok := s.entries[session.ID]
+	if !ok || time.Now().After(e.expiry) {
+		return false
+	}
+	for k, v := range e.values {
+		session.Values[k] = v
+	}
+	return true
+}
+
+func (s *memoryStore) erase(session *sessions.Session) {
+	s.entriesMu.Lock()
+	defer s.entriesMu.Unlock()
+
+	delete(s.entries, session.ID)
+}
@@ -17,9 +17,10 @@ package session
 import (
 	"encoding/base32"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"io/fs"
 	"net/http"
-	"os"
 	"sync"
 
 	"github.com/gorilla/securecookie"
@@ -33,8 +34,18 @@ type SessionData struct {
 	Policy []byte // raw policy
 }
 
-var sessionStoreMu sync.Mutex
-var sessionStore sessions.Store
+// SessionStore loads and persists the SessionData associated with a request.
+type SessionStore interface {
+	GetSessionData(r *http.Request) (SessionData, error)
+	SetSessionData(w http.ResponseWriter, r *http.Request, data SessionData) error
+}
+
+// RotatingSessionStore is a SessionStore whose keys can be replaced at runtime, as
+// returned by the store constructors.
+type RotatingSessionStore interface {
+	SessionStore
+	KeyRotator
+}
 
 const (
 	sessionKeyLength  = 32
@@ -47,72 +58,91 @@ const (
 
 func init() {
 	gob.Register(SessionData{})
+}
+
+var _ RotatingSessionStore = (*gorillaStore)(nil)
 
-	sessionKey := []byte(os.Getenv(sessionKeyEnvName))
-	if len(sessionKey) == 0 {
-		sessionKey = securecookie.GenerateRandomKey(sessionKeyLength)
-	} else if len(sessionKey) != sessionKeyLength {
-		panic(fmt.Sprintf("expected session key of %d bits, but was %d", sessionKeyLength, len(sessionKey)))
+// gorillaStore implements the SessionStore on top of a gorilla sessions.Store.
+type gorillaStore struct {
+	logger *zap.Logger
+
+	storeMu sync.Mutex
+	store   sessions.Store
+}
+
+func newGorillaStore(logger *zap.Logger, store sessions.Store) *gorillaStore {
+	return &gorillaStore{
+		logger: logger,
+		store:  store,
 	}
-	sessionStore = sessions.NewCookieStore(sessionKey)
-	sessionStoreMu = sync.Mutex{}
+}
+
+// NewCookieStore creates a SessionStore that keeps the session data in the
+// (authenticated) session cookie itself.
+func NewCookieStore(logger *zap.Logger, keyPairs ...[]byte) RotatingSessionStore {
+	store := sessions.NewCookieStore(keyPairs...)
+	store.Options = &sessions.Options{
+		HttpOnly: true,
+	}
+	return newGorillaStore(logger, store)
+}
+
+// NewMemoryStore creates a SessionStore that keeps the session data in memory,
+// the session cookie only carries the session ID.
+func NewMemoryStore(logger *zap.Logger, keyPairs ...[]byte) RotatingSessionStore {
+	return newGorillaStore(logger, newMemoryStore(keyPairs...))
+}
+
+// NewFileStore creates a SessionStore that keeps the session data in files in the
+// directory path, the session cookie only carries the session ID.
+func NewFileStore(logger *zap.Logger, path string, keyPairs ...[]byte) RotatingSessionStore {
+	store := sessions.NewFilesystemStore(path, keyPairs...)
+	store.Options.HttpOnly = true
+	return newGorillaStore(logger, store)
 }
 
 var base32RawStdEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
 
-// TODO maybe this should be an interface method as well?
-func GetSessionData(logger *zap.Logger, r *http.Request) (SessionData, error) {
-	sessionStoreMu.Lock()
-	defer sessionStoreMu.Unlock()
+func (s *gorillaStore) GetSessionData(r *http.Request) (SessionData, error) {
+	s.storeMu.Lock()
+	defer s.storeMu.Unlock()
 
-	session, err := sessionStore.Get(r, SessionName)
+	session, err := s.getSession(r)
 	if err != nil {
-		if multierr, ok := err.(securecookie.MultiError); !ok || !multierr.IsDecode() {
-			logger.Warn("Failed to get session from request.", zap.Error(err))
-			return SessionData{}, err
-		}
-		logger.Warn("Failed to decode session from request. Generating a new one...")
+		return SessionData{}, err
 	}
 
 	data, ok := session.Values[sessionDataKey]
 	if !ok {
 		id := base32RawStdEncoding.EncodeToString(securecookie.GenerateRandomKey(sessionIDLength))
-		logger.Debug("Generating a new session.", zap.String("session-id", id))
+		s.logger.Debug("Generating a new session.", zap.String("session-id", id))
 		return SessionData{ID: id}, nil
 	}
 
 	sd, ok := data.(SessionData)
 	if !ok {
-		logger.Error("Failed to decode session data.")
+		s.logger.Error("Failed to decode session data.")
 		return SessionData{}, fmt.Errorf("invalid session data type: expected sessionData, got %T", data)
 	}
 
 	return sd, nil
 }
 
-func SetSessionData(logger *zap.Logger, w http.ResponseWriter, r *http.Request, data SessionData) error {
-	sessionStoreMu.Lock()
-	defer sessionStoreMu.Unlock()
+func (s *gorillaStore) SetSessionData(w http.ResponseWriter, r *http.Request, data SessionData) error {
+	s.storeMu.Lock()
+	defer s.storeMu.Unlock()
 
 	if len(data.ID) == 0 {
 		return fmt.Errorf("invalid session data: no id set")
 	}
 
-	session, err := sessionStore.Get(r, SessionName)
+	session, err := s.getSession(r)
 	if err != nil {
-		if multierr, ok := err.(securecookie.MultiError); !ok || !multierr.IsDecode() {
-			logger.Warn("Failed to get session from request.", zap.Error(err))
-			return err
-		}
-		logger.Warn("Failed to decode session from request.")
+		return err
 	}
 
 	session.Values[sessionDataKey] = data
 
-	session.Options = &sessions.Options{
-		HttpOnly: true,
-	}
-
 	err = session.Save(r, w)
 	if err != nil {
 		return err
@@ -120,3 +150,42 @@ func SetSessionData(logger *zap.Logger, w http.ResponseWriter, r *http.Request,
 
 	return nil
 }
+
+// SetKeyPairs replaces the keys of the underlying store. The first pair is used to
+// encode new sessions, all pairs are used to decode existing ones.
+func (s *gorillaStore) SetKeyPairs(keyPairs ...[]byte) error {
+	if len(keyPairs) == 0 {
+		return ErrNoSessionKeys
+	}
+
+	s.storeMu.Lock()
+	defer s.storeMu.Unlock()
+
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	switch store := s.store.(type) {
+	case *sessions.CookieStore:
+		store.Codecs = codecs
+	case *sessions.FilesystemStore:
+		store.Codecs = codecs
+	case *memoryStore:
+		store.setCodecs(codecs)
+	default:
+		return fmt.Errorf("session store %T does not support key rotation", s.store)
+	}
+	return nil
+}
+
+// getSession returns the session of the request. Sessions that cannot be decoded or
+// that are unknown to a server-side store are replaced by a fresh session.
+func (s *gorillaStore) getSession(r *http.Request) (*sessions.Session, error) {
+	session, err := s.store.Get(r, SessionName)
+	if err != nil {
+		multierr, ok := err.(securecookie.MultiError)
+		if (!ok || !multierr.IsDecode()) && !errors.Is(err, fs.ErrNotExist) {
+			s.logger.Warn("Failed to get session from request.", zap.Error(err))
+			return nil, err
+		}
+		s.logger.Warn("Failed to decode session from request. Generating a new one...")
+	}
+	return session, nil
+}
@@ -15,9 +15,10 @@ package session
 
 import (
 	"net/http"
-	"os"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -50,13 +51,6 @@ func (s testingStore) Save(r *http.Request, w http.ResponseWriter, session *sess
 	return nil
 }
 
-func TestMain(m *testing.M) {
-	sessionStore = newTestingStore()
-
-	code := m.Run()
-	os.Exit(code)
-}
-
 func TestSessionData(t *testing.T) {
 	cases := map[string]struct {
 		setData      bool
@@ -76,10 +70,10 @@ func TestSessionData(t *testing.T) {
 			if c.setData {
 				store.session.Values[sessionDataKey] = c.expectedData
 			}
-			sessionStore = store
+			sessionStore := newGorillaStore(zap.NewNop(), store)
 
 			if name[:3] == "get" {
-				actual, err := GetSessionData(zap.NewNop(), nil)
+				actual, err := sessionStore.GetSessionData(nil)
 				if c.expectedErr {
 					require.Error(t, err)
 					return
@@ -92,7 +86,7 @@ func TestSessionData(t *testing.T) {
 				}
 			} else {
 				data := c.expectedData.(SessionData)
-				err := SetSessionData(zap.NewNop(), nil, nil, data)
+				err := sessionStore.SetSessionData(nil, nil, data)
 				if c.expectedErr {
 					require.Error(t, err)
 					return
@@ -103,3 +97,59 @@ func TestSessionData(t *testing.T) {
 		})
 	}
 }
+
+func TestSessionStoreRoundTrip(t *testing.T) {
+	key := securecookie.GenerateRandomKey(sessionKeyLength)
+	stores := map[string]func(t *testing.T) SessionStore{
+		"cookie store": func(t *testing.T) SessionStore { return NewCookieStore(zap.NewNop(), key) },
+		"memory store": func(t *testing.T) SessionStore { return NewMemoryStore(zap.NewNop(), key) },
+		"file store":   func(t *testing.T) SessionStore { return NewFileStore(zap.NewNop(), t.TempDir(), key) },
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			data := SessionData{"blub", []byte("+ 42")}
+
+			// persist session data
+			rr := httptest.NewRecorder()
+			err := store.SetSessionData(rr, httptest.NewRequest(http.MethodPut, "/", nil), data)
+			require.NoError(t, err)
+
+			cookies := rr.Result().Cookies()
+			require.Len(t, cookies, 1, "response did not contain a session cookie")
+			assert.Equal(t, SessionName, cookies[0].Name)
+
+			// load session data with cookie
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.AddCookie(cookies[0])
+			actual, err := store.GetSessionData(req)
+			require.NoError(t, err)
+			assert.Equal(t, data, actual)
+
+			// unknown or tampered cookie yields a new session
+			req = httptest.NewRequest(http.MethodGet, "/", nil)
+			req.AddCookie(&http.Cookie{Name: SessionName, Value: "blub"})
+			actual, err = store.GetSessionData(req)
+			require.NoError(t, err)
+			assert.NotEmpty(t, actual.ID)
+			assert.NotEqual(t, data.ID, actual.ID)
+			assert.Empty(t, actual.Policy)
+		})
+	}
+}
+
+func TestSessionStoresAreIndependent(t *testing.T) {
+	storeA := NewMemoryStore(zap.NewNop(), securecookie.GenerateRandomKey(sessionKeyLength))
+	storeB := NewMemoryStore(zap.NewNop(), securecookie.GenerateRandomKey(sessionKeyLength))
+
+	rr := httptest.NewRecorder()
+	err := storeA.SetSessionData(rr, httptest.NewRequest(http.MethodPut, "/", nil), SessionData{"blub", []byte("+")})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(rr.Result().Cookies()[0])
+	actual, err := storeB.GetSessionData(req)
+	require.NoError(t, err)
+	assert.NotEqual(t, "blub", actual.ID, "session leaked between stores")
+}
@@ -0,0 +1,305 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forward
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/scionproto-contrib/http-proxy/forward/accesslog"
+	"github.com/scionproto-contrib/http-proxy/forward/auth"
+	"github.com/scionproto-contrib/http-proxy/forward/metrics"
+	"github.com/scionproto-contrib/http-proxy/forward/panpolicy"
+	"github.com/scionproto-contrib/http-proxy/forward/socks5"
+	"github.com/scionproto-contrib/http-proxy/forward/utils"
+)
+
+// socks5HandshakeTimeout is the time within which clients must have sent their request.
+const socks5HandshakeTimeout = 10 * time.Second
+
+// ErrSOCKS5ServerClosed is returned by SOCKS5Server.Serve after the server is closed.
+var ErrSOCKS5ServerClosed = errors.New("SOCKS5 server closed")
+
+// SOCKS5Server serves the CONNECT command of SOCKS5 clients, e.g., ssh, git or curl with
+// --socks5-hostname, reaching the destinations like the tunnels of the HTTP proxy.
+//
+// If the proxy has an authenticator, clients authenticate with the username and password
+// of a user, e.g., of the htpasswd file, and use the default path policy. Otherwise, clients
+// may pass the session cookie of their path policy as the password of the user "policy",
+// like in the Proxy-Authorization header, or not authenticate at all.
+type SOCKS5Server struct {
+	proxy  *CoreProxy
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex     sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+}
+
+// NewSOCKS5Server returns a SOCKS5 server of the proxy, which must be initialized.
+func (cp *CoreProxy) NewSOCKS5Server() *SOCKS5Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &SOCKS5Server{
+		proxy:     cp,
+		ctx:       ctx,
+		cancel:    cancel,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts the connections of clients on the listener until the server is closed,
+// when it returns ErrSOCKS5ServerClosed.
+func (s *SOCKS5Server) Serve(l net.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return ErrSOCKS5ServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.listeners, l)
+		s.mutex.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return ErrSOCKS5ServerClosed
+		}
+		if err != nil {
+			s.mutex.Unlock()
+			return err
+		}
+		s.conns[conn] = struct{}{}
+		s.mutex.Unlock()
+
+		go func() {
+			defer func() {
+				conn.Close()
+				s.mutex.Lock()
+				delete(s.conns, conn)
+				s.mutex.Unlock()
+			}()
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// Close closes the listeners and the connections of the server.
+func (s *SOCKS5Server) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	s.cancel()
+	var errs []error
+	for l := range s.listeners {
+		if err := l.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return errors.Join(errs...)
+}
+
+func (s *SOCKS5Server) serveConn(conn net.Conn) {
+	cp := s.proxy
+	start := time.Now()
+	log := cp.logger.With(zap.String("client", conn.RemoteAddr().String()))
+	_ = conn.SetDeadline(start.Add(socks5HandshakeTimeout))
+	reader := bufio.NewReader(conn)
+
+	r, identity, err := s.handshake(conn, reader)
+	if err != nil {
+		log.Debug("SOCKS5 handshake failed.", zap.Error(err))
+		return
+	}
+	req, err := socks5.ReadRequest(reader)
+	if err != nil {
+		if errors.Is(err, socks5.ErrAddressType) {
+			_ = socks5.WriteReply(conn, socks5.ReplyAddressNotSupported, nil)
+		}
+		log.Debug("Failed to read SOCKS5 request.", zap.Error(err))
+		return
+	}
+	if req.Command != socks5.CommandConnect {
+		_ = socks5.WriteReply(conn, socks5.ReplyCommandNotSupported, nil)
+		log.Debug("Unsupported SOCKS5 command.", zap.Uint8("command", uint8(req.Command)))
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	record := accesslog.Record{
+		Time:   start,
+		Client: r.RemoteAddr,
+		Method: http.MethodConnect,
+		Host:   req.HostPort(),
+		Proto:  "SOCKS5",
+		User:   identity.Name,
+	}
+	_ = s.tunnel(conn, reader, r, &record)
+}
+
+// handshake negotiates the authentication method with the client and authenticates it.
+// It returns the request carrying the session cookie of the client, if any.
+func (s *SOCKS5Server) handshake(conn net.Conn, reader *bufio.Reader) (*http.Request, auth.Identity, error) {
+	cp := s.proxy
+	methods, err := socks5.ReadMethods(reader)
+	if err != nil {
+		return nil, auth.Identity{}, err
+	}
+	method := socks5.MethodNoAcceptable
+	if slices.Contains(methods, socks5.MethodUserPass) {
+		method = socks5.MethodUserPass
+	} else if slices.Contains(methods, socks5.MethodNoAuth) && cp.authenticator == nil {
+		method = socks5.MethodNoAuth
+	}
+	if err := socks5.WriteMethod(conn, method); err != nil {
+		return nil, auth.Identity{}, err
+	}
+
+	r := (&http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{},
+		Proto:      "SOCKS5",
+		Header:     make(http.Header),
+		RemoteAddr: conn.RemoteAddr().String(),
+	}).WithContext(s.ctx)
+	switch method {
+	case socks5.MethodNoAcceptable:
+		return nil, auth.Identity{}, errors.New("client offered no acceptable authentication method")
+	case socks5.MethodUserPass:
+		user, password, err := socks5.ReadUserPass(reader)
+		if err != nil {
+			return nil, auth.Identity{}, err
+		}
+		identity, err := s.login(r, user, password)
+		if err != nil {
+			_ = socks5.WriteUserPassStatus(conn, false)
+			return nil, auth.Identity{}, err
+		}
+		if err := socks5.WriteUserPassStatus(conn, true); err != nil {
+			return nil, auth.Identity{}, err
+		}
+		return r, identity, nil
+	default:
+		return r, auth.Identity{}, nil
+	}
+}
+
+// login authenticates the user with the authenticator of the proxy, if any, or otherwise
+// takes the password of the user "policy" as the session cookie.
+func (s *SOCKS5Server) login(r *http.Request, user, password string) (auth.Identity, error) {
+	cp := s.proxy
+	if cp.authenticator != nil {
+		r.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+password)))
+		defer r.Header.Del("Proxy-Authorization")
+		return cp.identify(r)
+	}
+	if user != auth.PolicyUser {
+		return auth.Identity{}, fmt.Errorf("username must be %s, with the session cookie as password", auth.PolicyUser)
+	}
+	if password != "" {
+		r.Header.Set("Cookie", password)
+	}
+	return auth.Identity{}, nil
+}
+
+// tunnel connects the client to the destination of the record, like HandleTunnelRequest.
+func (s *SOCKS5Server) tunnel(conn net.Conn, reader *bufio.Reader, r *http.Request, record *accesslog.Record) (err error) {
+	cp := s.proxy
+	var pr *proxiedRequest
+	defer func() {
+		cp.observeRequest(metrics.KindSOCKS5, record, pr, err)
+	}()
+	fail := func(err error) error {
+		_ = socks5.WriteReply(conn, socks5Reply(err), nil)
+		return err
+	}
+
+	sessionData, err := cp.sessionStore.GetSessionData(r)
+	if err != nil {
+		return fail(utils.NewHandlerError(http.StatusInternalServerError, err))
+	}
+	cp.logger.Debug("Having session.", zap.String("session-id", sessionData.ID))
+	record.SessionID = sessionData.ID
+
+	pr, ctx, err := cp.prepareRequest(r.Context(), record, sessionData, http.MethodConnect, "", record.Host)
+	if err != nil {
+		return fail(err)
+	}
+
+	cp.logger.Debug("Tunneling.", zap.String("host", record.Host), zap.String("proto", record.Proto))
+	targetConn, err := pr.dialer.DialContext(panpolicy.WithMultipath(ctx), "tcp", record.Host)
+	if err != nil {
+		return fail(dialError(http.StatusServiceUnavailable, fmt.Errorf("failed to setup tunnel: %w", err)))
+	}
+	defer targetConn.Close()
+	cp.logger.Debug("Set up tunnel.", zap.String("remote-address", targetConn.RemoteAddr().String()))
+	targetConn = cp.collector.CountTransferred(targetConn, metrics.TransportOf(targetConn))
+
+	if err := socks5.WriteReply(conn, socks5.ReplySucceeded, targetConn.LocalAddr()); err != nil {
+		return utils.NewHandlerError(http.StatusInternalServerError, err)
+	}
+	// the reader may hold data the client sent right after its request
+	if err := cp.streamTunnel(targetConn, reader, conn, pr); err != nil {
+		return utils.NewHandlerError(http.StatusInternalServerError, err)
+	}
+	return nil
+}
+
+// socks5Reply returns the reply to a request that failed with the error of the HTTP proxy.
+func socks5Reply(err error) socks5.Reply {
+	var he *utils.HandlerError
+	if !errors.As(err, &he) {
+		return socks5.ReplyGeneralFailure
+	}
+	if errors.Is(he.Err, syscall.ECONNREFUSED) {
+		return socks5.ReplyConnectionRefused
+	}
+	switch he.StatusCode {
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		return socks5.ReplyNotAllowed
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return socks5.ReplyHostUnreachable
+	case http.StatusGatewayTimeout:
+		return socks5.ReplyTTLExpired
+	default:
+		return socks5.ReplyGeneralFailure
+	}
+}
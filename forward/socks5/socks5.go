@@ -0,0 +1,213 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package socks5 implements the server side of the SOCKS5 protocol of RFC 1928, with the
+// username/password authentication of RFC 1929.
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+const (
+	version         = 5
+	userPassVersion = 1
+
+	addressIPv4   = 1
+	addressDomain = 3
+	addressIPv6   = 4
+)
+
+// Method is an authentication method.
+type Method byte
+
+const (
+	MethodNoAuth       Method = 0
+	MethodUserPass     Method = 2
+	MethodNoAcceptable Method = 0xff
+)
+
+// Command is the command of a request, only CommandConnect is supported by the proxy.
+type Command byte
+
+const (
+	CommandConnect   Command = 1
+	CommandBind      Command = 2
+	CommandAssociate Command = 3
+)
+
+// Reply is the reply code of a response to a request.
+type Reply byte
+
+const (
+	ReplySucceeded           Reply = 0
+	ReplyGeneralFailure      Reply = 1
+	ReplyNotAllowed          Reply = 2
+	ReplyNetworkUnreachable  Reply = 3
+	ReplyHostUnreachable     Reply = 4
+	ReplyConnectionRefused   Reply = 5
+	ReplyTTLExpired          Reply = 6
+	ReplyCommandNotSupported Reply = 7
+	ReplyAddressNotSupported Reply = 8
+)
+
+// ErrAddressType is returned by ReadRequest for requests with an unknown address type,
+// which are to be answered with ReplyAddressNotSupported.
+var ErrAddressType = errors.New("unsupported address type")
+
+// ReadMethods reads the greeting of a client, returning the authentication methods it offers.
+func ReadMethods(r io.Reader) ([]Method, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("reading greeting: %w", err)
+	}
+	if header[0] != version {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, fmt.Errorf("reading authentication methods: %w", err)
+	}
+	offered := make([]Method, len(methods))
+	for i, m := range methods {
+		offered[i] = Method(m)
+	}
+	return offered, nil
+}
+
+// WriteMethod writes the authentication method chosen by the server.
+func WriteMethod(w io.Writer, method Method) error {
+	_, err := w.Write([]byte{version, byte(method)})
+	return err
+}
+
+// ReadUserPass reads the username and password of a client authenticating with MethodUserPass.
+func ReadUserPass(r io.Reader) (user, password string, err error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", "", fmt.Errorf("reading username/password: %w", err)
+	}
+	if b[0] != userPassVersion {
+		return "", "", fmt.Errorf("unsupported username/password version %d", b[0])
+	}
+	if user, err = readString(r); err != nil {
+		return "", "", fmt.Errorf("reading username: %w", err)
+	}
+	if password, err = readString(r); err != nil {
+		return "", "", fmt.Errorf("reading password: %w", err)
+	}
+	return user, password, nil
+}
+
+// WriteUserPassStatus writes whether the username and password of the client are accepted.
+func WriteUserPassStatus(w io.Writer, ok bool) error {
+	status := byte(1)
+	if ok {
+		status = 0
+	}
+	_, err := w.Write([]byte{userPassVersion, status})
+	return err
+}
+
+// Request is the request of a client for a destination.
+type Request struct {
+	Command Command
+	// Host is the domain name or IP address of the destination.
+	Host string
+	Port uint16
+}
+
+// HostPort returns the destination in the form host:port.
+func (r Request) HostPort() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(int(r.Port)))
+}
+
+// ReadRequest reads the request of a client. The error is ErrAddressType if the request
+// is read completely, but its address type is not supported.
+func ReadRequest(r io.Reader) (Request, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Request{}, fmt.Errorf("reading request: %w", err)
+	}
+	if header[0] != version {
+		return Request{}, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	req := Request{Command: Command(header[1])}
+	switch header[3] {
+	case addressIPv4, addressIPv6:
+		b := make([]byte, 4)
+		if header[3] == addressIPv6 {
+			b = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return Request{}, fmt.Errorf("reading address: %w", err)
+		}
+		addr, _ := netip.AddrFromSlice(b)
+		req.Host = addr.String()
+	case addressDomain:
+		host, err := readString(r)
+		if err != nil {
+			return Request{}, fmt.Errorf("reading domain name: %w", err)
+		}
+		req.Host = host
+	default:
+		return Request{}, ErrAddressType
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return Request{}, fmt.Errorf("reading port: %w", err)
+	}
+	req.Port = binary.BigEndian.Uint16(port)
+	return req, nil
+}
+
+// WriteReply writes the reply to a request. The bound address is the local address of the
+// connection to the destination, the unspecified IPv4 address is sent if it is not a TCP/IP
+// address, e.g., if the destination is reached over SCION.
+func WriteReply(w io.Writer, reply Reply, bound net.Addr) error {
+	addrPort := netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	if tcpAddr, ok := bound.(*net.TCPAddr); ok {
+		addrPort = tcpAddr.AddrPort()
+	}
+	addr := addrPort.Addr().Unmap()
+	if !addr.IsValid() {
+		addr = netip.IPv4Unspecified()
+	}
+	b := []byte{version, byte(reply), 0, addressIPv4}
+	if addr.Is6() {
+		b[3] = addressIPv6
+	}
+	b = append(b, addr.AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, addrPort.Port())
+	_, err := w.Write(b)
+	return err
+}
+
+func readString(r io.Reader) (string, error) {
+	n := make([]byte, 1)
+	if _, err := io.ReadFull(r, n); err != nil {
+		return "", err
+	}
+	b := make([]byte, n[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
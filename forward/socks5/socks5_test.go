@@ -0,0 +1,102 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshake(t *testing.T) {
+	r := bytes.NewReader([]byte{
+		5, 2, 0, 2, // greeting offering no authentication and username/password
+		1, 5, 'a', 'l', 'i', 'c', 'e', 6, 's', 'e', 'c', 'r', 'e', 't',
+	})
+	methods, err := ReadMethods(r)
+	require.NoError(t, err)
+	assert.Equal(t, []Method{MethodNoAuth, MethodUserPass}, methods)
+	user, password, err := ReadUserPass(r)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", user)
+	assert.Equal(t, "secret", password)
+
+	var w bytes.Buffer
+	require.NoError(t, WriteMethod(&w, MethodUserPass))
+	require.NoError(t, WriteUserPassStatus(&w, false))
+	assert.Equal(t, []byte{5, 2, 1, 1}, w.Bytes())
+
+	_, err = ReadMethods(bytes.NewReader([]byte{4, 1, 0}))
+	assert.ErrorContains(t, err, "version 4")
+}
+
+func TestReadRequest(t *testing.T) {
+	cases := map[string]struct {
+		request     []byte
+		expected    Request
+		expectedErr error
+	}{
+		"domain": {
+			request:  []byte{5, 1, 0, 3, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'o', 'r', 'g', 0, 22},
+			expected: Request{Command: CommandConnect, Host: "example.org", Port: 22},
+		},
+		"ipv4": {
+			request:  []byte{5, 1, 0, 1, 192, 0, 2, 1, 1, 187},
+			expected: Request{Command: CommandConnect, Host: "192.0.2.1", Port: 443},
+		},
+		"ipv6": {
+			request:  []byte{5, 2, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80},
+			expected: Request{Command: CommandBind, Host: "2001:db8::1", Port: 80},
+		},
+		"unknown address type": {
+			request:     []byte{5, 1, 0, 9},
+			expectedErr: ErrAddressType,
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			req, err := ReadRequest(bytes.NewReader(c.request))
+			if c.expectedErr != nil {
+				assert.ErrorIs(t, err, c.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.expected, req)
+		})
+	}
+}
+
+func TestWriteReply(t *testing.T) {
+	cases := map[string]struct {
+		bound    net.Addr
+		expected []byte
+	}{
+		"ipv4":    {bound: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}, expected: []byte{5, 0, 0, 1, 192, 0, 2, 1, 1, 187}},
+		"ipv6":    {bound: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80}, expected: []byte{5, 0, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80}},
+		"not tcp": {bound: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}, expected: []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}},
+		"nil":     {expected: []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			var w bytes.Buffer
+			require.NoError(t, WriteReply(&w, ReplySucceeded, c.bound))
+			assert.Equal(t, c.expected, w.Bytes())
+		})
+	}
+}
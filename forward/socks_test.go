@@ -0,0 +1,111 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package forward_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/net/proxy"
+
+	"github.com/scionproto-contrib/http-proxy/forward"
+	"github.com/scionproto-contrib/http-proxy/forward/acl"
+	"github.com/scionproto-contrib/http-proxy/forward/auth"
+	"github.com/scionproto-contrib/http-proxy/forward/hostsfile"
+	"github.com/scionproto-contrib/http-proxy/forward/session"
+)
+
+func TestSOCKS5(t *testing.T) {
+	htpasswdPath := filepath.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, os.WriteFile(htpasswdPath, []byte("bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0o600)) // bob:secret
+	htpasswd, err := auth.LoadHtpasswd(htpasswdPath, "proxy")
+	require.NoError(t, err)
+
+	newServer := func(authenticator auth.Authenticator, list *acl.List) string {
+		cp := forward.NewCoreProxy(zap.NewNop(), 10*time.Second, 10*time.Second, 10*time.Second, 10*time.Second, false)
+		cp.SetHostsFile(hostsfile.Config{Disabled: true})
+		cp.SetSessionStore(session.NewCookieStore(zap.NewNop(), session.GenerateRandomKeys()...))
+		if authenticator != nil {
+			cp.SetAuthenticator(authenticator)
+		}
+		cp.SetAccessControl(list)
+		require.NoError(t, cp.Initialize())
+		server := cp.NewSOCKS5Server()
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		serveErr := make(chan error, 1)
+		go func() { serveErr <- server.Serve(listener) }()
+		t.Cleanup(func() {
+			require.NoError(t, server.Close())
+			assert.ErrorIs(t, <-serveErr, forward.ErrSOCKS5ServerClosed)
+			require.NoError(t, cp.Cleanup())
+		})
+		return listener.Addr().String()
+	}
+	openProxy := newServer(nil, nil)
+	authProxy := newServer(htpasswd, nil)
+	defaultProxy := newServer(nil, acl.DefaultList())
+
+	cases := map[string]struct {
+		proxyAddr   string
+		auth        *proxy.Auth
+		expectedErr string
+	}{
+		"no auth":           {proxyAddr: openProxy},
+		"policy user":       {proxyAddr: openProxy, auth: &proxy.Auth{User: auth.PolicyUser}},
+		"other user":        {proxyAddr: openProxy, auth: &proxy.Auth{User: "bob", Password: "secret"}, expectedErr: "authentication failed"},
+		"password":          {proxyAddr: authProxy, auth: &proxy.Auth{User: "bob", Password: "secret"}},
+		"wrong password":    {proxyAddr: authProxy, auth: &proxy.Auth{User: "bob", Password: "guess"}, expectedErr: "authentication failed"},
+		"no auth required":  {proxyAddr: authProxy, expectedErr: "no acceptable authentication methods"},
+		"denied by the acl": {proxyAddr: defaultProxy, expectedErr: "connection not allowed by ruleset"},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			dialer, err := proxy.SOCKS5("tcp", c.proxyAddr, c.auth, proxy.Direct)
+			require.NoError(t, err)
+			client := &http.Client{
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+						return dialer.(proxy.ContextDialer).DialContext(ctx, network, addr)
+					},
+				},
+				Timeout: 10 * time.Second,
+			}
+
+			resp, err := client.Get("http://" + insecureTestTarget.addr + "/")
+			if c.expectedErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, errors.Unwrap(err).Error(), c.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, insecureTestTarget.contents["/"], body)
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package strictscion remembers the hosts that must only be reached over SCION.
+//
+// Servers announce the Strict-SCION header to the clients that reach them over TCP/IP (see
+// the advertiser of the reverse proxy), hence it is honored in responses received over
+// TCP/IP. Unlike HSTS, which is ignored over HTTP, an injected header cannot redirect the
+// connections: the SCION address is still taken from the resolver, the header only refuses
+// TCP/IP, which an attacker on the TCP/IP path can already disrupt. The proxy only sees the
+// headers of the requests it forwards, i.e., of plain HTTP requests; the responses within
+// CONNECT tunnels, e.g., of HTTPS sites, are encrypted.
+package strictscion
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderName = "Strict-SCION"
+
+	// DefaultMaxAge is used if the Strict-SCION header does not carry a max-age directive.
+	DefaultMaxAge = 24 * time.Hour
+
+	// DefaultMaxHosts is the number of hosts remembered, the hosts expiring first are
+	// forgotten once it is exceeded.
+	DefaultMaxHosts = 10000
+
+	// maxAgeLimit caps max-age (in seconds) to avoid overflowing time.Duration.
+	maxAgeLimit = int64(100 * 365 * 24 * time.Hour / time.Second)
+)
+
+// Store remembers hosts that announced via the Strict-SCION header that they must
+// only be reached over SCION, analogous to HSTS (RFC 6797).
+type Store struct {
+	defaultMaxAge time.Duration
+	maxHosts      int
+
+	hostsMu sync.Mutex
+	hosts   map[string]time.Time // host -> expiry
+}
+
+func NewStore(defaultMaxAge time.Duration, maxHosts int) *Store {
+	return &Store{
+		defaultMaxAge: defaultMaxAge,
+		maxHosts:      maxHosts,
+		hosts:         make(map[string]time.Time),
+	}
+}
+
+// Observe records the Strict-SCION header value returned by host over SCION. An empty
+// value is ignored, a max-age of zero removes the host from the store.
+func (s *Store) Observe(host string, value string) {
+	if value == "" {
+		return
+	}
+	maxAge, ok := parseMaxAge(value)
+	if !ok {
+		maxAge = s.defaultMaxAge
+	}
+
+	s.hostsMu.Lock()
+	defer s.hostsMu.Unlock()
+
+	host = normalize(host)
+	if maxAge <= 0 {
+		delete(s.hosts, host)
+		return
+	}
+	if _, ok := s.hosts[host]; !ok && len(s.hosts) >= s.maxHosts {
+		s.evict()
+	}
+	s.hosts[host] = time.Now().Add(maxAge)
+}
+
+// evict forgets the host expiring first.
+func (s *Store) evict() {
+	var first string
+	var firstExpiry time.Time
+	for host, expiry := range s.hosts {
+		if first == "" || expiry.Before(firstExpiry) {
+			first, firstExpiry = host, expiry
+		}
+	}
+	delete(s.hosts, first)
+}
+
+// IsStrict reports whether host must only be reached over SCION.
+func (s *Store) IsStrict(host string) bool {
+	s.hostsMu.Lock()
+	defer s.hostsMu.Unlock()
+
+	host = normalize(host)
+	expiry, ok := s.hosts[host]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiry) {
+		delete(s.hosts, host)
+		return false
+	}
+	return true
+}
+
+// parseMaxAge looks for a max-age directive in the semicolon separated header value.
+func parseMaxAge(value string) (time.Duration, bool) {
+	for _, directive := range strings.Split(value, ";") {
+		name, arg, ok := strings.Cut(strings.TrimSpace(directive), "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "max-age") {
+			continue
+		}
+		seconds, err := strconv.ParseInt(strings.Trim(strings.TrimSpace(arg), `"`), 10, 64)
+		if err != nil || seconds < 0 {
+			return 0, false
+		}
+		if seconds > maxAgeLimit {
+			seconds = maxAgeLimit
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
+
+func normalize(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package strictscion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMaxAge(t *testing.T) {
+	cases := map[string]struct {
+		value          string
+		expectedMaxAge time.Duration
+		expectedOk     bool
+	}{
+		"no directive":       {"1-ff00:0:110,[192.0.2.1]:443", 0, false},
+		"max-age only":       {"max-age=60", 60 * time.Second, true},
+		"max-age quoted":     {`max-age="60"`, 60 * time.Second, true},
+		"max-age with addr":  {"1-ff00:0:110,[192.0.2.1]:443; max-age=3600", time.Hour, true},
+		"max-age zero":       {"max-age=0", 0, true},
+		"max-age invalid":    {"max-age=abc", 0, false},
+		"max-age negative":   {"max-age=-1", 0, false},
+		"max-age mixed case": {"Max-Age=60", 60 * time.Second, true},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			maxAge, ok := parseMaxAge(c.value)
+			assert.Equal(t, c.expectedOk, ok)
+			assert.Equal(t, c.expectedMaxAge, maxAge)
+		})
+	}
+}
+
+func TestStore(t *testing.T) {
+	s := NewStore(time.Hour, DefaultMaxHosts)
+
+	assert.False(t, s.IsStrict("example.org"), "unknown host should not be strict")
+
+	s.Observe("example.org:80", "")
+	assert.False(t, s.IsStrict("example.org"), "empty header should be ignored")
+
+	s.Observe("Example.org:80", "1-ff00:0:110,[192.0.2.1]:443")
+	assert.True(t, s.IsStrict("example.org:443"), "host should be strict regardless of port and case")
+
+	s.Observe("example.org", "max-age=0")
+	assert.False(t, s.IsStrict("example.org"), "max-age=0 should remove host")
+
+	s.Observe("example.org", "max-age=1")
+	s.hosts["example.org"] = time.Now().Add(-time.Second)
+	assert.False(t, s.IsStrict("example.org"), "expired host should not be strict")
+
+	bounded := NewStore(time.Hour, 2)
+	bounded.Observe("a.example.org", "max-age=60")
+	bounded.Observe("b.example.org", "max-age=3600")
+	bounded.Observe("c.example.org", "max-age=3600")
+	assert.False(t, bounded.IsStrict("a.example.org"), "host expiring first should be forgotten")
+	assert.True(t, bounded.IsStrict("b.example.org"))
+	assert.True(t, bounded.IsStrict("c.example.org"))
+}
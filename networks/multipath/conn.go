@@ -0,0 +1,494 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package multipath implements a byte stream striped over several subflows, e.g.,
+// QUIC single streams over different SCION paths, and reassembled in order by the peer.
+//
+// The "protocol" is:
+//   - the client opens all subflows and sends a hello on each of them, containing the
+//     version, a random tunnel ID, the index of the subflow and the number of subflows.
+//   - the server groups the subflows by tunnel ID until all subflows arrived.
+//   - both peers send the data in frames of at most maxFrameSize bytes, each prefixed with
+//     a sequence number and its length. A frame is sent over whichever subflow is ready
+//     first, hence faster paths carry more frames. The receiver reorders the frames by
+//     their sequence number.
+//   - an empty frame signals the end of the stream, i.e., half-closes the connection.
+package multipath
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
+)
+
+const (
+	// Proto is the application layer protocol negotiated for the subflows of a
+	// multipath connection.
+	Proto = "qs-mp"
+
+	// MaxSubflows is the maximum number of subflows of a connection.
+	MaxSubflows = 16
+
+	version        = 1
+	helloLen       = 1 + tunnelIDLen + 2
+	tunnelIDLen    = 16
+	frameHeaderLen = 8 + 4
+	maxFrameSize   = 16 * 1024
+	// maxBuffered is the amount of out of order data buffered by the receiver before it
+	// stops reading from the subflows that are ahead.
+	maxBuffered = 4 * 1024 * 1024
+)
+
+// Interface guards
+var (
+	_ net.Conn = (*Conn)(nil)
+)
+
+type tunnelID [tunnelIDLen]byte
+
+type hello struct {
+	id    tunnelID
+	index int
+	count int
+}
+
+func (h hello) marshal() []byte {
+	b := make([]byte, 0, helloLen)
+	b = append(b, version)
+	b = append(b, h.id[:]...)
+	return append(b, byte(h.index), byte(h.count))
+}
+
+func readHello(r io.Reader) (hello, error) {
+	b := make([]byte, helloLen)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return hello{}, err
+	}
+	if b[0] != version {
+		return hello{}, fmt.Errorf("unsupported multipath version %d", b[0])
+	}
+	h := hello{index: int(b[helloLen-2]), count: int(b[helloLen-1])}
+	copy(h.id[:], b[1:])
+	if h.count == 0 || h.count > MaxSubflows || h.index >= h.count {
+		return hello{}, fmt.Errorf("invalid subflow %d of %d", h.index, h.count)
+	}
+	return h, nil
+}
+
+type frame struct {
+	seq  uint64
+	data []byte
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+type pathAwareConn interface {
+	GetPath() *pan.Path
+}
+
+// Conn is a connection striped over several subflows.
+type Conn struct {
+	subflows []net.Conn
+
+	writeMu     sync.Mutex
+	writeSeq    uint64
+	writeClosed bool
+	frames      chan frame
+	senders     sync.WaitGroup
+	sendOnce    sync.Once
+	sendFailed  chan struct{}
+	sendErr     error
+
+	deadlineMu    sync.Mutex
+	writeDeadline time.Time
+
+	readMu       sync.Mutex
+	readCond     *sync.Cond
+	readSeq      uint64
+	lastSeq      []uint64
+	buffered     map[uint64][]byte
+	bufferedLen  int
+	pending      []byte
+	eof          bool
+	receiving    int
+	readErr      error
+	readDeadline time.Time
+	readTimer    *time.Timer
+
+	closeOnce sync.Once
+	// closed is closed by Close, unblocking the writes and stopping the senders.
+	closed chan struct{}
+}
+
+// Dial sends the hellos on the subflows of a new multipath connection and returns the
+// connection. The subflows are owned by the returned connection.
+func Dial(subflows []net.Conn) (*Conn, error) {
+	if len(subflows) == 0 || len(subflows) > MaxSubflows {
+		return nil, fmt.Errorf("invalid number of subflows %d", len(subflows))
+	}
+	var id tunnelID
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	for i, subflow := range subflows {
+		h := hello{id: id, index: i, count: len(subflows)}
+		if _, err := subflow.Write(h.marshal()); err != nil {
+			return nil, fmt.Errorf("sending hello on subflow %d: %w", i, err)
+		}
+	}
+	return newConn(subflows), nil
+}
+
+func newConn(subflows []net.Conn) *Conn {
+	c := &Conn{
+		subflows:   subflows,
+		frames:     make(chan frame),
+		sendFailed: make(chan struct{}),
+		readSeq:    1,
+		lastSeq:    make([]uint64, len(subflows)),
+		buffered:   make(map[uint64][]byte),
+		receiving:  len(subflows),
+		closed:     make(chan struct{}),
+	}
+	c.readCond = sync.NewCond(&c.readMu)
+	for i, subflow := range subflows {
+		c.senders.Add(1)
+		go c.send(subflow)
+		go c.receive(i, subflow)
+	}
+	return c
+}
+
+// send writes the frames handed over by Write to the subflow until the connection is
+// closed for writing, or closed.
+func (c *Conn) send(subflow net.Conn) {
+	defer c.senders.Done()
+
+	header := make([]byte, frameHeaderLen)
+	for {
+		var f frame
+		var ok bool
+		select {
+		case f, ok = <-c.frames:
+		case <-c.closed:
+			return
+		}
+		if !ok {
+			break
+		}
+		binary.BigEndian.PutUint64(header, f.seq)
+		binary.BigEndian.PutUint32(header[8:], uint32(len(f.data)))
+		if _, err := subflow.Write(append(header, f.data...)); err != nil {
+			c.failSend(err)
+			// keep draining, the connection is broken anyway
+			continue
+		}
+	}
+	if cw, ok := subflow.(closeWriter); ok {
+		_ = cw.CloseWrite()
+	}
+}
+
+func (c *Conn) failSend(err error) {
+	c.sendOnce.Do(func() {
+		c.sendErr = err
+		close(c.sendFailed)
+	})
+}
+
+// receive reads the frames of the subflow and buffers them for reordering.
+func (c *Conn) receive(index int, subflow net.Conn) {
+	header := make([]byte, frameHeaderLen)
+	for {
+		if !c.awaitBufferSpace(index) {
+			return
+		}
+		if _, err := io.ReadFull(subflow, header); err != nil {
+			c.stopReceiving(err)
+			return
+		}
+		seq := binary.BigEndian.Uint64(header)
+		length := binary.BigEndian.Uint32(header[8:])
+		if length > maxFrameSize {
+			c.stopReceiving(fmt.Errorf("frame of %d bytes exceeds maximum of %d bytes", length, maxFrameSize))
+			return
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(subflow, data); err != nil {
+			c.stopReceiving(err)
+			return
+		}
+
+		c.readMu.Lock()
+		if _, dup := c.buffered[seq]; dup || seq < c.readSeq {
+			c.readMu.Unlock()
+			c.stopReceiving(fmt.Errorf("duplicate frame %d", seq))
+			return
+		}
+		c.buffered[seq] = data
+		c.bufferedLen += len(data)
+		c.lastSeq[index] = seq
+		c.readCond.Broadcast()
+		c.readMu.Unlock()
+	}
+}
+
+// awaitBufferSpace blocks while the receive buffer is full and the subflow is ahead of
+// the reader, i.e., the next frame to read is carried by another subflow. A subflow
+// carries its frames in order, hence the subflow carrying the next frame is never blocked.
+func (c *Conn) awaitBufferSpace(index int) bool {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for c.readErr == nil && c.bufferedLen >= maxBuffered && c.lastSeq[index] >= c.readSeq {
+		c.readCond.Wait()
+	}
+	return c.readErr == nil
+}
+
+// stopReceiving records the end of a subflow. A subflow ending with io.EOF is closed
+// for writing by the peer, the connection fails if all subflows ended before the end
+// of the stream.
+func (c *Conn) stopReceiving(err error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	c.receiving--
+	switch {
+	case !errors.Is(err, io.EOF):
+		if c.readErr == nil {
+			c.readErr = err
+		}
+	case c.receiving == 0 && c.readErr == nil:
+		c.readErr = io.ErrUnexpectedEOF
+	}
+	c.readCond.Broadcast()
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for {
+		if len(c.pending) > 0 {
+			n := copy(p, c.pending)
+			c.pending = c.pending[n:]
+			return n, nil
+		}
+		if data, ok := c.buffered[c.readSeq]; ok {
+			delete(c.buffered, c.readSeq)
+			c.bufferedLen -= len(data)
+			c.readSeq++
+			c.readCond.Broadcast()
+			if len(data) == 0 {
+				c.eof = true
+			}
+			c.pending = data
+			continue
+		}
+		if c.eof {
+			return 0, io.EOF
+		}
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.readCond.Wait()
+	}
+}
+
+// Write splits p into frames and hands them over to the subflows.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.writeClosed {
+		return 0, net.ErrClosed
+	}
+	n := 0
+	for len(p) > 0 {
+		size := min(len(p), maxFrameSize)
+		if err := c.writeFrame(append([]byte(nil), p[:size]...)); err != nil {
+			return n, err
+		}
+		n += size
+		p = p[size:]
+	}
+	return n, nil
+}
+
+// writeFrame hands over the next frame to the first subflow ready to send it. Once a
+// frame is lost, e.g., due to the write deadline, the stream cannot be reassembled and
+// all following writes fail.
+func (c *Conn) writeFrame(data []byte) error {
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	default:
+	}
+	select {
+	case <-c.sendFailed:
+		return c.sendErr
+	default:
+	}
+
+	c.deadlineMu.Lock()
+	writeDeadline := c.writeDeadline
+	c.deadlineMu.Unlock()
+
+	var deadline <-chan time.Time
+	if !writeDeadline.IsZero() {
+		timer := time.NewTimer(time.Until(writeDeadline))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	c.writeSeq++
+	select {
+	case c.frames <- frame{seq: c.writeSeq, data: data}:
+		return nil
+	case <-c.closed:
+		return net.ErrClosed
+	case <-c.sendFailed:
+		return c.sendErr
+	case <-deadline:
+		c.failSend(os.ErrDeadlineExceeded)
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// CloseWrite signals the end of the stream to the peer and closes the subflows for
+// writing once all frames are sent, or the connection is closed. This is analogous to
+// net.TCPConn.CloseWrite.
+func (c *Conn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.writeClosed {
+		return nil
+	}
+	c.writeClosed = true
+	err := c.writeFrame(nil)
+	close(c.frames)
+	c.senders.Wait()
+	return err
+}
+
+// Close closes all subflows, unblocking pending reads and writes. Unlike CloseWrite, it
+// does not wait for the frames being sent, which are lost if the peer stalls; the end
+// of the stream is only signaled by CloseWrite.
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+
+		c.readMu.Lock()
+		if c.readErr == nil {
+			c.readErr = net.ErrClosed
+		}
+		if c.readTimer != nil {
+			c.readTimer.Stop()
+		}
+		c.readCond.Broadcast()
+		c.readMu.Unlock()
+
+		errs := make([]error, len(c.subflows))
+		var wg sync.WaitGroup
+		for i, subflow := range c.subflows {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = subflow.Close()
+			}()
+		}
+		wg.Wait()
+		err = errors.Join(errs...)
+		// the senders blocked by the peer failed with the subflows
+		c.senders.Wait()
+	})
+	return err
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.subflows[0].LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.subflows[0].RemoteAddr()
+}
+
+// GetPath returns the path of the first subflow, if known.
+func (c *Conn) GetPath() *pan.Path {
+	if pc, ok := c.subflows[0].(pathAwareConn); ok {
+		return pc.GetPath()
+	}
+	return nil
+}
+
+// Subflows returns the number of subflows of the connection.
+func (c *Conn) Subflows() int {
+	return len(c.subflows)
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	c.readDeadline = t
+	if c.readTimer != nil {
+		c.readTimer.Stop()
+		c.readTimer = nil
+	}
+	if !t.IsZero() {
+		c.readTimer = time.AfterFunc(time.Until(t), func() {
+			c.readMu.Lock()
+			defer c.readMu.Unlock()
+			c.readCond.Broadcast()
+		})
+	}
+	c.readCond.Broadcast()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.writeDeadline = t
+	c.deadlineMu.Unlock()
+
+	for _, subflow := range c.subflows {
+		if err := subflow.SetWriteDeadline(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package multipath
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowConn delays each write, e.g., to emulate a path with a higher latency.
+type slowConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (c *slowConn) Write(p []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.Conn.Write(p)
+}
+
+func newSubflowPairs(n int) (client, server []net.Conn) {
+	for i := 0; i < n; i++ {
+		c, s := net.Pipe()
+		client = append(client, c)
+		server = append(server, s)
+	}
+	return client, server
+}
+
+func TestConnStripes(t *testing.T) {
+	cases := map[string]struct {
+		subflows int
+		size     int
+		delay    time.Duration
+	}{
+		"single subflow":            {subflows: 1, size: 100 * 1024},
+		"several subflows":          {subflows: 3, size: 1024 * 1024},
+		"subflow with higher delay": {subflows: 3, size: 256 * 1024, delay: 5 * time.Millisecond},
+		"empty stream":              {subflows: 2, size: 0},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			clientSubflows, serverSubflows := newSubflowPairs(c.subflows)
+			if c.delay != 0 {
+				clientSubflows[0] = &slowConn{Conn: clientSubflows[0], delay: c.delay}
+			}
+			client, server := newConn(clientSubflows), newConn(serverSubflows)
+			defer client.Close()
+			defer server.Close()
+
+			data := make([]byte, c.size)
+			_, err := rand.Read(data)
+			require.NoError(t, err)
+
+			// both directions at once
+			errc := make(chan error, 1)
+			go func() {
+				_, err := client.Write(data)
+				if err == nil {
+					err = client.CloseWrite()
+				}
+				errc <- err
+			}()
+			go func() {
+				_, _ = server.Write(data)
+				_ = server.CloseWrite()
+			}()
+
+			received, err := io.ReadAll(server)
+			require.NoError(t, err, "reading from server side failed")
+			assert.True(t, bytes.Equal(data, received), "server received corrupted data")
+			require.NoError(t, <-errc, "writing from client side failed")
+
+			received, err = io.ReadAll(client)
+			require.NoError(t, err, "reading from client side failed")
+			assert.True(t, bytes.Equal(data, received), "client received corrupted data")
+		})
+	}
+}
+
+func TestConnSubflowFailure(t *testing.T) {
+	clientSubflows, serverSubflows := newSubflowPairs(2)
+	client, server := newConn(clientSubflows), newConn(serverSubflows)
+	defer client.Close()
+	defer server.Close()
+
+	go func() { _, _ = client.Write([]byte("hello")) }()
+
+	received := make([]byte, 5)
+	_, err := io.ReadFull(server, received)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(received))
+
+	// the second subflow breaks, unlike its end of stream this is an error
+	serverSubflows[1].Close()
+
+	_, err = server.Read(received)
+	assert.Error(t, err, "read succeeded after subflow failed")
+	assert.False(t, errors.Is(err, io.EOF), "subflow failure reported as end of stream")
+}
+
+func TestConnReadDeadline(t *testing.T) {
+	clientSubflows, serverSubflows := newSubflowPairs(2)
+	client, server := newConn(clientSubflows), newConn(serverSubflows)
+	defer client.Close()
+	defer server.Close()
+
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err := server.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// clearing the deadline allows reading again
+	require.NoError(t, server.SetReadDeadline(time.Time{}))
+	go func() { _, _ = client.Write([]byte("x")) }()
+	b := make([]byte, 1)
+	_, err = server.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, "x", string(b))
+}
+
+func TestConnCloseUnblocksWrite(t *testing.T) {
+	// the server side never reads, hence the writes of the client block
+	clientSubflows, _ := newSubflowPairs(2)
+	client := newConn(clientSubflows)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := client.Write(make([]byte, 4*maxFrameSize))
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		_ = client.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close blocked by pending write")
+	}
+	select {
+	case err := <-errc:
+		assert.Error(t, err, "write succeeded after close")
+	case <-time.After(time.Second):
+		t.Fatal("write not unblocked by close")
+	}
+	assert.ErrorIs(t, client.CloseWrite(), net.ErrClosed)
+}
+
+func TestReadHello(t *testing.T) {
+	id := tunnelID{1, 2, 3}
+	cases := map[string]struct {
+		hello       []byte
+		expected    hello
+		expectedErr bool
+	}{
+		"valid":           {hello: hello{id: id, index: 1, count: 2}.marshal(), expected: hello{id: id, index: 1, count: 2}},
+		"index too large": {hello: hello{id: id, index: 2, count: 2}.marshal(), expectedErr: true},
+		"no subflows":     {hello: hello{id: id}.marshal(), expectedErr: true},
+		"too many":        {hello: hello{id: id, count: MaxSubflows + 1}.marshal(), expectedErr: true},
+		"wrong version":   {hello: append([]byte{version + 1}, hello{id: id, count: 1}.marshal()[1:]...), expectedErr: true},
+		"truncated":       {hello: hello{id: id, count: 1}.marshal()[:4], expectedErr: true},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			h, err := readHello(bytes.NewReader(c.hello))
+			if c.expectedErr {
+				assert.Error(t, err, "expected an error but got none")
+				return
+			}
+			require.NoError(t, err, "unexpected error")
+			assert.Equal(t, c.expected, h)
+		})
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package multipath
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/pkg/pan"
+	"github.com/netsec-ethz/scion-apps/pkg/quicutil"
+)
+
+// handshakeTimeout is the time within which all subflows of a connection must arrive.
+const handshakeTimeout = 10 * time.Second
+
+// Interface guards
+var (
+	_ net.Listener = (*Listener)(nil)
+)
+
+// acceptor accepts the subflows of a listener together with their negotiated
+// application layer protocol. This interface is used to allow for testing.
+type acceptor interface {
+	accept() (net.Conn, string, error)
+	Close() error
+	Addr() net.Addr
+}
+
+type quicAcceptor struct {
+	*pan.QUICListener
+}
+
+func (a quicAcceptor) accept() (net.Conn, string, error) {
+	connection, err := a.Listener.Accept(context.Background())
+	if err != nil {
+		return nil, "", err
+	}
+	stream, err := quicutil.NewSingleStream(connection)
+	if err != nil {
+		return nil, "", err
+	}
+	return stream, connection.ConnectionState().TLS.NegotiatedProtocol, nil
+}
+
+// Listener accepts single stream as well as multipath connections over QUIC. Connections
+// negotiating Proto are grouped by their tunnel ID and returned from Accept once all
+// subflows arrived, all other connections are returned as quicutil.SingleStream.
+type Listener struct {
+	acceptor acceptor
+
+	conns     chan net.Conn
+	acceptErr chan error
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mutex   sync.Mutex
+	pending map[tunnelID][]net.Conn
+}
+
+// NewListener creates a listener on the QUIC listener, which must offer Proto in
+// addition to quicutil.SingleStreamProto.
+func NewListener(quicListener *pan.QUICListener) *Listener {
+	return newListener(quicAcceptor{quicListener})
+}
+
+func newListener(a acceptor) *Listener {
+	l := &Listener{
+		acceptor:  a,
+		conns:     make(chan net.Conn),
+		acceptErr: make(chan error, 1),
+		done:      make(chan struct{}),
+		pending:   make(map[tunnelID][]net.Conn),
+	}
+	go l.run()
+	return l
+}
+
+func (l *Listener) run() {
+	for {
+		conn, proto, err := l.acceptor.accept()
+		if err != nil {
+			l.acceptErr <- err
+			return
+		}
+		if proto != Proto {
+			l.deliver(conn)
+			continue
+		}
+		go l.handshake(conn)
+	}
+}
+
+// handshake reads the hello of a subflow and delivers the connection once all of its
+// subflows arrived.
+func (l *Listener) handshake(subflow net.Conn) {
+	_ = subflow.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	h, err := readHello(subflow)
+	if err != nil {
+		abort(subflow)
+		return
+	}
+	_ = subflow.SetReadDeadline(time.Time{})
+
+	l.mutex.Lock()
+	subflows, ok := l.pending[h.id]
+	if !ok {
+		subflows = make([]net.Conn, h.count)
+		time.AfterFunc(handshakeTimeout, func() { l.expire(h.id) })
+	}
+	if len(subflows) != h.count || subflows[h.index] != nil {
+		l.mutex.Unlock()
+		abort(subflow)
+		return
+	}
+	subflows[h.index] = subflow
+	l.pending[h.id] = subflows
+	for _, s := range subflows {
+		if s == nil {
+			l.mutex.Unlock()
+			return
+		}
+	}
+	delete(l.pending, h.id)
+	l.mutex.Unlock()
+
+	l.deliver(newConn(subflows))
+}
+
+// expire closes the subflows of a connection whose subflows did not all arrive in time.
+func (l *Listener) expire(id tunnelID) {
+	l.mutex.Lock()
+	subflows := l.pending[id]
+	delete(l.pending, id)
+	l.mutex.Unlock()
+
+	for _, s := range subflows {
+		if s != nil {
+			abort(s)
+		}
+	}
+}
+
+// abort closes a subflow without waiting for the peer to acknowledge the shutdown.
+func abort(subflow net.Conn) {
+	_ = subflow.SetDeadline(time.Now())
+	subflow.Close()
+}
+
+func (l *Listener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		abort(conn)
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.acceptErr:
+		// keep returning the error to subsequent calls
+		l.acceptErr <- err
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.acceptor.Close()
+
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		for id, subflows := range l.pending {
+			for _, s := range subflows {
+				if s != nil {
+					abort(s)
+				}
+			}
+			delete(l.pending, id)
+		}
+	})
+	return err
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.acceptor.Addr()
+}
@@ -0,0 +1,114 @@
+// Copyright 2024 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package multipath
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/netsec-ethz/scion-apps/pkg/quicutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type acceptedSubflow struct {
+	conn  net.Conn
+	proto string
+}
+
+type mockAcceptor struct {
+	subflows chan acceptedSubflow
+}
+
+func (a *mockAcceptor) accept() (net.Conn, string, error) {
+	s, ok := <-a.subflows
+	if !ok {
+		return nil, "", net.ErrClosed
+	}
+	return s.conn, s.proto, nil
+}
+
+func (a *mockAcceptor) Close() error {
+	return nil
+}
+
+func (a *mockAcceptor) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func TestListener(t *testing.T) {
+	a := &mockAcceptor{subflows: make(chan acceptedSubflow)}
+	l := newListener(a)
+	defer l.Close()
+
+	// single stream connections are passed through
+	single, singleServer := net.Pipe()
+	defer single.Close()
+	a.subflows <- acceptedSubflow{singleServer, quicutil.SingleStreamProto}
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	assert.Equal(t, singleServer, conn, "single stream connection was not passed through")
+
+	// the subflows of a multipath connection are grouped
+	clientSubflows, serverSubflows := newSubflowPairs(3)
+	dialed := make(chan *Conn, 1)
+	go func() {
+		client, err := Dial(clientSubflows)
+		if err != nil {
+			close(dialed)
+			return
+		}
+		dialed <- client
+	}()
+	for _, s := range serverSubflows {
+		a.subflows <- acceptedSubflow{s, Proto}
+	}
+
+	conn, err = l.Accept()
+	require.NoError(t, err)
+	server, ok := conn.(*Conn)
+	require.True(t, ok, "accepted connection is not a multipath connection")
+	assert.Equal(t, 3, server.Subflows())
+
+	client := <-dialed
+	require.NotNil(t, client, "dialing failed")
+	defer client.Close()
+	go func() {
+		_, _ = client.Write([]byte("hello over several paths"))
+		_ = client.CloseWrite()
+	}()
+	received, err := io.ReadAll(server)
+	require.NoError(t, err)
+	assert.Equal(t, "hello over several paths", string(received))
+
+	// closing the acceptor is reported by Accept
+	close(a.subflows)
+	_, err = l.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestListenerInvalidHello(t *testing.T) {
+	a := &mockAcceptor{subflows: make(chan acceptedSubflow)}
+	l := newListener(a)
+	defer l.Close()
+
+	client, server := net.Pipe()
+	a.subflows <- acceptedSubflow{server, Proto}
+
+	// a hello of a subflow exceeding the number of subflows is rejected
+	_, _ = client.Write(hello{index: 3, count: 2}.marshal())
+	_, err := client.Read(make([]byte, 1))
+	assert.Error(t, err, "subflow with invalid hello was not closed")
+}
@@ -29,6 +29,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/scionproto-contrib/http-proxy/networks"
+	"github.com/scionproto-contrib/http-proxy/networks/multipath"
 )
 
 const (
@@ -117,8 +118,9 @@ func (l *listenerSCION) listen(
 	laddr *snet.UDPAddr,
 	cfg net.ListenConfig,
 ) (networks.Destructor, error) {
+	// multipath is preferred by the server, clients not offering it are served a single stream
 	tlsCfg := &tls.Config{
-		NextProtos:   []string{quicutil.SingleStreamProto},
+		NextProtos:   []string{multipath.Proto, quicutil.SingleStreamProto},
 		Certificates: quicutil.MustGenerateSelfSignedCert(),
 	}
 	quicListener, err := listenQUIC(ctx, network, laddr, tlsCfg, nil)
@@ -129,16 +131,17 @@ func (l *listenerSCION) listen(
 
 	network.Logger().Debug("created new listener", zap.String("addr", laddr.String()))
 	return &reusableListener{
-		SingleStreamListener: &quicutil.SingleStreamListener{QUICListener: quicListener},
-		addr:                 laddr.String(),
-		network:              network,
+		Listener: multipath.NewListener(quicListener),
+		addr:     laddr.String(),
+		network:  network,
 	}, nil
 }
 
-// reusableListener allows reusing the same quicutil.SingleStreamListener.
+// reusableListener allows reusing the same multipath.Listener, which accepts single
+// stream connections as well as connections striped over several paths.
 // It may work in conjunction with a pool implementation to manage usage.
 type reusableListener struct {
-	*quicutil.SingleStreamListener
+	*multipath.Listener
 	addr    string
 	network *Network
 }
@@ -155,7 +158,7 @@ func (l *reusableListener) Destruct() error {
 	l.network.Logger().Debug("destroying listener", zap.String("addr", l.addr))
 	defer l.network.Logger().Debug("destroyed listener", zap.String("addr", l.addr))
 
-	return l.SingleStreamListener.Close()
+	return l.Listener.Close()
 }
 
 func listenQUIC(